@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/mousybusiness/go-web/internal/bench"
+	"github.com/mousybusiness/go-web/web"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type config struct {
+	url         string
+	method      string
+	body        []byte
+	headers     []web.KV
+	token       string
+	rate        float64 // requests per second, open loop, 0 to use concurrency instead
+	concurrency int     // requests in flight when not sending at a rate
+	duration    time.Duration
+	timeout     time.Duration
+}
+
+type report struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	Mode        string            `json:"mode"`
+	TargetRate  float64           `json:"target_rate,omitempty"`
+	Concurrency int               `json:"concurrency,omitempty"`
+	Duration    float64           `json:"duration_s"` // how long requests were sent for
+	Drain       float64           `json:"drain_s"`    // waiting for those in flight afterwards
+	Requests    uint64            `json:"requests"`
+	Throughput  float64           `json:"throughput"` // requests completed per second while sending
+	BytesRead   uint64            `json:"bytes_read"`
+	Latency     bench.Latency     `json:"latency"`
+	Histogram   []bench.Bucket    `json:"histogram"`
+	Status      map[string]uint64 `json:"status"`
+	Errors      map[string]uint64 `json:"errors"`
+}
+
+// sends requests with web.Instance over a pool sized for the load
+type httpClient struct {
+	c *http.Client
+}
+
+func (h httpClient) Do(req *http.Request) (*http.Response, error) {
+	return h.c.Do(req)
+}
+
+func (h httpClient) SetTimeout(timeout time.Duration) {
+	h.c.Timeout = timeout
+}
+
+// the timeout is set once, requests are sent without one so concurrent requests don't
+// race setting it
+func newClient(conns int, timeout time.Duration) httpClient {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = conns
+	t.MaxIdleConnsPerHost = conns
+	return httpClient{c: &http.Client{Transport: t, Timeout: timeout}}
+}
+
+// a benchmark in progress
+type run struct {
+	cfg     config
+	w       *web.Instance
+	headers []web.KV
+
+	latency *bench.Histogram
+	status  *bench.Counter
+	errors  *bench.Counter
+	bytes   uint64
+
+	completed uint64    // requests answered or failed so far
+	sendEnd   time.Time // when sending stopped, the drain follows
+	inWindow  uint64    // requests completed by sendEnd
+}
+
+func newRun(cfg config) (*run, error) {
+	if !strings.HasPrefix(cfg.url, "http://") && !strings.HasPrefix(cfg.url, "https://") {
+		return nil, fmt.Errorf("unsupported url %q, use http or https", cfg.url)
+	}
+	cfg.method = strings.ToUpper(cfg.method)
+	switch cfg.method {
+	case http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return nil, fmt.Errorf("unsupported method %s", cfg.method)
+	}
+	if cfg.rate <= 0 && cfg.concurrency <= 0 {
+		return nil, errors.New("rate or concurrency must be positive")
+	}
+
+	conns := cfg.concurrency
+	if cfg.rate > 0 {
+		// enough for the rate if every request took the whole timeout, within reason
+		conns = int(cfg.rate*cfg.timeout.Seconds()) + 1
+		if conns > 1000 {
+			conns = 1000
+		}
+	}
+	headers := append([]web.KV(nil), cfg.headers...)
+	if cfg.token != "" {
+		headers = append(headers, web.KV{Key: "Authorization", Value: "Bearer " + cfg.token})
+	}
+	return &run{
+		cfg:     cfg,
+		w:       web.NewInstance(newClient(conns, cfg.timeout)),
+		headers: headers,
+		latency: bench.NewHistogram(),
+		status:  bench.NewCounter(),
+		errors:  bench.NewCounter(),
+	}, nil
+}
+
+// sends requests for the duration or until ctx is done, then waits for those in flight
+func (r *run) run(ctx context.Context) report {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.duration)
+	defer cancel()
+
+	start := time.Now()
+	rep := report{URL: r.cfg.url, Method: r.cfg.method}
+	if r.cfg.rate > 0 {
+		rep.Mode, rep.TargetRate = "rate", r.cfg.rate
+		r.openLoop(ctx, start)
+	} else {
+		rep.Mode, rep.Concurrency = "concurrency", r.cfg.concurrency
+		r.closedLoop(ctx)
+	}
+	sending := r.sendEnd.Sub(start)
+
+	rep.Duration = sending.Seconds()
+	rep.Drain = time.Since(r.sendEnd).Seconds()
+	rep.Latency = r.latency.Summary()
+	rep.Requests = rep.Latency.Count
+	// requests completed during the drain would inflate it, the window is over
+	rep.Throughput = float64(r.inWindow) / sending.Seconds()
+	rep.BytesRead = atomic.LoadUint64(&r.bytes)
+	rep.Histogram = r.latency.Buckets(10)
+	rep.Status = r.status.Counts()
+	rep.Errors = r.errors.Counts()
+	return rep
+}
+
+// sends at the target rate whatever the responses take, latency is measured from when
+// each request was due so a slow target can't hide it by slowing the sender
+func (r *run) openLoop(ctx context.Context, start time.Time) {
+	interval := time.Duration(float64(time.Second) / r.cfg.rate)
+	var wg sync.WaitGroup
+	for n := 0; ; n++ {
+		due := start.Add(interval * time.Duration(n))
+		if !sleepUntil(ctx, due) {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.send(due)
+		}()
+	}
+	r.stopSending()
+	wg.Wait()
+}
+
+// keeps concurrency requests in flight, each sent once the previous one returned
+func (r *run) closedLoop(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < r.cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				r.send(time.Now())
+			}
+		}()
+	}
+	<-ctx.Done()
+	r.stopSending()
+	wg.Wait()
+}
+
+// marks the end of the send window, requests still in flight are only drained
+func (r *run) stopSending() {
+	r.sendEnd = time.Now()
+	r.inWindow = atomic.LoadUint64(&r.completed)
+}
+
+func (r *run) send(due time.Time) {
+	code, body, err := r.do()
+	r.latency.Record(time.Since(due))
+	atomic.AddUint64(&r.completed, 1)
+	if err != nil {
+		r.errors.Add(classify(err))
+		return
+	}
+	atomic.AddUint64(&r.bytes, uint64(len(body)))
+	r.status.Add(strconv.Itoa(code))
+}
+
+func (r *run) do() (int, []byte, error) {
+	switch r.cfg.method {
+	case http.MethodPost:
+		return r.w.Post(r.cfg.url, 0, r.cfg.body, r.headers...)
+	case http.MethodPut:
+		return r.w.Put(r.cfg.url, 0, r.cfg.body, r.headers...)
+	case http.MethodPatch:
+		return r.w.Patch(r.cfg.url, 0, r.cfg.body, r.headers...)
+	case http.MethodDelete:
+		return r.w.Delete(r.cfg.url, 0, r.cfg.body, r.headers...)
+	}
+	return r.w.Get(r.cfg.url, 0, r.headers...)
+}
+
+// groups errors into a few classes for the report
+func classify(err error) string {
+	var ne net.Error
+	var dns *net.DNSError
+	var cert x509.UnknownAuthorityError
+	var host x509.HostnameError
+	var rec tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.As(err, &dns):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "connection reset"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.As(err, &cert), errors.As(err, &host), errors.As(err, &rec):
+		return "tls"
+	case errors.As(err, &ne):
+		return "network"
+	}
+	return "other"
+}
+
+// sleeps until t, false if ctx is done first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,125 @@
+// Command webbench drives a url with the web client, either at a fixed request rate,
+// open loop so a slow target can't hold the load back, or with a fixed number of
+// requests in flight. It reports a latency histogram, status codes and error classes.
+//
+//	webbench -url https://example.com/api/users -rate 500 -duration 30s
+//	webbench -url https://example.com/api/users -method POST -body '{"name":"bob"}' -H 'X-Api-Key: key' -c 50 -json report.json
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/mousybusiness/go-web/internal/bench"
+	"github.com/mousybusiness/go-web/web"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// collects repeated -H flags
+type headerFlags []web.KV
+
+func (h *headerFlags) String() string {
+	var s []string
+	for _, kv := range *h {
+		s = append(s, kv.Key+": "+kv.Value)
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return errors.New(`header must look like "Key: Value"`)
+	}
+	*h = append(*h, web.KV{Key: strings.TrimSpace(v[:i]), Value: strings.TrimSpace(v[i+1:])})
+	return nil
+}
+
+func main() {
+	var (
+		cfg        config
+		headers    headerFlags
+		body       string
+		bodyFile   string
+		jsonReport string
+	)
+	flag.StringVar(&cfg.url, "url", "", "url to send requests to")
+	flag.StringVar(&cfg.method, "method", "GET", "GET, POST, PUT, PATCH or DELETE")
+	flag.StringVar(&body, "body", "", "request body")
+	flag.StringVar(&bodyFile, "body-file", "", "read the request body from this file")
+	flag.Var(&headers, "H", `header sent with every request, "Key: Value", can be repeated`)
+	flag.StringVar(&cfg.token, "token", os.Getenv("TOKEN"), "bearer token sent with every request, defaults to $TOKEN")
+	flag.Float64Var(&cfg.rate, "rate", 0, "requests per second, sent whatever the responses take")
+	flag.IntVar(&cfg.concurrency, "c", 10, "requests in flight, used when no rate is set")
+	flag.DurationVar(&cfg.duration, "duration", time.Second*10, "how long requests are sent for")
+	flag.DurationVar(&cfg.timeout, "timeout", time.Second*5, "timeout for every request")
+	flag.StringVar(&jsonReport, "json", "", "write a json report to this file, - for stdout")
+	flag.Parse()
+
+	cfg.headers = headers
+	cfg.body = []byte(body)
+	if bodyFile != "" {
+		b, err := ioutil.ReadFile(bodyFile)
+		if err != nil {
+			log.Fatalln("failed to read body", err)
+		}
+		cfg.body = b
+	}
+
+	r, err := newRun(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// stops early on Control C, still reporting what was measured
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if cfg.rate > 0 {
+		log.Printf("sending %.0f req/s to %s %s for %v", cfg.rate, cfg.method, cfg.url, cfg.duration)
+	} else {
+		log.Printf("sending %d concurrent requests to %s %s for %v", cfg.concurrency, cfg.method, cfg.url, cfg.duration)
+	}
+	rep := r.run(ctx)
+
+	out := io.Writer(os.Stdout)
+	if jsonReport == "-" {
+		out = os.Stderr // keep stdout for the json
+	}
+	printReport(out, rep)
+	if jsonReport != "" {
+		if err := bench.WriteJSON(jsonReport, rep); err != nil {
+			log.Fatalln("failed to write report", err)
+		}
+	}
+}
+
+func printReport(w io.Writer, r report) {
+	fmt.Fprintf(w, "%s %s, %s mode, %.1fs, %.1fs drain\n", r.Method, r.URL, r.Mode, r.Duration, r.Drain)
+	fmt.Fprintf(w, "requests:   %d, %.1f req/s, %d bytes read\n", r.Requests, r.Throughput, r.BytesRead)
+	fmt.Fprintf(w, "latency:    %s\n", r.Latency)
+	if len(r.Histogram) > 0 {
+		fmt.Fprintln(w, "histogram:")
+		bench.WriteBuckets(w, "  ", r.Histogram)
+	}
+	if len(r.Status) > 0 {
+		fmt.Fprintln(w, "status:")
+		bench.WriteCounts(w, "  ", r.Status)
+	}
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(w, "errors:")
+		bench.WriteCounts(w, "  ", r.Errors)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"github.com/mousybusiness/go-web/web"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "POST" || string(b) != `{"name":"bob"}` || r.Header.Get("X-Api-Key") != "key" ||
+			r.Header.Get("Authorization") != "Bearer stub" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&n, 1)%2 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	cfg := config{
+		url:      srv.URL,
+		method:   "post",
+		body:     []byte(`{"name":"bob"}`),
+		headers:  []web.KV{{Key: "X-Api-Key", Value: "key"}},
+		token:    "stub",
+		duration: time.Millisecond * 200,
+		timeout:  time.Second,
+	}
+
+	t.Run("rate", func(t *testing.T) {
+		atomic.StoreInt32(&n, 0)
+		cfg := cfg
+		cfg.rate = 100
+		r, err := newRun(cfg)
+		checkErr(t, err)
+		rep := r.run(context.Background())
+
+		// 200ms at 100 req/s
+		if rep.Mode != "rate" || rep.Requests < 19 || rep.Requests > 21 {
+			t.Fatalf("expected about 20 requests, got %d", rep.Requests)
+		}
+		if rep.Status["200"] == 0 || rep.Status["503"] == 0 || rep.Status["400"] != 0 || len(rep.Errors) != 0 {
+			t.Fatalf("unexpected status %v errors %v", rep.Status, rep.Errors)
+		}
+		if rep.BytesRead != rep.Status["200"]*2 {
+			t.Fatalf("want %d bytes read, got %d", rep.Status["200"]*2, rep.BytesRead)
+		}
+
+		var b bytes.Buffer
+		printReport(&b, rep)
+		for _, s := range []string{"rate mode", "histogram:", "503"} {
+			if !strings.Contains(b.String(), s) {
+				t.Fatalf("expected report to contain %q:\n%s", s, b.String())
+			}
+		}
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		cfg := cfg
+		cfg.concurrency = 4
+		r, err := newRun(cfg)
+		checkErr(t, err)
+		rep := r.run(context.Background())
+		if rep.Mode != "concurrency" || rep.Requests == 0 || rep.Status["400"] != 0 {
+			t.Fatalf("unexpected report %+v", rep)
+		}
+	})
+}
+
+func TestRunDrain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 300)
+	}))
+	defer srv.Close()
+
+	for _, cfg := range []config{
+		{url: srv.URL, method: "GET", rate: 20, duration: time.Millisecond * 200, timeout: time.Second},
+		{url: srv.URL, method: "GET", concurrency: 2, duration: time.Millisecond * 200, timeout: time.Second},
+	} {
+		r, err := newRun(cfg)
+		checkErr(t, err)
+		rep := r.run(context.Background())
+
+		// every response arrives after sending stopped, the drain doesn't count
+		if rep.Duration > 0.25 || rep.Drain < 0.05 {
+			t.Fatalf("expected a 200ms window and a drain, got %.3fs %.3fs", rep.Duration, rep.Drain)
+		}
+		if rep.Requests == 0 || rep.Throughput != 0 {
+			t.Fatalf("expected drained requests not to count towards throughput, got %d at %.1f", rep.Requests, rep.Throughput)
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tt := []struct {
+		url  string
+		want string
+	}{
+		{slow.URL, "timeout"},
+		{closed.URL, "connection refused"},
+	}
+	for _, v := range tt {
+		r, err := newRun(config{url: v.url, method: "GET", rate: 50, duration: time.Millisecond * 50, timeout: time.Millisecond * 20})
+		checkErr(t, err)
+		rep := r.run(context.Background())
+		if rep.Errors[v.want] == 0 || len(rep.Errors) != 1 || len(rep.Status) != 0 {
+			t.Fatalf("%s; want %s errors, got %v %v", v.url, v.want, rep.Errors, rep.Status)
+		}
+	}
+
+	for _, cfg := range []config{
+		{url: "ftp://example.com", method: "GET", rate: 1},
+		{url: "http://example.com", method: "HEAD", rate: 1},
+		{url: "http://example.com", method: "GET"},
+	} {
+		if _, err := newRun(cfg); err == nil {
+			t.Fatalf("expected %+v to be invalid", cfg)
+		}
+	}
+}
+
+func TestHeaderFlags(t *testing.T) {
+	var h headerFlags
+	fs := flag.NewFlagSet("stub", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&h, "H", "")
+	checkErr(t, fs.Parse([]string{"-H", "X-Api-Key: key", "-H", "Accept:text/plain"}))
+	if len(h) != 2 || h[0] != (web.KV{Key: "X-Api-Key", Value: "key"}) || h[1] != (web.KV{Key: "Accept", Value: "text/plain"}) {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	if fs.Parse([]string{"-H", "invalid"}) == nil {
+		t.Fatal("expected header without a colon to be rejected")
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
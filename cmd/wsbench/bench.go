@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/internal/bench"
+	"github.com/mousybusiness/go-web/ws/client"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type config struct {
+	url      string
+	token    string
+	conns    int
+	ramp     time.Duration // spread of connection attempts
+	duration time.Duration // how long messages are sent for once every connection was attempted
+	rate     float64       // messages per second across every connection
+	size     int           // payload bytes
+	method   string        // called on the server, which must answer with a result
+	timeout  time.Duration // for connecting and for each call
+}
+
+type report struct {
+	URL         string            `json:"url"`
+	Connections int               `json:"connections"`
+	Ramp        float64           `json:"ramp_s"`     // spent opening connections, nothing is sent meanwhile
+	Duration    float64           `json:"duration_s"` // spent sending once the connections were open
+	TargetRate  float64           `json:"target_rate"`
+	Rate        float64           `json:"rate"` // results received per second
+	Connect     connectReport     `json:"connect"`
+	Messages    messageReport     `json:"messages"`
+	Disconnects uint64            `json:"disconnects"`
+	RoundTrip   bench.Latency     `json:"round_trip"`
+	Errors      map[string]uint64 `json:"errors"`
+}
+
+type connectReport struct {
+	Attempts uint64        `json:"attempts"`
+	Failures uint64        `json:"failures"`
+	Latency  bench.Latency `json:"latency"`
+}
+
+type messageReport struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+	Failed   uint64 `json:"failed"`
+	Skipped  uint64 `json:"skipped"` // no connection was open to send on
+}
+
+type payload struct {
+	Data string `json:"data"`
+}
+
+// a benchmark in progress
+type run struct {
+	cfg     config
+	secure  bool
+	host    string
+	path    string
+	query   url.Values
+	payload payload
+
+	connectLatency *bench.Histogram
+	roundTrip      *bench.Histogram
+	errors         *bench.Counter
+
+	attempts, connectFailures, disconnects uint64
+	sent, received, failed, skipped        uint64
+
+	mu   sync.Mutex
+	live []*client.Connection
+	next int
+}
+
+func newRun(cfg config) (*run, error) {
+	u, err := url.Parse(cfg.url)
+	if err != nil {
+		return nil, err
+	}
+	r := &run{
+		cfg:            cfg,
+		host:           u.Host,
+		path:           u.Path,
+		query:          u.Query(),
+		payload:        payload{Data: strings.Repeat("x", cfg.size)},
+		connectLatency: bench.NewHistogram(),
+		roundTrip:      bench.NewHistogram(),
+		errors:         bench.NewCounter(),
+	}
+	switch u.Scheme {
+	case "ws", "http":
+	case "wss", "https":
+		r.secure = true
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use ws or wss", u.Scheme)
+	}
+	if r.path == "" {
+		r.path = "/"
+	}
+	if cfg.conns <= 0 || cfg.rate <= 0 {
+		return nil, errors.New("connections and rate must be positive")
+	}
+	return r, nil
+}
+
+// opens the connections over the ramp, then sends at the target rate until the duration
+// has passed or ctx is done
+func (r *run) run(ctx context.Context) report {
+	start := time.Now()
+	connCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var dials, handshakes sync.WaitGroup
+	for i := 0; i < r.cfg.conns; i++ {
+		at := start.Add(r.cfg.ramp * time.Duration(i) / time.Duration(r.cfg.conns))
+		if !sleepUntil(ctx, at) {
+			break
+		}
+		dials.Add(1)
+		handshakes.Add(1)
+		go func(i int) {
+			defer dials.Done()
+			r.connect(connCtx, i, handshakes.Done)
+		}(i)
+	}
+	handshakes.Wait() // bounded by the handshake timeout
+	sending := time.Now()
+
+	end := sending.Add(r.cfg.duration)
+	interval := time.Duration(float64(time.Second) / r.cfg.rate)
+	var calls sync.WaitGroup
+	// open loop, sends are scheduled regardless of how long results take
+	for n := 0; ; n++ {
+		due := sending.Add(interval * time.Duration(n))
+		if !due.Before(end) || !sleepUntil(ctx, due) {
+			break
+		}
+		conn := r.pick()
+		if conn == nil {
+			atomic.AddUint64(&r.skipped, 1)
+			continue
+		}
+		calls.Add(1)
+		go func() {
+			defer calls.Done()
+			r.call(connCtx, conn, due)
+		}()
+	}
+	sleepUntil(ctx, end) // the rate is over the whole window, not up to the last send
+	elapsed := time.Since(sending)
+
+	calls.Wait() // bounded by the call timeout
+	cancel()
+	dials.Wait()
+	r.mu.Lock()
+	for _, c := range r.live {
+		closeConn(c)
+	}
+	r.mu.Unlock()
+
+	return report{
+		URL:         r.cfg.url,
+		Connections: r.cfg.conns,
+		Ramp:        sending.Sub(start).Seconds(),
+		Duration:    elapsed.Seconds(),
+		TargetRate:  r.cfg.rate,
+		Rate:        float64(atomic.LoadUint64(&r.received)) / elapsed.Seconds(),
+		Connect: connectReport{
+			Attempts: atomic.LoadUint64(&r.attempts),
+			Failures: atomic.LoadUint64(&r.connectFailures),
+			Latency:  r.connectLatency.Summary(),
+		},
+		Messages: messageReport{
+			Sent:     atomic.LoadUint64(&r.sent),
+			Received: atomic.LoadUint64(&r.received),
+			Failed:   atomic.LoadUint64(&r.failed),
+			Skipped:  atomic.LoadUint64(&r.skipped),
+		},
+		Disconnects: atomic.LoadUint64(&r.disconnects),
+		RoundTrip:   r.roundTrip.Summary(),
+		Errors:      r.errors.Counts(),
+	}
+}
+
+// dials connection i, calling dialed once it's open or failed to, and keeps reading
+// from it until ctx is done
+func (r *run) connect(ctx context.Context, i int, dialed func()) {
+	atomic.AddUint64(&r.attempts, 1)
+	q := url.Values{}
+	for k, v := range r.query {
+		q[k] = v
+	}
+	// identifies the connection to servers started with -serve
+	q.Set("uid", fmt.Sprintf("wsbench-%d-%d", os.Getpid(), i))
+
+	d := &websocket.Dialer{HandshakeTimeout: r.cfg.timeout, Proxy: websocket.DefaultDialer.Proxy}
+	start := time.Now()
+	conn, err := client.NewConnection(d, r.secure, fmt.Sprintf("wsbench-%d", i), r.host, r.path, r.cfg.token, q.Encode())
+	if err != nil {
+		atomic.AddUint64(&r.connectFailures, 1)
+		r.errors.Add("connect: " + classify(err))
+		dialed()
+		return
+	}
+	r.connectLatency.Record(time.Since(start))
+
+	msgCh := make(chan []byte)
+	conn.Read(ctx, msgCh)
+	r.mu.Lock()
+	r.live = append(r.live, conn)
+	r.mu.Unlock()
+	dialed()
+
+	// drains anything the server sends besides results, the channel closes when the
+	// connection is lost
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, open := <-msgCh:
+			if open {
+				continue
+			}
+			if ctx.Err() == nil {
+				atomic.AddUint64(&r.disconnects, 1)
+				r.errors.Add("disconnected")
+				r.remove(conn)
+			}
+			return
+		}
+	}
+}
+
+// round trips are measured from when the call was due, so a slow server can't hide
+// it by holding up the sender
+func (r *run) call(ctx context.Context, conn *client.Connection, due time.Time) {
+	ctx, cancel := context.WithTimeout(ctx, r.cfg.timeout)
+	defer cancel()
+	atomic.AddUint64(&r.sent, 1)
+	if err := conn.Call(ctx, r.cfg.method, r.payload, nil); err != nil {
+		atomic.AddUint64(&r.failed, 1)
+		r.errors.Add("call: " + classify(err))
+		return
+	}
+	r.roundTrip.Record(time.Since(due))
+	atomic.AddUint64(&r.received, 1)
+}
+
+// the next open connection, round robin
+func (r *run) pick() *client.Connection {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.live) == 0 {
+		return nil
+	}
+	r.next = (r.next + 1) % len(r.live)
+	return r.live[r.next]
+}
+
+func (r *run) remove(conn *client.Connection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, c := range r.live {
+		if c == conn {
+			r.live = append(r.live[:i], r.live[i+1:]...)
+			return
+		}
+	}
+}
+
+func closeConn(c *client.Connection) {
+	if wc, ok := c.Conn.(*websocket.Conn); ok {
+		_ = wc.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		_ = wc.Close()
+	}
+}
+
+// groups errors into a few classes for the report
+func classify(err error) string {
+	var e *envelope.Error
+	var ne net.Error
+	var ce *websocket.CloseError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &e):
+		return "server " + e.Code
+	case errors.As(err, &ce):
+		return fmt.Sprintf("closed %d", ce.Code)
+	case errors.Is(err, websocket.ErrBadHandshake):
+		return "bad handshake"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.As(err, &ne):
+		return "network"
+	}
+	return "other"
+}
+
+// sleeps until t, false if ctx is done first
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+// Command wsbench measures how many connections and messages per second a websocket
+// deployment handles. It opens connections with ws/client, calls a method answering
+// with a result at a target rate across them and reports round trip latency, connect
+// failures and disconnects.
+//
+//	wsbench -serve :8080
+//	wsbench -url ws://localhost:8080/ws -conns 1000 -ramp 10s -rate 5000 -duration 30s -json report.json
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/mousybusiness/go-web/internal/bench"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func main() {
+	var (
+		cfg        config
+		serveAddr  string
+		jsonReport string
+	)
+	flag.StringVar(&cfg.url, "url", "ws://localhost:8080/ws", "websocket url to connect to")
+	flag.StringVar(&cfg.token, "token", os.Getenv("TOKEN"), "bearer token sent with every connection, defaults to $TOKEN")
+	flag.IntVar(&cfg.conns, "conns", 100, "connections to open")
+	flag.DurationVar(&cfg.ramp, "ramp", time.Second*5, "time over which connections are opened")
+	flag.DurationVar(&cfg.duration, "duration", time.Second*30, "time messages are sent for once every connection was opened")
+	flag.Float64Var(&cfg.rate, "rate", 100, "messages per second across every connection")
+	flag.IntVar(&cfg.size, "size", 64, "payload size in bytes")
+	flag.StringVar(&cfg.method, "method", "echo", "method called, the server must answer it with a result")
+	flag.DurationVar(&cfg.timeout, "timeout", time.Second*5, "timeout for connecting and for every call")
+	flag.StringVar(&serveAddr, "serve", "", "serve an echo server to benchmark on this address instead")
+	flag.StringVar(&jsonReport, "json", "", "write a json report to this file, - for stdout")
+	flag.Parse()
+
+	if serveAddr != "" {
+		log.Println("serving echo on", serveAddr+"/ws")
+		log.Fatalln(serve(serveAddr))
+	}
+
+	r, err := newRun(cfg)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// stops early on Control C, still reporting what was measured
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	log.Printf("opening %d connections to %s over %v, sending %.0f msg/s for %v", cfg.conns, cfg.url, cfg.ramp, cfg.rate, cfg.duration)
+	rep := r.run(ctx)
+
+	out := io.Writer(os.Stdout)
+	if jsonReport == "-" {
+		out = os.Stderr // keep stdout for the json
+	}
+	printReport(out, rep)
+	if jsonReport != "" {
+		if err := bench.WriteJSON(jsonReport, rep); err != nil {
+			log.Fatalln("failed to write report", err)
+		}
+	}
+}
+
+func printReport(w io.Writer, r report) {
+	fmt.Fprintf(w, "%s, %d connections opened over %.1fs, sending for %.1fs\n", r.URL, r.Connections, r.Ramp, r.Duration)
+	fmt.Fprintf(w, "connect:     %d attempts, %d failed, %s\n", r.Connect.Attempts, r.Connect.Failures, r.Connect.Latency)
+	fmt.Fprintf(w, "messages:    %d sent, %d received, %d failed, %d skipped\n", r.Messages.Sent, r.Messages.Received, r.Messages.Failed, r.Messages.Skipped)
+	fmt.Fprintf(w, "rate:        %.1f msg/s of %.1f targeted\n", r.Rate, r.TargetRate)
+	fmt.Fprintf(w, "round trip:  %s\n", r.RoundTrip)
+	fmt.Fprintf(w, "disconnects: %d\n", r.Disconnects)
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(w, "errors:")
+		bench.WriteCounts(w, "  ", r.Errors)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := httptest.NewServer(echoHandler())
+	defer srv.Close()
+
+	r, err := newRun(config{
+		url:      "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+		conns:    5,
+		ramp:     time.Millisecond * 50,
+		duration: time.Millisecond * 200,
+		rate:     200,
+		size:     16,
+		method:   "echo",
+		timeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := r.run(context.Background())
+
+	if rep.Connect.Attempts != 5 || rep.Connect.Failures != 0 || rep.Connect.Latency.Count != 5 {
+		t.Fatalf("unexpected connect report %+v", rep.Connect)
+	}
+	m := rep.Messages
+	if m.Received == 0 || m.Failed != 0 || m.Sent != m.Received || rep.RoundTrip.Count != m.Received {
+		t.Fatalf("unexpected messages report %+v %+v", m, rep.Errors)
+	}
+	// 200ms at 200 msg/s, only once every connection is open
+	if m.Skipped != 0 || m.Sent < 36 || m.Sent > 41 {
+		t.Fatalf("expected about 40 messages sent, got %+v", m)
+	}
+	if rep.Ramp < 0.04 || rep.Duration < 0.2 || rep.Rate > 205 {
+		t.Fatalf("expected the ramp to be reported apart from sending, got %.3fs, %.3fs at %.1f msg/s", rep.Ramp, rep.Duration, rep.Rate)
+	}
+	if rep.Disconnects != 0 {
+		t.Fatalf("unexpected disconnects %d", rep.Disconnects)
+	}
+
+	var b bytes.Buffer
+	printReport(&b, rep)
+	if !strings.Contains(b.String(), "5 attempts, 0 failed") {
+		t.Fatalf("unexpected text report:\n%s", b.String())
+	}
+}
+
+func TestRunConnectFailures(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	r, err := newRun(config{
+		url:      "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws",
+		conns:    3,
+		duration: time.Millisecond * 50,
+		rate:     100,
+		method:   "echo",
+		timeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := r.run(context.Background())
+	if rep.Connect.Failures != 3 || rep.Errors["connect: bad handshake"] != 3 || rep.Messages.Sent != 0 {
+		t.Fatalf("unexpected report %+v", rep)
+	}
+
+	if _, err := newRun(config{url: "tcp://localhost", conns: 1, rate: 1}); err == nil {
+		t.Fatal("expected unsupported scheme to fail")
+	}
+}
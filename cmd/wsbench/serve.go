@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/server"
+	"net/http"
+)
+
+// answers echo calls with their params, connections are identified by the uid query
+// parameter wsbench sets
+func echoHandler() http.Handler {
+	r := server.NewRouter()
+	r.HandleCall("echo", func(ctx context.Context, c *server.ConnectedClient, p json.RawMessage) (json.RawMessage, error) {
+		return p, nil
+	})
+	return server.NewHandler(func(r *http.Request) (string, error) {
+		uid := r.URL.Query().Get("uid")
+		if uid == "" {
+			return "", errors.New("uid query parameter missing")
+		}
+		return uid, nil
+	}, r)
+}
+
+func serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", echoHandler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -2,21 +2,16 @@ package main
 
 import (
 	"errors"
-	"github.com/mousybusiness/go-web/web"
 	"github.com/mousybusiness/go-web/web/webtest"
 	"net/http"
 	"testing"
 )
 
-func init() {
-	web.Client = webtest.MockClient{}
-}
-
 func TestMockedFunction(t *testing.T) {
-	// mock status code
-	webtest.DoFunc = func(req *http.Request) (*http.Response, error) {
+	// mock status code, web.Client is restored once the test ends
+	m := webtest.NewMock(t).DoFunc(func(req *http.Request) (*http.Response, error) {
 		return webtest.MockResponse(400, "bad request", nil)
-	}
+	})
 
 	code, _ := MockedFunction()
 	if code != 400 {
@@ -24,9 +19,9 @@ func TestMockedFunction(t *testing.T) {
 	}
 
 	// mock error
-	webtest.DoFunc = func(req *http.Request) (*http.Response, error) {
+	m.DoFunc(func(req *http.Request) (*http.Response, error) {
 		return webtest.MockResponse(0, "errorororor", errors.New("an error"))
-	}
+	})
 
 	_, err := MockedFunction()
 	if err == nil {
@@ -5,9 +5,8 @@ go 1.15
 require (
 	firebase.google.com/go v3.13.0+incompatible
 	github.com/gin-gonic/gin v1.6.3
-	github.com/gobwas/httphead v0.1.0 // indirect
-	github.com/gobwas/pool v0.2.1 // indirect
-	github.com/gobwas/ws v1.0.4
+	github.com/gobwas/httphead v0.1.0
+	github.com/gobwas/ws v1.1.0
 	github.com/gorilla/websocket v1.4.2
 	github.com/mousybusiness/googlecloudgo v0.2.0
 	github.com/pkg/errors v0.9.1
@@ -0,0 +1,129 @@
+// Package bench holds what the load testing commands share: latency histograms,
+// counters and reports
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency summarizes a Histogram, durations are reported in milliseconds
+type Latency struct {
+	Count uint64  `json:"count"`
+	Mean  float64 `json:"mean_ms"`
+	Min   float64 `json:"min_ms"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	P999  float64 `json:"p999_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func (h *Histogram) Summary() Latency {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.n == 0 {
+		return Latency{}
+	}
+	return Latency{
+		Count: h.n,
+		Mean:  ms(h.sum / time.Duration(h.n)),
+		Min:   ms(h.min),
+		P50:   ms(h.percentile(50)),
+		P90:   ms(h.percentile(90)),
+		P99:   ms(h.percentile(99)),
+		P999:  ms(h.percentile(99.9)),
+		Max:   ms(h.max),
+	}
+}
+
+func (l Latency) String() string {
+	return fmt.Sprintf("mean %.2fms, min %.2fms, p50 %.2fms, p90 %.2fms, p99 %.2fms, p99.9 %.2fms, max %.2fms",
+		l.Mean, l.Min, l.P50, l.P90, l.P99, l.P999, l.Max)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Counter counts occurrences by key, safe for concurrent use
+type Counter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func NewCounter() *Counter {
+	return &Counter{counts: make(map[string]uint64)}
+}
+
+func (c *Counter) Add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[key]++
+}
+
+// copy of the counts
+func (c *Counter) Counts() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		m[k] = v
+	}
+	return m
+}
+
+// writes counts one per line, highest first, each prefixed with indent
+func WriteCounts(w io.Writer, indent string, counts map[string]uint64) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%-24s %d\n", indent, k, counts[k])
+	}
+}
+
+// draws buckets as bars, each prefixed with indent
+func WriteBuckets(w io.Writer, indent string, buckets []Bucket) {
+	var most uint64
+	for _, b := range buckets {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+	for _, b := range buckets {
+		bar := 0
+		if most > 0 {
+			bar = int(b.Count * 40 / most)
+		}
+		fmt.Fprintf(w, "%s%10.2fms - %10.2fms %8d %s\n", indent, b.FromMs, b.ToMs, b.Count, strings.Repeat("#", bar))
+	}
+}
+
+// writes v as indented json to path, or to stdout when path is "-"
+func WriteJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if path == "-" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
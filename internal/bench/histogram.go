@@ -0,0 +1,165 @@
+package bench
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// nanoseconds below 2*subBuckets get a bucket each, above they share buckets
+// 1/subBuckets of their power of two wide, so percentiles are within 1% of the
+// recorded values
+const (
+	subBits    = 7
+	subBuckets = 1 << subBits
+)
+
+// Histogram records durations in constant memory, safe for concurrent use
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	n      uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, (64-subBits)*subBuckets)}
+}
+
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[index(d)]++
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.n++
+	h.sum += d
+}
+
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+// duration below which p percent of the recorded durations fall, p between 0 and 100
+func (h *Histogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.percentile(p)
+}
+
+func (h *Histogram) percentile(p float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(p / 100 * float64(h.n))
+	if rank >= h.n {
+		return h.max
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			d := value(i)
+			// the bucket's midpoint may lie outside what was recorded
+			if d > h.max {
+				return h.max
+			}
+			if d < h.min {
+				return h.min
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// Bucket counts the durations recorded between From and To
+type Bucket struct {
+	From  time.Duration `json:"-"`
+	To    time.Duration `json:"-"`
+	Count uint64        `json:"count"`
+
+	FromMs float64 `json:"from_ms"`
+	ToMs   float64 `json:"to_ms"`
+}
+
+// the recorded durations spread over n buckets of exponentially growing width, from
+// the minimum to the maximum
+func (h *Histogram) Buckets(n int) []Bucket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.n == 0 || n <= 0 {
+		return nil
+	}
+	lo, hi := float64(h.min), float64(h.max)
+	if lo < 1 {
+		lo = 1
+	}
+	if hi <= lo {
+		return []Bucket{newBucket(h.min, h.max, h.n)}
+	}
+
+	// bounds grow by a constant factor
+	bounds := make([]time.Duration, n+1)
+	factor := math.Pow(hi/lo, 1/float64(n))
+	b := lo
+	for i := range bounds {
+		bounds[i] = time.Duration(b)
+		b *= factor
+	}
+	bounds[0], bounds[n] = h.min, h.max
+
+	out := make([]Bucket, n)
+	for i := range out {
+		out[i] = newBucket(bounds[i], bounds[i+1], 0)
+	}
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		d := value(i)
+		j := 0
+		for j < n-1 && d >= bounds[j+1] {
+			j++
+		}
+		out[j].Count += c
+	}
+	return out
+}
+
+func newBucket(from, to time.Duration, n uint64) Bucket {
+	return Bucket{From: from, To: to, Count: n, FromMs: ms(from), ToMs: ms(to)}
+}
+
+// bucket of d
+func index(d time.Duration) int {
+	v := uint64(d)
+	if v < 2*subBuckets {
+		return int(v)
+	}
+	// keeps the top subBits+1 bits, between subBuckets and 2*subBuckets
+	shift := bits.Len64(v) - subBits - 1
+	return shift*subBuckets + int(v>>uint(shift))
+}
+
+// midpoint of bucket i
+func value(i int) time.Duration {
+	if i < 2*subBuckets {
+		return time.Duration(i)
+	}
+	shift := i/subBuckets - 1
+	lo := uint64(i%subBuckets+subBuckets) << uint(shift)
+	return time.Duration(lo + (uint64(1)<<uint(shift))/2)
+}
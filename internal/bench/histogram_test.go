@@ -0,0 +1,79 @@
+package bench
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram()
+	if h.Percentile(50) != 0 || h.Summary() != (Latency{}) {
+		t.Fatal("empty histogram should report zeros")
+	}
+
+	// 1ms to 10s
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w + 1; i <= 10000; i += 4 {
+				h.Record(time.Duration(i) * time.Millisecond)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if h.Count() != 10000 {
+		t.Fatalf("count; want: %v, got: %v", 10000, h.Count())
+	}
+	tt := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{50, time.Second * 5},
+		{90, time.Second * 9},
+		{99, time.Millisecond * 9900},
+		{100, time.Second * 10},
+	}
+	for _, v := range tt {
+		got := h.Percentile(v.p)
+		if math.Abs(float64(got-v.want)) > float64(v.want)/100 {
+			t.Fatalf("p%v; want: %v within 1%%, got: %v", v.p, v.want, got)
+		}
+	}
+
+	s := h.Summary()
+	if s.Min != 1 || s.Max != 10000 || math.Abs(s.Mean-5000.5) > 0.01 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+
+	var n uint64
+	buckets := h.Buckets(10)
+	for i, b := range buckets {
+		n += b.Count
+		if i > 0 && b.From != buckets[i-1].To {
+			t.Fatalf("buckets should be contiguous, got %+v", buckets)
+		}
+	}
+	if len(buckets) != 10 || n != 10000 {
+		t.Fatalf("buckets should hold every duration, got %d in %d", n, len(buckets))
+	}
+}
+
+func TestHistogramIndex(t *testing.T) {
+	prev := -1
+	for _, d := range []time.Duration{0, 1, 255, 256, 257, 1000, time.Millisecond, time.Hour, math.MaxInt64} {
+		i := index(d)
+		if i < prev {
+			t.Fatalf("index should grow with the duration, %v got %d after %d", d, i, prev)
+		}
+		prev = i
+		if v := value(i); math.Abs(float64(v-d)) > float64(d)/100+1 {
+			t.Fatalf("bucket of %v should be within 1%%, got %v", d, v)
+		}
+	}
+}
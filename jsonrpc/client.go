@@ -0,0 +1,138 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	errs "github.com/pkg/errors"
+	"strconv"
+	"sync"
+)
+
+// Transport sends requests, as a batch or one at a time, and returns the responses to
+// those that are not notifications in any order
+type Transport interface {
+	Send(ctx context.Context, reqs []Request, batch bool) ([]Response, error)
+}
+
+// Client sends JSON-RPC 2.0 requests over a Transport
+type Client struct {
+	Transport Transport
+
+	mu     sync.Mutex
+	lastID uint64
+}
+
+// BatchElem is one request of a batch, Error is set when the call failed
+type BatchElem struct {
+	Method string
+	Params interface{}
+	Result interface{} // unmarshalled into unless nil
+	Notify bool        // send without an id, expecting no response
+	Error  error
+}
+
+// creates a new Client sending over t
+func NewClient(t Transport) *Client {
+	return &Client{Transport: t}
+}
+
+// calls method with params and unmarshals the result into result if it is not nil,
+// errors returned by the server are *Error
+func (c *Client) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	req, err := c.request(method, params, false)
+	if err != nil {
+		return err
+	}
+
+	resps, err := c.Transport.Send(ctx, []Request{req}, false)
+	if err != nil {
+		return err
+	}
+	for _, r := range resps {
+		if idKey(r.ID) == idKey(req.ID) {
+			return decode(r, result)
+		}
+	}
+	return errs.Errorf("no response for %s", method)
+}
+
+// sends method with params as a notification, the server sends no response
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	req, err := c.request(method, params, true)
+	if err != nil {
+		return err
+	}
+	_, err = c.Transport.Send(ctx, []Request{req}, false)
+	return err
+}
+
+// sends every element in a single batch, errors of individual calls are set on the
+// element, only transport failures are returned
+func (c *Client) Batch(ctx context.Context, elems []BatchElem) error {
+	if len(elems) == 0 {
+		return errs.New("empty batch")
+	}
+
+	reqs := make([]Request, len(elems))
+	byID := make(map[string]int, len(elems))
+	for i, e := range elems {
+		req, err := c.request(e.Method, e.Params, e.Notify)
+		if err != nil {
+			return err
+		}
+		reqs[i] = req
+		if !e.Notify {
+			byID[idKey(req.ID)] = i
+		}
+	}
+
+	resps, err := c.Transport.Send(ctx, reqs, true)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resps {
+		i, ok := byID[idKey(r.ID)]
+		if !ok {
+			continue
+		}
+		delete(byID, idKey(r.ID))
+		elems[i].Error = decode(r, elems[i].Result)
+	}
+	for _, i := range byID {
+		elems[i].Error = errs.Errorf("no response for %s", elems[i].Method)
+	}
+	return nil
+}
+
+func (c *Client) request(method string, params interface{}, notify bool) (Request, error) {
+	if method == "" {
+		return Request{}, errs.New("method is empty")
+	}
+
+	req := Request{JSONRPC: Version, Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return Request{}, errs.Wrapf(err, "failed to marshal %s params", method)
+		}
+		req.Params = b
+	}
+	if !notify {
+		c.mu.Lock()
+		c.lastID++
+		req.ID = json.RawMessage(strconv.FormatUint(c.lastID, 10))
+		c.mu.Unlock()
+	}
+	return req, nil
+}
+
+func decode(r Response, result interface{}) error {
+	if r.Error != nil {
+		return r.Error
+	}
+	if result == nil || len(r.Result) == 0 {
+		return nil
+	}
+	return errs.Wrap(json.Unmarshal(r.Result, result), "invalid result")
+}
@@ -0,0 +1,256 @@
+package jsonrpc
+
+import (
+	"context"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/client"
+	"github.com/mousybusiness/go-web/ws/server"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// websocket connection answering every write with the jsonrpc server
+type loopbackConn struct {
+	s     *Server
+	reads chan []byte
+}
+
+func (l loopbackConn) WriteMessage(messageType int, data []byte) error {
+	go func() {
+		if res := l.s.Handle(context.Background(), data); res != nil {
+			l.reads <- res
+		}
+	}()
+	return nil
+}
+
+func (l loopbackConn) ReadMessage() (int, []byte, error) {
+	return 1, <-l.reads, nil
+}
+
+func testClient(t *testing.T, c *Client) {
+	t.Helper()
+	ctx := context.Background()
+
+	var n int
+	checkErr(t, c.Call(ctx, "sum", []int{1, 2, 3}, &n))
+	if n != 6 {
+		t.Fatalf("call result; want: %v, got: %v", 6, n)
+	}
+
+	err := c.Call(ctx, "missing", nil, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeMethodNotFound {
+		t.Fatalf("expected method not found, got: %v", err)
+	}
+
+	checkErr(t, c.Notify(ctx, "sum", []int{1}))
+
+	var a, b int
+	batch := []BatchElem{
+		{Method: "sum", Params: []int{1, 1}, Result: &a},
+		{Method: "sum", Params: []int{1}, Notify: true},
+		{Method: "subtract", Params: []int{5, 1}, Result: &b},
+		{Method: "fail"},
+	}
+	checkErr(t, c.Batch(ctx, batch))
+	if a != 2 || b != 4 {
+		t.Fatalf("batch results; want: %v %v, got: %v %v", 2, 4, a, b)
+	}
+	checkErr(t, batch[0].Error)
+	checkErr(t, batch[1].Error)
+	checkErrNil(t, batch[3].Error)
+
+	checkErrNil(t, c.Batch(ctx, nil))
+}
+
+func TestHTTPClient(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := httptest.NewServer(newTestServer())
+	defer srv.Close()
+
+	testClient(t, NewClient(&HTTPTransport{URL: srv.URL, Timeout: time.Second}))
+
+	// not a jsonrpc endpoint
+	bad := httptest.NewServer(nil)
+	defer bad.Close()
+	checkErrNil(t, NewClient(&HTTPTransport{URL: bad.URL}).Call(context.Background(), "sum", nil, nil))
+}
+
+func TestWSClient(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	conn := &client.Connection{Name: "stub", Conn: loopbackConn{s: newTestServer(), reads: make(chan []byte)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// messages that aren't responses still reach the read channel
+	msgCh := make(chan []byte, 1)
+	conn.Read(ctx, msgCh)
+
+	testClient(t, NewClient(NewWSTransport(conn)))
+
+	// unanswered requests time out
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*20)
+	defer tcancel()
+	c := NewClient(NewWSTransport(&client.Connection{Name: "stub", Conn: loopbackConn{s: NewServer(), reads: make(chan []byte)}}))
+	checkErrNil(t, c.Notify(tctx, "", nil))
+	err := c.Call(tctx, "sum", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+}
+
+// answers once n requests were written, in reverse order
+type heldConn struct {
+	s       *Server
+	n       int
+	written chan []byte
+	reads   chan []byte
+}
+
+func (c heldConn) WriteMessage(messageType int, data []byte) error {
+	c.written <- data
+	return nil
+}
+
+func (c heldConn) ReadMessage() (int, []byte, error) {
+	return 1, <-c.reads, nil
+}
+
+func (c heldConn) answer() {
+	held := make([][]byte, c.n)
+	for i := range held {
+		held[i] = <-c.written
+	}
+	for i := len(held) - 1; i >= 0; i-- {
+		c.reads <- c.s.Handle(context.Background(), held[i])
+	}
+}
+
+func TestWSTransportShared(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	hc := heldConn{s: newTestServer(), n: 2, written: make(chan []byte, 2), reads: make(chan []byte)}
+	go hc.answer()
+	conn := &client.Connection{Name: "stub", Conn: hc}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn.Read(ctx, nil)
+
+	// both clients number their requests from 1, both are pending at once
+	tr := NewWSTransport(conn)
+	var wg sync.WaitGroup
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var n int
+			if err := NewClient(tr).Call(ctx, "sum", []int{i}, &n); err != nil || n != i {
+				t.Errorf("client %d; want: %v, got: %v %v", i, i, n, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// answers every message with an error the server couldn't attach to a request
+type nullIDConn struct {
+	reads chan []byte
+}
+
+func (c nullIDConn) WriteMessage(messageType int, data []byte) error {
+	go func() {
+		c.reads <- []byte(`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`)
+	}()
+	return nil
+}
+
+func (c nullIDConn) ReadMessage() (int, []byte, error) {
+	return 1, <-c.reads, nil
+}
+
+func TestWSTransportNullID(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	conn := &client.Connection{Name: "stub", Conn: nullIDConn{reads: make(chan []byte)}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn.Read(ctx, nil)
+
+	err := NewClient(NewWSTransport(conn)).Call(ctx, "sum", []int{1}, nil)
+	var e *Error
+	if !errors.As(err, &e) || e.Code != CodeParseError {
+		t.Fatalf("expected parse error, got: %v", err)
+	}
+}
+
+// server side websocket io fed from a channel
+type chanServer struct {
+	reads   chan []byte
+	written chan []byte
+}
+
+func (c chanServer) WriteMessage(conn *server.CleanableConnection, b []byte) error {
+	c.written <- b
+	return nil
+}
+
+func (c chanServer) ReadMessage(conn *server.CleanableConnection) ([]byte, error) {
+	b, open := <-c.reads
+	if !open {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+type nopConn struct{}
+
+func (nopConn) GetConnection() io.ReadWriteCloser { return nopRWCloser{} }
+func (nopConn) CleanUp(uid string) error          { return nil }
+
+type nopRWCloser struct{}
+
+func (nopRWCloser) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (nopRWCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopRWCloser) Close() error                { return nil }
+
+func TestServeConn(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	cs := chanServer{reads: make(chan []byte), written: make(chan []byte, 1)}
+	server.Server = cs
+	cc := server.NewConnection("jsonrpc-uid", nopConn{})
+
+	s := NewServer()
+	s.Register("whoami", func(ctx context.Context, p struct{}) (string, error) {
+		return ConnFromContext(ctx).UID(), nil
+	})
+
+	done := make(chan error)
+	go func() { done <- s.ServeConn(context.Background(), cc) }()
+
+	cs.reads <- []byte(`{"jsonrpc":"2.0","method":"whoami","id":1}`)
+	select {
+	case b := <-cs.written:
+		if string(b) != `{"jsonrpc":"2.0","result":"jsonrpc-uid","id":1}` {
+			t.Fatalf("invalid response: %s", b)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("expected response before timeout")
+	}
+
+	close(cs.reads)
+	select {
+	case err := <-done:
+		checkErr(t, err)
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("serve should return once the connection is cleaned up")
+	}
+}
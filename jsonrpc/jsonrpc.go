@@ -0,0 +1,86 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the only protocol version spoken
+const Version = "2.0"
+
+// error codes defined by the JSON-RPC 2.0 specification
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerError is used for handler errors that are not an *Error
+	CodeServerError = -32000
+)
+
+// Request is a call, or a notification when it has no ID
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// true when no response is expected
+func (r Request) IsNotification() bool {
+	return len(r.ID) == 0
+}
+
+// Response answers the request with the same ID, it carries either a Result or an Error
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// always includes result on success, even when it is null, as the specification requires
+func (r Response) MarshalJSON() ([]byte, error) {
+	type response Response
+	if r.Error != nil {
+		return json.Marshal(response(r))
+	}
+	result := r.Result
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	return json.Marshal(struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  json.RawMessage `json:"result"`
+		ID      json.RawMessage `json:"id"`
+	}{r.JSONRPC, result, r.ID})
+}
+
+// Error is a JSON-RPC error object
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// creates an error with the given code
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// true when b holds a batch rather than a single object
+func isBatch(b []byte) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	return len(b) > 0 && b[0] == '['
+}
+
+// normalizes an id for use as a map key
+func idKey(id json.RawMessage) string {
+	return string(bytes.TrimSpace(id))
+}
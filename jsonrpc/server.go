@@ -0,0 +1,214 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/server"
+	errs "github.com/pkg/errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+type connKey struct{}
+
+// the websocket connection a request arrived on, nil for http requests
+func ConnFromContext(ctx context.Context) *server.ConnectedClient {
+	c, _ := ctx.Value(connKey{}).(*server.ConnectedClient)
+	return c
+}
+
+// Server dispatches JSON-RPC 2.0 requests to registered methods
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]method
+}
+
+type method struct {
+	fn     reflect.Value
+	params reflect.Type
+}
+
+// creates an empty Server
+func NewServer() *Server {
+	return &Server{methods: make(map[string]method)}
+}
+
+// registers fn for name, fn must be of the form func(context.Context, P) (R, error) where
+// P is unmarshalled from the params and R is the result, return an *Error to choose the
+// error code sent back. Panics if fn is not a valid method
+func (s *Server) Register(name string, fn interface{}) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.In(0) != contextType || t.NumOut() != 2 || t.Out(1) != errorType {
+		panic(errs.Errorf("jsonrpc method %s must be func(context.Context, P) (R, error), got %s", name, t))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[name] = method{fn: v, params: t.In(1)}
+}
+
+// handles a single request or a batch, returning the encoded response or nil when
+// there is nothing to send back
+func (s *Server) Handle(ctx context.Context, b []byte) []byte {
+	var out interface{}
+	if isBatch(b) {
+		var raw []json.RawMessage
+		if err := json.Unmarshal(b, &raw); err != nil {
+			out = errorResponse(nil, NewError(CodeParseError, err.Error()))
+		} else if len(raw) == 0 {
+			out = errorResponse(nil, NewError(CodeInvalidRequest, "empty batch"))
+		} else {
+			var resps []Response
+			for _, r := range raw {
+				if resp := s.handleOne(ctx, r); resp != nil {
+					resps = append(resps, *resp)
+				}
+			}
+			if len(resps) == 0 {
+				return nil
+			}
+			out = resps
+		}
+	} else {
+		resp := s.handleOne(ctx, b)
+		if resp == nil {
+			return nil
+		}
+		out = resp
+	}
+
+	res, err := json.Marshal(out)
+	if err != nil {
+		log.Println("failed to marshal jsonrpc response,", err)
+		res, _ = json.Marshal(errorResponse(nil, NewError(CodeInternalError, "failed to marshal response")))
+	}
+	return res
+}
+
+func (s *Server) handleOne(ctx context.Context, b []byte) *Response {
+	var req Request
+	if err := json.Unmarshal(b, &req); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			return errorResponse(nil, NewError(CodeParseError, err.Error()))
+		}
+		return errorResponse(nil, NewError(CodeInvalidRequest, err.Error()))
+	}
+	if req.JSONRPC != Version || req.Method == "" || !validID(req.ID) {
+		return errorResponse(req.ID, NewError(CodeInvalidRequest, "invalid request"))
+	}
+
+	s.mu.RLock()
+	m, ok := s.methods[req.Method]
+	s.mu.RUnlock()
+	if !ok {
+		return reply(req, errorResponse(req.ID, NewError(CodeMethodNotFound, "method not found: "+req.Method)))
+	}
+
+	params := reflect.New(m.params)
+	if len(req.Params) != 0 {
+		if err := json.Unmarshal(req.Params, params.Interface()); err != nil {
+			return reply(req, errorResponse(req.ID, NewError(CodeInvalidParams, err.Error())))
+		}
+	}
+
+	out := m.fn.Call([]reflect.Value{reflect.ValueOf(ctx), params.Elem()})
+	if err, _ := out[1].Interface().(error); err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			e = NewError(CodeServerError, err.Error())
+		}
+		return reply(req, errorResponse(req.ID, e))
+	}
+
+	result, err := json.Marshal(out[0].Interface())
+	if err != nil {
+		return reply(req, errorResponse(req.ID, NewError(CodeInternalError, err.Error())))
+	}
+	return reply(req, &Response{JSONRPC: Version, Result: result, ID: req.ID})
+}
+
+// handles requests posted over http
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	res := s.Handle(r.Context(), b)
+	if res == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(res)
+}
+
+// reads requests from c and writes back responses until ctx is done or c is cleaned up,
+// handlers can get c with ConnFromContext
+func (s *Server) ServeConn(ctx context.Context, c *server.ConnectedClient) error {
+	msgCh := make(chan server.Msg)
+	if err := c.Read(ctx, msgCh); err != nil {
+		return err
+	}
+
+	hctx := context.WithValue(ctx, connKey{}, c)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.Done():
+			return nil
+		case m := <-msgCh:
+			res := s.Handle(hctx, m.Data)
+			if res == nil {
+				continue
+			}
+			if err := c.Write(res); err != nil {
+				log.Println("failed to write jsonrpc response to", m.From, err)
+			}
+		}
+	}
+}
+
+// notifications are never answered, even with errors
+func reply(req Request, resp *Response) *Response {
+	if req.IsNotification() {
+		return nil
+	}
+	return resp
+}
+
+func errorResponse(id json.RawMessage, e *Error) *Response {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: Version, Error: e, ID: id}
+}
+
+// ids are strings, numbers, null or absent
+func validID(id json.RawMessage) bool {
+	if len(id) == 0 {
+		return true
+	}
+	switch id[0] {
+	case '"', '-', 'n', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestServer() *Server {
+	s := NewServer()
+	s.Register("subtract", func(ctx context.Context, p []int) (int, error) {
+		if len(p) != 2 {
+			return 0, NewError(CodeInvalidParams, "expected 2 params")
+		}
+		return p[0] - p[1], nil
+	})
+	s.Register("sum", func(ctx context.Context, p []int) (int, error) {
+		n := 0
+		for _, v := range p {
+			n += v
+		}
+		return n, nil
+	})
+	s.Register("notify_hello", func(ctx context.Context, p []int) (interface{}, error) {
+		return nil, nil
+	})
+	s.Register("fail", func(ctx context.Context, p struct{}) (interface{}, error) {
+		return nil, errors.New("stub")
+	})
+	return s
+}
+
+func TestServerHandle(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	s := newTestServer()
+
+	// examples from the specification
+	tt := []struct {
+		name string
+		req  string
+		resp string
+	}{
+		{"positional params", `{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`, `{"jsonrpc":"2.0","result":19,"id":1}`},
+		{"string id", `{"jsonrpc": "2.0", "method": "subtract", "params": [23, 42], "id": "a"}`, `{"jsonrpc":"2.0","result":-19,"id":"a"}`},
+		{"null result", `{"jsonrpc": "2.0", "method": "notify_hello", "params": [7], "id": 2}`, `{"jsonrpc":"2.0","result":null,"id":2}`},
+		{"notification", `{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4]}`, ``},
+		{"failed notification", `{"jsonrpc": "2.0", "method": "foobar"}`, ``},
+		{"method not found", `{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`, `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method not found: foobar"},"id":"1"}`},
+		{"parse error", `{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`, `-32700`},
+		{"invalid request", `{"jsonrpc": "2.0", "method": 1, "params": "bar"}`, `-32600`},
+		{"wrong version", `{"jsonrpc": "1.0", "method": "sum", "id": 3}`, `-32600`},
+		{"invalid params", `{"jsonrpc": "2.0", "method": "sum", "params": {"a": 1}, "id": 4}`, `-32602`},
+		{"handler error code", `{"jsonrpc": "2.0", "method": "subtract", "params": [1], "id": 5}`, `-32602`},
+		{"handler error", `{"jsonrpc": "2.0", "method": "fail", "id": 6}`, `{"jsonrpc":"2.0","error":{"code":-32000,"message":"stub"},"id":6}`},
+		{"batch parse error", `[{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},{"jsonrpc": "2.0", "method"]`, `-32700`},
+		{"empty batch", `[]`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`},
+		{"invalid batch", `[1,2]`, `[{"jsonrpc":"2.0","error":{"code":-32600,`},
+		{"notification batch", `[{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4]},{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}]`, ``},
+	}
+
+	for _, v := range tt {
+		res := string(s.Handle(context.Background(), []byte(v.req)))
+		if v.resp == "" {
+			if res != "" {
+				t.Fatalf("%s: expected no response, got: %s", v.name, res)
+			}
+			continue
+		}
+		if !strings.Contains(res, v.resp) {
+			t.Fatalf("%s: response; want: %v, got: %v", v.name, v.resp, res)
+		}
+	}
+
+	// mixed batch
+	res := s.Handle(context.Background(), []byte(`[
+		{"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+		{"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},
+		{"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},
+		{"foo": "boo"},
+		{"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"}
+	]`))
+	var resps []Response
+	checkErr(t, json.Unmarshal(res, &resps))
+	if len(resps) != 4 {
+		t.Fatalf("batch responses; want: %v, got: %v", 4, len(resps))
+	}
+	if string(resps[0].Result) != "7" || string(resps[1].Result) != "19" {
+		t.Fatalf("invalid batch results: %s", res)
+	}
+	if resps[2].Error.Code != CodeInvalidRequest || resps[3].Error.Code != CodeMethodNotFound {
+		t.Fatalf("invalid batch errors: %s", res)
+	}
+}
+
+func TestServerRegisterPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected panic on invalid method")
+		}
+	}()
+	NewServer().Register("stub", func(ctx context.Context, p []int) error { return nil })
+}
+
+func TestServeHTTP(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := httptest.NewServer(newTestServer())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"sum","params":[1,2],"id":1}`))
+	checkErr(t, err)
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(b) != `{"jsonrpc":"2.0","result":3,"id":1}` {
+		t.Fatalf("invalid http response %d: %s", resp.StatusCode, b)
+	}
+
+	// notifications get no content
+	resp, err = http.Post(srv.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"sum","params":[1,2]}`))
+	checkErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("notification status; want: %v, got: %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	// only POST
+	resp, err = http.Get(srv.URL)
+	checkErr(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("get status; want: %v, got: %v", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
+
+func checkErrNil(t *testing.T, err error) {
+	if err == nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
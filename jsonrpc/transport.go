@@ -0,0 +1,203 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/ws/client"
+	errs "github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPTransport posts requests to URL through the web package
+type HTTPTransport struct {
+	URL           string
+	Timeout       time.Duration // bounded further by the context deadline, 0 means no timeout
+	Headers       []web.KV
+	Authenticated bool // adds the TOKEN bearer header like web.APost
+}
+
+func (t *HTTPTransport) Send(ctx context.Context, reqs []Request, batch bool) ([]Response, error) {
+	b, err := encode(reqs, batch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	timeout := t.Timeout
+	if dl, ok := ctx.Deadline(); ok {
+		if left := time.Until(dl); timeout == 0 || left < timeout {
+			timeout = left
+		}
+	}
+
+	post := web.Post
+	if t.Authenticated {
+		post = web.APost
+	}
+	code, body, err := post(t.URL, timeout, b, t.Headers...)
+	if err != nil {
+		return nil, errs.Wrap(err, "jsonrpc http request failed")
+	}
+
+	resps, err := parseResponses(body)
+	if err != nil && (code < 200 || code > 299) {
+		return nil, errs.Errorf("jsonrpc http status %d: %s", code, http.StatusText(code))
+	}
+	return resps, err
+}
+
+// WSTransport sends requests over a websocket Connection and matches responses by id,
+// Read or a Router must be serving the connection. Requests are sent with ids of the
+// transport's own, so Clients sharing it can't answer each other's calls
+type WSTransport struct {
+	conn *client.Connection
+
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[string]pendingRequest
+}
+
+// a request waiting for its response, id is the one its Client gave it
+type pendingRequest struct {
+	id json.RawMessage
+	ch chan Response
+}
+
+// creates a transport over conn, registering an interceptor for responses on it
+func NewWSTransport(conn *client.Connection) *WSTransport {
+	t := &WSTransport{
+		conn:    conn,
+		pending: make(map[string]pendingRequest),
+	}
+	conn.Intercept(t.deliver)
+	return t
+}
+
+func (t *WSTransport) Send(ctx context.Context, reqs []Request, batch bool) ([]Response, error) {
+	if _, ok := ctx.Deadline(); !ok && client.CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.CallTimeout)
+		defer cancel()
+	}
+
+	ch := make(chan Response, len(reqs))
+	sent := make([]Request, len(reqs))
+	var ids []string
+	t.mu.Lock()
+	for i, r := range reqs {
+		if !r.IsNotification() {
+			t.lastID++
+			id := strconv.FormatUint(t.lastID, 10)
+			ids = append(ids, id)
+			t.pending[id] = pendingRequest{id: r.ID, ch: ch}
+			r.ID = json.RawMessage(id)
+		}
+		sent[i] = r
+	}
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		for _, id := range ids {
+			delete(t.pending, id)
+		}
+		t.mu.Unlock()
+	}()
+
+	b, err := encode(sent, batch)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.conn.Write(b); err != nil {
+		return nil, errs.Wrap(err, "failed to send jsonrpc request")
+	}
+
+	resps := make([]Response, 0, len(ids))
+	for len(resps) < len(ids) {
+		select {
+		case <-ctx.Done():
+			return nil, errs.Wrap(ctx.Err(), "jsonrpc request")
+		case r := <-ch:
+			resps = append(resps, r)
+		}
+	}
+	return resps, nil
+}
+
+// consumes m when it answers a pending request
+func (t *WSTransport) deliver(m []byte) bool {
+	t.mu.Lock()
+	waiting := len(t.pending) != 0
+	t.mu.Unlock()
+	if !waiting {
+		return false
+	}
+
+	resps, err := parseResponses(m)
+	if err != nil {
+		return false
+	}
+
+	consumed := false
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range resps {
+		if r.JSONRPC != Version {
+			continue
+		}
+		if id := idKey(r.ID); (id == "" || id == "null") && r.Error != nil {
+			// parse errors and invalid requests can't say which request they answer,
+			// every outstanding one fails rather than waiting for its timeout
+			for id, p := range t.pending {
+				delete(t.pending, id)
+				p.ch <- Response{JSONRPC: r.JSONRPC, Error: r.Error, ID: p.id}
+			}
+			consumed = true
+			continue
+		}
+		if p, ok := t.pending[idKey(r.ID)]; ok {
+			delete(t.pending, idKey(r.ID))
+			r.ID = p.id
+			p.ch <- r
+			consumed = true
+		}
+	}
+	return consumed
+}
+
+func encode(reqs []Request, batch bool) ([]byte, error) {
+	if len(reqs) == 0 {
+		return nil, errs.New("no requests")
+	}
+	if batch {
+		return json.Marshal(reqs)
+	}
+	if len(reqs) != 1 {
+		return nil, errs.New("multiple requests must be sent as a batch")
+	}
+	return json.Marshal(reqs[0])
+}
+
+// parses a single response or a batch, empty bodies answer notifications
+func parseResponses(b []byte) ([]Response, error) {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil, nil
+	}
+	if isBatch(b) {
+		var resps []Response
+		err := json.Unmarshal(b, &resps)
+		return resps, errs.Wrap(err, "invalid jsonrpc batch response")
+	}
+	var r Response
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errs.Wrap(err, "invalid jsonrpc response")
+	}
+	return []Response{r}, nil
+}
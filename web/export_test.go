@@ -0,0 +1,4 @@
+package web
+
+// exposes unexported helpers to the web_test package
+var Do = do
@@ -39,82 +39,147 @@ type KV struct {
 	Value string
 }
 
+// Instance performs the request helpers with its own HTTPClient instead of the
+// package level Client, so tests can mock it without touching global state
+type Instance struct {
+	Client HTTPClient
+}
+
+// creates an Instance sending requests with c
+func NewInstance(c HTTPClient) *Instance {
+	return &Instance{Client: c}
+}
+
 // authenticated GET helper using TOKEN env variable
 func AGet(url string, timeout time.Duration, headers ...KV) (int, []byte, error) {
-	return Get(url, timeout, append(headers, getAuthKV())...)
+	return NewInstance(Client).AGet(url, timeout, headers...)
 }
 
 // http GET helper
 func Get(url string, timeout time.Duration, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).Get(url, timeout, headers...)
+}
+
+// authenticated PATCH helper using TOKEN env variable
+func APatch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).APatch(url, timeout, b, headers...)
+}
+
+// http PATCH helper
+func Patch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).Patch(url, timeout, b, headers...)
+}
+
+// authenticated POST helper using TOKEN env variable
+func APost(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).APost(url, timeout, b, headers...)
+}
+
+// http POST helper
+func Post(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).Post(url, timeout, b, headers...)
+}
+
+// authenticated PUT helper using TOKEN env variable
+func APut(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).APut(url, timeout, b, headers...)
+}
+
+// http PUT helper
+func Put(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).Put(url, timeout, b, headers...)
+}
+
+// authenticated DELETE helper using TOKEN env variable
+func ADelete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).ADelete(url, timeout, b, headers...)
+}
+
+// http DELETE helper
+func Delete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).Delete(url, timeout, b, headers...)
+}
+
+func do(req *http.Request, timeout time.Duration, headers ...KV) (int, []byte, error) {
+	return NewInstance(Client).do(req, timeout, headers...)
+}
+
+// authenticated GET helper using TOKEN env variable
+func (w *Instance) AGet(url string, timeout time.Duration, headers ...KV) (int, []byte, error) {
+	return w.Get(url, timeout, append(headers, getAuthKV())...)
+}
+
+// http GET helper
+func (w *Instance) Get(url string, timeout time.Duration, headers ...KV) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return do(req, timeout, headers...)
+	return w.do(req, timeout, headers...)
 }
 
 // authenticated PATCH helper using TOKEN env variable
-func APatch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
-	return Patch(url, timeout, b, append(headers, getAuthKV())...)
+func (w *Instance) APatch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return w.Patch(url, timeout, b, append(headers, getAuthKV())...)
 }
 
 // http PATCH helper
-func Patch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+func (w *Instance) Patch(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodPatch, url, bytes.NewReader(b))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return do(req, timeout, headers...)
+	return w.do(req, timeout, headers...)
 }
 
 // authenticated POST helper using TOKEN env variable
-func APost(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
-	return Post(url, timeout, b, append(headers, getAuthKV())...)
+func (w *Instance) APost(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return w.Post(url, timeout, b, append(headers, getAuthKV())...)
 }
 
 // http POST helper
-func Post(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+func (w *Instance) Post(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return do(req, timeout, headers...)
+	return w.do(req, timeout, headers...)
 }
 
 // authenticated PUT helper using TOKEN env variable
-func APut(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
-	return Post(url, timeout, b, append(headers, getAuthKV())...)
+func (w *Instance) APut(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return w.Post(url, timeout, b, append(headers, getAuthKV())...)
 }
 
 // http PUT helper
-func Put(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+func (w *Instance) Put(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(b))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return do(req, timeout, headers...)
+	return w.do(req, timeout, headers...)
 }
 
 // authenticated DELETE helper using TOKEN env variable
-func ADelete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
-	return Delete(url, timeout, b, append(headers, getAuthKV())...)
+func (w *Instance) ADelete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+	return w.Delete(url, timeout, b, append(headers, getAuthKV())...)
 }
 
 // http DELETE helper
-func Delete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
+func (w *Instance) Delete(url string, timeout time.Duration, b []byte, headers ...KV) (int, []byte, error) {
 	req, err := http.NewRequest(http.MethodDelete, url, bytes.NewReader(b))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return do(req, timeout, headers...)
+	return w.do(req, timeout, headers...)
 }
 
-func do(req *http.Request, timeout time.Duration, headers ...KV) (int, []byte, error) {
+func (w *Instance) do(req *http.Request, timeout time.Duration, headers ...KV) (int, []byte, error) {
 	req.Header.Set("Content-Type", "application/json") // default to json
 	for _, v := range headers {
 		req.Header.Set(v.Key, v.Value)
@@ -122,9 +187,9 @@ func do(req *http.Request, timeout time.Duration, headers ...KV) (int, []byte, e
 
 	// a value of 0 means no timeout
 	if timeout.Minutes() != 0 {
-		Client.SetTimeout(timeout)
+		w.Client.SetTimeout(timeout)
 	}
-	resp, err := Client.Do(req)
+	resp, err := w.Client.Do(req)
 	if err != nil {
 		return 0, nil, err
 	}
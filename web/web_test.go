@@ -1,8 +1,9 @@
-package web
+package web_test
 
 import (
 	"bytes"
 	"errors"
+	"github.com/mousybusiness/go-web/web"
 	"github.com/mousybusiness/go-web/web/webtest"
 	"io/ioutil"
 	"log"
@@ -13,14 +14,14 @@ import (
 
 func TestDo(t *testing.T) {
 	log.SetOutput(ioutil.Discard) // discard logs
-	Client = webtest.MockClient{}
+	web.Client = webtest.MockClient{}
 	req := &http.Request{Header: make(map[string][]string)}
 	webtest.DoFunc = func(req *http.Request) (*http.Response, error) {
 		return &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("stub"))), StatusCode: 200}, nil
 	}
 
 	// happy path - no
-	code, body, err := do(req, time.Millisecond*100)
+	code, body, err := web.Do(req, time.Millisecond*100)
 	checkErr(t, err)
 
 	if code != 200 {
@@ -36,7 +37,7 @@ func TestDo(t *testing.T) {
 	}
 
 	// error in http call
-	_, _, err = do(req, time.Millisecond*100)
+	_, _, err = web.Do(req, time.Millisecond*100)
 	checkErrNil(t, err)
 
 	// check headers
@@ -46,7 +47,7 @@ func TestDo(t *testing.T) {
 		return &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("stub")))}, nil
 	}
 
-	do(req, time.Millisecond*100, KV{"Content-Type", "stub"}, KV{"X-Api-Key", "123"})
+	web.Do(req, time.Millisecond*100, web.KV{"Content-Type", "stub"}, web.KV{"X-Api-Key", "123"})
 
 	if v, ok := h["Content-Type"]; !ok {
 		t.Fatalf("expecting content type header in request")
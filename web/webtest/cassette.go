@@ -0,0 +1,376 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mousybusiness/go-web/web"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RecordEnv set to a non empty value makes recorders record instead of replay
+const RecordEnv = "WEBTEST_RECORD"
+
+// replaces redacted header values in cassettes
+const Redacted = "REDACTED"
+
+type RecordMode int
+
+const (
+	// answers from the cassette, failing on requests it doesn't hold
+	ModeReplay RecordMode = iota
+	// sends requests with the wrapped client and saves them to the cassette
+	ModeRecord
+)
+
+// Cassette holds the interactions a Recorder saved
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	Code   int         `json:"code"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// Matcher reports whether a request matches a recorded one, body is the request's body
+type Matcher func(req *http.Request, body []byte, rec RecordedRequest) bool
+
+func MatchMethod(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return req.Method == rec.Method
+}
+
+func MatchURL(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return req.URL.String() == rec.URL
+}
+
+// matches the url ignoring its query
+func MatchPath(req *http.Request, body []byte, rec RecordedRequest) bool {
+	u, err := req.URL.Parse(rec.URL)
+	return err == nil && u.Host == req.URL.Host && u.Path == req.URL.Path
+}
+
+func MatchBody(req *http.Request, body []byte, rec RecordedRequest) bool {
+	return string(body) == rec.Body
+}
+
+// matches json equivalent bodies, whatever the key order or whitespace
+func MatchJSONBody(req *http.Request, body []byte, rec RecordedRequest) bool {
+	if len(body) == 0 && rec.Body == "" {
+		return true
+	}
+	var got, want interface{}
+	if json.Unmarshal(body, &got) != nil || json.Unmarshal([]byte(rec.Body), &want) != nil {
+		return false
+	}
+	return reflect.DeepEqual(got, want)
+}
+
+// matches requests sending the same values for headers, redacted headers only by how many values they have
+func MatchHeader(headers ...string) Matcher {
+	return func(req *http.Request, body []byte, rec RecordedRequest) bool {
+		for _, h := range headers {
+			if !reflect.DeepEqual(req.Header.Values(h), rec.Header.Values(h)) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Recorder is a web.HTTPClient recording the interactions of the client it wraps to
+// a cassette, or replaying them from it without touching the network
+type Recorder struct {
+	t    testing.TB
+	path string
+
+	mu          sync.Mutex
+	client      web.HTTPClient
+	mode        RecordMode
+	redact      []string
+	redactQuery []string
+	redactBody  func(b []byte) []byte
+	match       []Matcher
+	timeout     time.Duration
+
+	loaded   bool
+	cassette Cassette
+	used     []bool
+}
+
+// creates a Recorder over the current web.Client installed as web.Client until the
+// test ends, see NewRecorder
+func Record(t testing.TB, path string) *Recorder {
+	t.Helper()
+	r := NewRecorder(t, path, web.Client)
+	prev := web.Client
+	web.Client = r
+	t.Cleanup(func() {
+		web.Client = prev
+	})
+	return r
+}
+
+// creates a Recorder for the cassette at path wrapping c. It replays unless RecordEnv
+// is set, and saves what it recorded once the test ends. The Authorization header is
+// redacted and requests are matched by method, url and body unless configured otherwise
+func NewRecorder(t testing.TB, path string, c web.HTTPClient) *Recorder {
+	r := &Recorder{
+		t:      t,
+		path:   path,
+		client: c,
+		redact: []string{"Authorization"},
+		match:  []Matcher{MatchMethod, MatchURL, MatchBody},
+	}
+	if os.Getenv(RecordEnv) != "" {
+		r.mode = ModeRecord
+	}
+	t.Cleanup(func() {
+		if err := r.save(); err != nil {
+			t.Errorf("saving cassette %s: %v", path, err)
+		}
+	})
+	return r
+}
+
+func (r *Recorder) SetMode(m RecordMode) *Recorder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mode = m
+	return r
+}
+
+// redacts headers, in requests and responses, in addition to Authorization
+func (r *Recorder) Redact(headers ...string) *Recorder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redact = append(r.redact, headers...)
+	return r
+}
+
+// redacts query parameters of request urls, replayed requests are redacted the same
+// way before they are matched
+func (r *Recorder) RedactQuery(params ...string) *Recorder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redactQuery = append(r.redactQuery, params...)
+	return r
+}
+
+// rewrites request and response bodies with fn before they are saved
+func (r *Recorder) RedactBody(fn func(b []byte) []byte) *Recorder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redactBody = fn
+	return r
+}
+
+// replaces the matchers a request must satisfy to be answered by a recorded interaction
+func (r *Recorder) Match(ms ...Matcher) *Recorder {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.match = ms
+	return r
+}
+
+func (r *Recorder) SetTimeout(timeout time.Duration) {
+	r.mu.Lock()
+	r.timeout = timeout
+	c := r.client
+	r.mu.Unlock()
+	if c != nil {
+		c.SetTimeout(timeout)
+	}
+}
+
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	mode := r.mode
+	r.mu.Unlock()
+	if mode == ModeRecord {
+		return r.record(req, body)
+	}
+	return r.replay(req, body)
+}
+
+func (r *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    r.redactURL(req.URL).String(),
+			Header: r.redactHeader(req.Header),
+			Body:   string(r.redactBytes(body)),
+		},
+		Response: RecordedResponse{
+			Code:   resp.StatusCode,
+			Header: r.redactHeader(resp.Header),
+			Body:   string(r.redactBytes(b)),
+		},
+	})
+	return resp, nil
+}
+
+func (r *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.load(); err != nil {
+		r.t.Errorf("loading cassette %s: %v", r.path, err)
+		return nil, err
+	}
+	// matched redacted the way recorded requests were saved
+	redacted := *req
+	redacted.URL = r.redactURL(req.URL)
+	redacted.Header = r.redactHeader(req.Header)
+	body = r.redactBytes(body)
+	for i, in := range r.cassette.Interactions {
+		if r.used[i] || !r.matches(&redacted, body, in.Request) {
+			continue
+		}
+		r.used[i] = true
+		return &http.Response{
+			StatusCode: in.Response.Code,
+			Header:     in.Response.Header.Clone(),
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte(in.Response.Body))),
+		}, nil
+	}
+	r.t.Errorf("%s %s not recorded in cassette %s, run with %s=1 to record it", req.Method, req.URL, r.path, RecordEnv)
+	return nil, errors.New("webtest: unrecorded request " + req.Method + " " + req.URL.String())
+}
+
+func (r *Recorder) matches(req *http.Request, body []byte, rec RecordedRequest) bool {
+	for _, m := range r.match {
+		if !m(req, body, rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// reads the cassette the first time it's replayed from
+func (r *Recorder) load() error {
+	if r.loaded {
+		return nil
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &r.cassette); err != nil {
+		return fmt.Errorf("invalid cassette: %w", err)
+	}
+	r.used = make([]bool, len(r.cassette.Interactions))
+	r.loaded = true
+	return nil
+}
+
+func (r *Recorder) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mode != ModeRecord {
+		return nil
+	}
+	b, err := json.MarshalIndent(r.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.path, b, 0644)
+}
+
+func (r *Recorder) redactHeader(h http.Header) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	h = h.Clone()
+	for _, k := range r.redact {
+		if vs := h.Values(k); len(vs) > 0 {
+			h.Del(k)
+			for range vs {
+				h.Add(k, Redacted)
+			}
+		}
+	}
+	return h
+}
+
+// u with its redacted query parameters replaced, the query is reencoded if any was
+func (r *Recorder) redactURL(u *url.URL) *url.URL {
+	q := u.Query()
+	redacted := false
+	for _, p := range r.redactQuery {
+		vs := q[p]
+		for i := range vs {
+			vs[i] = Redacted
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return &c
+}
+
+func (r *Recorder) redactBytes(b []byte) []byte {
+	if r.redactBody == nil || len(b) == 0 {
+		return b
+	}
+	return r.redactBody(b)
+}
+
+// reads the request body leaving it readable for whoever sends it next
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
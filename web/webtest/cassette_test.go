@@ -0,0 +1,171 @@
+package webtest_test
+
+import (
+	"fmt"
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/web/webtest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sends requests over the network
+type httpClient struct {
+	c *http.Client
+}
+
+func (h httpClient) Do(req *http.Request) (*http.Response, error) {
+	return h.c.Do(req)
+}
+
+func (h httpClient) SetTimeout(timeout time.Duration) {
+	h.c.Timeout = timeout
+}
+
+func TestRecorder(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, b)
+	}))
+	path := filepath.Join(t.TempDir(), "cassettes", "users.json")
+	auth := web.KV{Key: "Authorization", Value: "Bearer secret"}
+
+	send := func(w *web.Instance) {
+		t.Helper()
+		code, body, err := w.Post(srv.URL+"/users", time.Second, []byte(`{"name":"bob","token":"secret"}`), auth)
+		if err != nil || code != 200 || string(body) != `POST /users {"name":"bob","token":"secret"}` {
+			t.Fatalf("unexpected response %d %s %v", code, body, err)
+		}
+		_, body, err = w.Get(srv.URL+"/users?page=2", time.Second, auth)
+		if err != nil || string(body) != "GET /users " {
+			t.Fatalf("unexpected response %s %v", body, err)
+		}
+	}
+
+	t.Run("record", func(t *testing.T) {
+		r := webtest.NewRecorder(t, path, httpClient{&http.Client{}}).SetMode(webtest.ModeRecord)
+		send(web.NewInstance(r))
+	})
+	srv.Close()
+
+	b, err := ioutil.ReadFile(path)
+	checkErr(t, err)
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("expected requests to be sent while recording, got %d", calls)
+	}
+	if strings.Contains(string(b), "Bearer secret") || !strings.Contains(string(b), webtest.Redacted) {
+		t.Fatalf("expected authorization to be redacted, got %s", b)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		send(web.NewInstance(webtest.NewRecorder(t, path, nil)))
+	})
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("replay should not touch the network, got %d requests", calls)
+	}
+
+	t.Run("unrecorded", func(t *testing.T) {
+		rt := &recordingT{TB: t}
+		w := web.NewInstance(webtest.NewRecorder(rt, path, nil))
+		if _, _, err := w.Delete(srv.URL+"/users", time.Second, nil); err == nil {
+			t.Fatal("expected unrecorded request to fail")
+		}
+		if len(rt.errors) != 1 {
+			t.Fatalf("expected the test to be failed, got %v", rt.errors)
+		}
+	})
+
+	t.Run("replayed once", func(t *testing.T) {
+		rt := &recordingT{TB: t}
+		w := web.NewInstance(webtest.NewRecorder(rt, path, nil))
+		_, _, _ = w.Get(srv.URL+"/users?page=2", time.Second)
+		if _, _, err := w.Get(srv.URL+"/users?page=2", time.Second); err == nil || len(rt.errors) != 1 {
+			t.Fatalf("expected interactions to be replayed once, got %v", rt.errors)
+		}
+	})
+}
+
+func TestRecorderMatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "match.json")
+
+	t.Run("record", func(t *testing.T) {
+		r := webtest.NewRecorder(t, path, httpClient{&http.Client{}}).
+			SetMode(webtest.ModeRecord).
+			Redact("X-Api-Key").
+			RedactBody(func(b []byte) []byte {
+				return []byte(strings.Replace(string(b), "hunter2", webtest.Redacted, -1))
+			})
+		_, _, err := web.NewInstance(r).Post(srv.URL+"/login?ts=1", time.Second, []byte(`{"user":"bob","password":"hunter2"}`),
+			web.KV{Key: "X-Api-Key", Value: "key"})
+		checkErr(t, err)
+	})
+
+	b, err := ioutil.ReadFile(path)
+	checkErr(t, err)
+	if strings.Contains(string(b), "hunter2") || strings.Contains(string(b), `"key"`) {
+		t.Fatalf("expected header and body to be redacted, got %s", b)
+	}
+
+	// different query, key order and password
+	t.Run("replay", func(t *testing.T) {
+		r := webtest.NewRecorder(t, path, nil).Match(webtest.MatchMethod, webtest.MatchPath, webtest.MatchJSONBody)
+		_, _, err := web.NewInstance(r).Post(srv.URL+"/login?ts=2", time.Second, []byte(`{"password":"REDACTED","user":"bob"}`))
+		checkErr(t, err)
+	})
+}
+
+func TestRecorderRedactedReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	path := filepath.Join(t.TempDir(), "redacted.json")
+	recorder := func(t *testing.T, c web.HTTPClient) *webtest.Recorder {
+		return webtest.NewRecorder(t, path, c).
+			Redact("X-Api-Key").
+			RedactQuery("access_token").
+			RedactBody(func(b []byte) []byte {
+				return []byte(strings.Replace(string(b), "hunter2", webtest.Redacted, -1))
+			}).
+			Match(webtest.MatchMethod, webtest.MatchURL, webtest.MatchBody, webtest.MatchHeader("X-Api-Key"))
+	}
+	login := func(w *web.Instance) error {
+		_, _, err := w.Post(srv.URL+"/login?access_token=s3cret&client=web", time.Second, []byte(`{"user":"bob","password":"hunter2"}`),
+			web.KV{Key: "X-Api-Key", Value: "key"})
+		return err
+	}
+
+	t.Run("record", func(t *testing.T) {
+		checkErr(t, login(web.NewInstance(recorder(t, httpClient{&http.Client{}}).SetMode(webtest.ModeRecord))))
+	})
+	srv.Close()
+
+	b, err := ioutil.ReadFile(path)
+	checkErr(t, err)
+	if strings.Contains(string(b), "s3cret") || !strings.Contains(string(b), "client=web") {
+		t.Fatalf("expected the access token to be redacted from the url, got %s", b)
+	}
+
+	// the same request as recorded, secrets and all
+	t.Run("replay", func(t *testing.T) {
+		checkErr(t, login(web.NewInstance(recorder(t, nil))))
+	})
+}
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,195 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Expectation describes a request the code under test must make and how to answer it
+type Expectation struct {
+	method string
+	path   string
+	query  url.Values
+	header http.Header
+	body   []byte
+	json   interface{}
+	isJSON bool
+
+	resp *ResponseBuilder
+
+	times int // -1 for any number
+	calls int
+}
+
+// expects a request for method and path, answered with 200 and no body unless Reply
+// is used, once unless Times is used
+func (m *Mock) On(method, path string) *Expectation {
+	e := &Expectation{
+		method: strings.ToUpper(method),
+		path:   path,
+		query:  url.Values{},
+		header: http.Header{},
+		resp:   NewResponse(http.StatusOK),
+		times:  1,
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectations = append(m.expectations, e)
+	return e
+}
+
+// only matches requests with header key set to value
+func (e *Expectation) WithHeader(key, value string) *Expectation {
+	e.header.Add(key, value)
+	return e
+}
+
+// only matches requests with query parameter key set to value
+func (e *Expectation) WithQuery(key, value string) *Expectation {
+	e.query.Add(key, value)
+	return e
+}
+
+// only matches requests whose body is exactly body
+func (e *Expectation) WithBody(body string) *Expectation {
+	e.body = []byte(body)
+	return e
+}
+
+// only matches requests whose body is json equivalent to v, whatever the key order
+// or whitespace
+func (e *Expectation) WithJSONBody(v interface{}) *Expectation {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("webtest: invalid json body for %s: %v", e, err))
+	}
+	_ = json.Unmarshal(b, &e.json)
+	e.isJSON = true
+	return e
+}
+
+// answers with code and body, a string or []byte is sent as is, anything else as json
+func (e *Expectation) Reply(code int, body interface{}) *Expectation {
+	r := NewResponse(code)
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r.Body(b)
+	case []byte:
+		r.Body(string(b))
+	default:
+		r.JSON(b)
+	}
+	return e.ReplyWith(r)
+}
+
+// answers with responses built by r
+func (e *Expectation) ReplyWith(r *ResponseBuilder) *Expectation {
+	e.resp = r
+	return e
+}
+
+// expects the request exactly n times
+func (e *Expectation) Times(n int) *Expectation {
+	e.times = n
+	return e
+}
+
+// allows the request any number of times, including none
+func (e *Expectation) AnyTimes() *Expectation {
+	e.times = -1
+	return e
+}
+
+func (e *Expectation) String() string {
+	s := e.method + " " + e.path
+	if len(e.query) > 0 {
+		s += "?" + e.query.Encode()
+	}
+	return s
+}
+
+func (e *Expectation) matches(req *http.Request, body []byte) bool {
+	if e.method != req.Method || e.path != req.URL.Path {
+		return false
+	}
+	q := req.URL.Query()
+	for k, vs := range e.query {
+		for _, v := range vs {
+			if !contains(q[k], v) {
+				return false
+			}
+		}
+	}
+	for k, vs := range e.header {
+		for _, v := range vs {
+			if !contains(req.Header.Values(k), v) {
+				return false
+			}
+		}
+	}
+	if e.body != nil && !bytes.Equal(e.body, body) {
+		return false
+	}
+	if e.isJSON {
+		var got interface{}
+		if json.Unmarshal(body, &got) != nil || !reflect.DeepEqual(got, e.json) {
+			return false
+		}
+	}
+	return true
+}
+
+// answers req with the first expectation it matches that still expects calls, false
+// when there is none
+func (m *Mock) expected(req *http.Request, body []byte) (*http.Response, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var exhausted *Expectation
+	for _, e := range m.expectations {
+		if !e.matches(req, body) {
+			continue
+		}
+		if e.times >= 0 && e.calls >= e.times {
+			exhausted = e
+			continue
+		}
+		e.calls++
+		resp, err := e.resp.Do(req)
+		return resp, true, err
+	}
+	if exhausted != nil {
+		m.t.Helper()
+		m.t.Errorf("%s expected %d times, got %d", exhausted, exhausted.times, exhausted.calls+1)
+		exhausted.calls++
+		return nil, false, fmt.Errorf("webtest: %s called more than expected", exhausted)
+	}
+	return nil, false, nil
+}
+
+// fails t for every expectation not met
+func (m *Mock) AssertExpectations(t testing.TB) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range m.expectations {
+		if e.times >= 0 && e.calls < e.times {
+			t.Errorf("%s expected %d times, got %d", e, e.times, e.calls)
+		}
+	}
+}
+
+func contains(vs []string, v string) bool {
+	for _, s := range vs {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package webtest_test
+
+import (
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/web/webtest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExpectations(t *testing.T) {
+	w, m := webtest.NewInstance(t)
+	m.On("POST", "/users").
+		WithHeader("Authorization", "Bearer stub").
+		WithJSONBody(map[string]interface{}{"name": "bob", "age": 30}).
+		Reply(201, map[string]string{"id": "1"}).
+		Times(2)
+	m.On("GET", "/users").WithQuery("page", "2").Reply(200, "page 2").AnyTimes()
+	m.On("GET", "/users").Reply(200, "page 1").AnyTimes()
+
+	for i := 0; i < 2; i++ {
+		code, body, err := w.Post("https://example.com/users", time.Second, []byte(`{ "age": 30, "name": "bob" }`),
+			web.KV{Key: "Authorization", Value: "Bearer stub"})
+		if err != nil || code != 201 || string(body) != `{"id":"1"}` {
+			t.Fatalf("unexpected response %d %s %v", code, body, err)
+		}
+	}
+
+	tt := []struct {
+		url  string
+		body string
+	}{
+		{"https://example.com/users?page=2", "page 2"},
+		{"https://example.com/users?page=3", "page 1"},
+		{"https://example.com/users", "page 1"},
+	}
+	for _, v := range tt {
+		_, body, err := w.Get(v.url, 0)
+		if err != nil || string(body) != v.body {
+			t.Fatalf("%s; want: %v, got: %s %v", v.url, v.body, body, err)
+		}
+	}
+}
+
+func TestExpectationsFallback(t *testing.T) {
+	w, m := webtest.NewInstance(t)
+	m.On("GET", "/health").Reply(204, nil)
+	m.DoFunc(func(req *http.Request) (*http.Response, error) {
+		return webtest.MockResponse(418, "", nil)
+	})
+
+	if code, _, _ := w.Get("https://example.com/health", 0); code != 204 {
+		t.Fatalf("expected expectation to answer, got %d", code)
+	}
+	if code, _, _ := w.Get("https://example.com/other", 0); code != 418 {
+		t.Fatalf("expected DoFunc to answer unmatched requests, got %d", code)
+	}
+}
+
+func TestExpectationsUnmet(t *testing.T) {
+	deleteTwice := func(m *webtest.Mock) { m.On("DELETE", "/users/1").Times(2) }
+	tt := []struct {
+		name   string
+		expect func(m *webtest.Mock)
+		calls  func(w *web.Instance)
+		fails  int
+	}{
+		{"never called", deleteTwice, func(w *web.Instance) {}, 1},
+		{"called once", deleteTwice, func(w *web.Instance) {
+			_, _, _ = w.Delete("https://example.com/users/1", 0, nil)
+		}, 1},
+		{"called twice", deleteTwice, func(w *web.Instance) {
+			_, _, _ = w.Delete("https://example.com/users/1", 0, nil)
+			_, _, _ = w.Delete("https://example.com/users/1", 0, nil)
+		}, 0},
+		{"called too often", deleteTwice, func(w *web.Instance) {
+			for i := 0; i < 3; i++ {
+				_, _, _ = w.Delete("https://example.com/users/1", 0, nil)
+			}
+		}, 1},
+		{"wrong body", func(m *webtest.Mock) {
+			m.On("POST", "/users").WithJSONBody(map[string]string{"name": "bob"})
+		}, func(w *web.Instance) {
+			_, _, _ = w.Post("https://example.com/users", 0, []byte(`{"name":"alice"}`))
+		}, 2}, // unmatched and never called
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			rt := &recordingT{TB: t}
+			w, m := webtest.NewInstance(rt)
+			v.expect(m)
+			v.calls(w)
+			m.AssertExpectations(rt)
+			if len(rt.errors) != v.fails {
+				t.Fatalf("want %d failures, got %v", v.fails, rt.errors)
+			}
+		})
+	}
+}
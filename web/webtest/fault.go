@@ -0,0 +1,246 @@
+package webtest
+
+import (
+	"bytes"
+	"context"
+	"github.com/mousybusiness/go-web/web"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault describes what goes wrong with a request, faults can be combined
+type Fault struct {
+	// delays the request, if it reaches the client's timeout the request times out
+	Latency time.Duration
+	// fails the request as if the connection was reset
+	Reset bool
+	// fails the request with a timeout error once the client's timeout has passed
+	Timeout bool
+	// answers with Status and no body instead of sending the request
+	Status int
+	// cuts the body in half, reading it ends with io.ErrUnexpectedEOF
+	Truncate bool
+	// answers with a body that isn't valid json
+	MalformedJSON bool
+}
+
+// FaultRule injects its fault into the requests it matches
+type FaultRule struct {
+	fault       Fault
+	method      string
+	path        string
+	probability float64
+	times       int // -1 for every request
+	injected    int
+}
+
+// only injects the fault into requests for method and path, an empty method or path
+// matches any
+func (r *FaultRule) For(method, path string) *FaultRule {
+	r.method = strings.ToUpper(method)
+	r.path = path
+	return r
+}
+
+// injects the fault into a matching request with probability p, between 0 and 1
+func (r *FaultRule) Probability(p float64) *FaultRule {
+	r.probability = p
+	return r
+}
+
+// stops injecting the fault after n requests
+func (r *FaultRule) Times(n int) *FaultRule {
+	r.times = n
+	return r
+}
+
+func (r *FaultRule) matches(req *http.Request) bool {
+	return (r.method == "" || r.method == req.Method) && (r.path == "" || r.path == req.URL.Path)
+}
+
+// FaultInjector is a web.HTTPClient injecting faults into the requests of the client
+// it wraps. Faults are drawn from a seeded source so failures can be reproduced
+type FaultInjector struct {
+	client web.HTTPClient
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	rules    []*FaultRule
+	timeout  time.Duration
+	injected int
+}
+
+// creates a FaultInjector wrapping c, the same seed injects the same faults into the
+// same sequence of requests
+func NewFaultInjector(c web.HTTPClient, seed int64) *FaultInjector {
+	return &FaultInjector{
+		client: c,
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// injects fault into every request until narrowed down by the rule, rules are tried
+// in the order they were added and the first one firing applies
+func (f *FaultInjector) Inject(fault Fault) *FaultRule {
+	r := &FaultRule{fault: fault, probability: 1, times: -1}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, r)
+	return r
+}
+
+// number of requests a fault was injected into
+func (f *FaultInjector) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+func (f *FaultInjector) SetTimeout(timeout time.Duration) {
+	f.mu.Lock()
+	f.timeout = timeout
+	f.mu.Unlock()
+	f.client.SetTimeout(timeout)
+}
+
+func (f *FaultInjector) Do(req *http.Request) (*http.Response, error) {
+	fault, ok, timeout := f.next(req)
+	if !ok {
+		return f.client.Do(req)
+	}
+
+	if fault.Latency > 0 {
+		if timeout > 0 && fault.Latency >= timeout {
+			return nil, f.timedOut(req, timeout)
+		}
+		if err := sleep(req.Context(), fault.Latency); err != nil {
+			return nil, &url.Error{Op: urlOp(req), URL: req.URL.String(), Err: err}
+		}
+	}
+	if fault.Timeout {
+		return nil, f.timedOut(req, timeout)
+	}
+	if fault.Reset {
+		return nil, &url.Error{Op: urlOp(req), URL: req.URL.String(), Err: &net.OpError{
+			Op:  "read",
+			Net: "tcp",
+			Err: syscall.ECONNRESET,
+		}}
+	}
+
+	var resp *http.Response
+	if fault.Status != 0 {
+		resp = &http.Response{
+			StatusCode: fault.Status,
+			Status:     http.StatusText(fault.Status),
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}
+	} else {
+		r, err := f.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp = r
+	}
+
+	if fault.MalformedJSON || fault.Truncate {
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if fault.MalformedJSON {
+			b = malformed(b)
+		}
+		if fault.Truncate {
+			resp.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b[:len(b)/2]), errReader{io.ErrUnexpectedEOF}))
+		} else {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+		}
+		resp.ContentLength = int64(len(b))
+	}
+	return resp, nil
+}
+
+// picks the fault for req, with the client's current timeout
+func (f *FaultInjector) next(req *http.Request) (Fault, bool, time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.rules {
+		if !r.matches(req) || (r.times >= 0 && r.injected >= r.times) {
+			continue
+		}
+		// drawn even for certain rules so the sequence only depends on the requests made
+		if f.rand.Float64() >= r.probability {
+			continue
+		}
+		r.injected++
+		f.injected++
+		return r.fault, true, f.timeout
+	}
+	return Fault{}, false, f.timeout
+}
+
+// waits out timeout then fails like http.Client does when it's reached
+func (f *FaultInjector) timedOut(req *http.Request, timeout time.Duration) error {
+	if err := sleep(req.Context(), timeout); err != nil {
+		return &url.Error{Op: urlOp(req), URL: req.URL.String(), Err: err}
+	}
+	return &url.Error{Op: urlOp(req), URL: req.URL.String(), Err: timeoutError{}}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drops the closing byte, or answers a lone brace for empty bodies
+func malformed(b []byte) []byte {
+	if len(b) < 2 {
+		return []byte("{")
+	}
+	return b[:len(b)-1]
+}
+
+// url.Error uses the method, capitalized, as its operation
+func urlOp(req *http.Request) string {
+	m := strings.ToLower(req.Method)
+	if m == "" {
+		return "Get"
+	}
+	return strings.ToUpper(m[:1]) + m[1:]
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string {
+	return "webtest: injected timeout (Client.Timeout exceeded while awaiting headers)"
+}
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
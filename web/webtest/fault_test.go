@@ -0,0 +1,129 @@
+package webtest_test
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/web/webtest"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a fault injector over a mock answering every request with a json body
+func newFaultInjector(t *testing.T, seed int64) (*web.Instance, *webtest.FaultInjector) {
+	_, m := webtest.NewInstance(t)
+	m.On("GET", "/users").Reply(200, map[string]string{"id": "1"}).AnyTimes()
+	f := webtest.NewFaultInjector(m, seed)
+	return web.NewInstance(f), f
+}
+
+func TestFaultInjector(t *testing.T) {
+	tt := []struct {
+		name  string
+		fault webtest.Fault
+		check func(t *testing.T, code int, body []byte, err error)
+	}{
+		{"status", webtest.Fault{Status: 503}, func(t *testing.T, code int, body []byte, err error) {
+			if err != nil || code != 503 || len(body) != 0 {
+				t.Fatalf("want 503, got %d %s %v", code, body, err)
+			}
+		}},
+		{"reset", webtest.Fault{Reset: true}, func(t *testing.T, code int, body []byte, err error) {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("want connection reset, got %v", err)
+			}
+		}},
+		{"timeout", webtest.Fault{Timeout: true}, func(t *testing.T, code int, body []byte, err error) {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				t.Fatalf("want timeout, got %v", err)
+			}
+		}},
+		{"latency past timeout", webtest.Fault{Latency: time.Hour}, func(t *testing.T, code int, body []byte, err error) {
+			var ne net.Error
+			if !errors.As(err, &ne) || !ne.Timeout() {
+				t.Fatalf("want timeout, got %v", err)
+			}
+		}},
+		{"latency", webtest.Fault{Latency: time.Millisecond * 5}, func(t *testing.T, code int, body []byte, err error) {
+			if err != nil || code != 200 {
+				t.Fatalf("want 200, got %d %v", code, err)
+			}
+		}},
+		{"truncate", webtest.Fault{Truncate: true}, func(t *testing.T, code int, body []byte, err error) {
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("want unexpected eof, got %v", err)
+			}
+		}},
+		{"malformed json", webtest.Fault{MalformedJSON: true}, func(t *testing.T, code int, body []byte, err error) {
+			var v interface{}
+			if err != nil || code != 200 || json.Unmarshal(body, &v) == nil {
+				t.Fatalf("want malformed json, got %d %s %v", code, body, err)
+			}
+		}},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			w, f := newFaultInjector(t, 1)
+			f.Inject(v.fault)
+			start := time.Now()
+			code, body, err := w.Get("https://example.com/users", time.Millisecond*20)
+			if d := time.Since(start); d < v.fault.Latency && d < time.Millisecond*20 {
+				t.Fatalf("expected latency to be injected, took %v", d)
+			}
+			v.check(t, code, body, err)
+			if f.Injected() != 1 {
+				t.Fatalf("want 1 fault injected, got %d", f.Injected())
+			}
+		})
+	}
+}
+
+func TestFaultInjectorRules(t *testing.T) {
+	w, f := newFaultInjector(t, 1)
+	f.Inject(webtest.Fault{Status: 404}).For("GET", "/missing")
+	f.Inject(webtest.Fault{Status: 503}).For("GET", "/users").Times(2)
+
+	want := []int{503, 503, 200, 200}
+	for i, code := range want {
+		got, _, _ := w.Get("https://example.com/users", 0)
+		if got != code {
+			t.Fatalf("request %d; want: %v, got: %v", i, code, got)
+		}
+	}
+	// never reaches the mock, which would fail the test
+	if got, _, _ := w.Get("https://example.com/missing", 0); got != 404 {
+		t.Fatalf("want 404, got %d", got)
+	}
+}
+
+func TestFaultInjectorSeed(t *testing.T) {
+	codes := func(seed int64) []int {
+		w, f := newFaultInjector(t, seed)
+		f.Inject(webtest.Fault{Status: 500}).Probability(0.3)
+		var codes []int
+		for i := 0; i < 100; i++ {
+			code, _, _ := w.Get("https://example.com/users", 0)
+			codes = append(codes, code)
+		}
+		return codes
+	}
+
+	a, b := codes(42), codes(42)
+	failed := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("request %d; same seed should inject the same faults", i)
+		}
+		if a[i] == 500 {
+			failed++
+		}
+	}
+	if failed < 10 || failed > 50 {
+		t.Fatalf("expected about 30 faults, got %d", failed)
+	}
+}
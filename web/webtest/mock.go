@@ -0,0 +1,110 @@
+package webtest
+
+import (
+	"errors"
+	"github.com/mousybusiness/go-web/web"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock is a web.HTTPClient scoped to a single test, unlike MockClient it keeps no
+// package level state
+type Mock struct {
+	t testing.TB
+
+	mu           sync.Mutex
+	do           func(req *http.Request) (*http.Response, error)
+	timeout      time.Duration
+	expectations []*Expectation
+	calls        []Call
+}
+
+// Call is a request the mock received
+type Call struct {
+	Request *http.Request
+	// the request's body, read before it was answered
+	Body []byte
+}
+
+// creates a Mock installed as web.Client until the test ends, when the previous
+// web.Client is restored. Tests sharing web.Client can't run in parallel, see NewInstance
+func NewMock(t testing.TB) *Mock {
+	t.Helper()
+	m := newMock(t)
+	prev := web.Client
+	web.Client = m
+	t.Cleanup(func() {
+		web.Client = prev
+	})
+	return m
+}
+
+// creates a Mock and a web.Instance sending its requests to it, leaving web.Client
+// alone so the test can run in parallel with others
+func NewInstance(t testing.TB) (*web.Instance, *Mock) {
+	t.Helper()
+	m := newMock(t)
+	return web.NewInstance(m), m
+}
+
+func newMock(t testing.TB) *Mock {
+	m := &Mock{t: t}
+	t.Cleanup(func() {
+		m.AssertExpectations(t)
+	})
+	return m
+}
+
+// answers every request no expectation matched with fn
+func (m *Mock) DoFunc(fn func(req *http.Request) (*http.Response, error)) *Mock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.do = fn
+	return m
+}
+
+// every request received so far, in order
+func (m *Mock) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+func (m *Mock) Do(req *http.Request) (*http.Response, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	m.calls = append(m.calls, Call{Request: req, Body: body})
+	m.mu.Unlock()
+
+	resp, ok, err := m.expected(req, body)
+	if ok || err != nil {
+		return resp, err
+	}
+
+	m.mu.Lock()
+	do := m.do
+	m.mu.Unlock()
+	if do == nil {
+		m.t.Errorf("unexpected request %s %s", req.Method, req.URL)
+		return nil, errors.New("webtest: no response mocked for " + req.Method + " " + req.URL.String())
+	}
+	return do(req)
+}
+
+func (m *Mock) SetTimeout(timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.timeout = timeout
+}
+
+// the timeout last set by the code under test
+func (m *Mock) Timeout() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.timeout
+}
@@ -0,0 +1,74 @@
+package webtest_test
+
+import (
+	"fmt"
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/web/webtest"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// records test failures instead of failing
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestNewMock(t *testing.T) {
+	prev := web.Client
+
+	t.Run("installed", func(t *testing.T) {
+		m := webtest.NewMock(t).DoFunc(func(req *http.Request) (*http.Response, error) {
+			return webtest.MockResponse(201, "created", nil)
+		})
+		if web.Client != m {
+			t.Fatal("expected mock to be installed as web.Client")
+		}
+		code, body, err := web.Post("https://example.com/users", time.Second, nil)
+		if err != nil || code != 201 || string(body) != "created" {
+			t.Fatalf("unexpected response %d %s %v", code, body, err)
+		}
+		if m.Timeout() != time.Second {
+			t.Fatalf("expected timeout to be recorded, got %v", m.Timeout())
+		}
+	})
+
+	if web.Client != prev {
+		t.Fatal("expected web.Client to be restored once the test ended")
+	}
+}
+
+func TestNewInstance(t *testing.T) {
+	for _, code := range []int{200, 404, 500} {
+		code := code
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			t.Parallel()
+			w, m := webtest.NewInstance(t)
+			m.DoFunc(func(req *http.Request) (*http.Response, error) {
+				return webtest.MockResponse(code, "", nil)
+			})
+			for i := 0; i < 10; i++ {
+				got, _, err := w.Get("https://example.com", 0)
+				if err != nil || got != code {
+					t.Fatalf("expected %d, got %d %v", code, got, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMockUnexpected(t *testing.T) {
+	rt := &recordingT{TB: t}
+	w, _ := webtest.NewInstance(rt)
+	if _, _, err := w.Get("https://example.com/nothing", 0); err == nil {
+		t.Fatal("expected unmocked request to fail")
+	}
+	if len(rt.errors) != 1 {
+		t.Fatalf("expected the test to be failed, got %v", rt.errors)
+	}
+}
@@ -0,0 +1,200 @@
+package webtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ResponseBuilder builds mocked responses, every response built gets a fresh body
+type ResponseBuilder struct {
+	code          int
+	status        string
+	header        http.Header
+	trailer       http.Header
+	body          []byte
+	chunks        [][]byte
+	interval      time.Duration
+	delay         time.Duration
+	contentLength int64
+	err           error
+}
+
+// starts a response with code and no body
+func NewResponse(code int) *ResponseBuilder {
+	return &ResponseBuilder{
+		code:          code,
+		header:        http.Header{},
+		contentLength: -1,
+	}
+}
+
+// replaces the status text following the code
+func (b *ResponseBuilder) Status(text string) *ResponseBuilder {
+	b.status = text
+	return b
+}
+
+func (b *ResponseBuilder) Header(key, value string) *ResponseBuilder {
+	b.header.Add(key, value)
+	return b
+}
+
+// sets a trailer, only readable from the response once its body has been read to the end
+func (b *ResponseBuilder) Trailer(key, value string) *ResponseBuilder {
+	if b.trailer == nil {
+		b.trailer = http.Header{}
+	}
+	b.trailer.Add(key, value)
+	return b
+}
+
+func (b *ResponseBuilder) Body(body string) *ResponseBuilder {
+	b.body = []byte(body)
+	b.chunks = nil
+	return b
+}
+
+// marshals v as the body and sets the json Content-Type
+func (b *ResponseBuilder) JSON(v interface{}) *ResponseBuilder {
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("webtest: invalid json response: %v", err))
+	}
+	b.header.Set("Content-Type", "application/json")
+	b.body = j
+	b.chunks = nil
+	return b
+}
+
+// sends the body in chunks, waiting interval before each but the first
+func (b *ResponseBuilder) Stream(interval time.Duration, chunks ...string) *ResponseBuilder {
+	b.body = nil
+	b.chunks = nil
+	for _, c := range chunks {
+		b.chunks = append(b.chunks, []byte(c))
+	}
+	b.interval = interval
+	return b
+}
+
+// delays the first read of the body by d, the response itself is answered straight away
+func (b *ResponseBuilder) Delay(d time.Duration) *ResponseBuilder {
+	b.delay = d
+	return b
+}
+
+// overrides the content length, which defaults to the size of the body
+func (b *ResponseBuilder) ContentLength(n int64) *ResponseBuilder {
+	b.contentLength = n
+	return b
+}
+
+// fails the request with err instead of answering it
+func (b *ResponseBuilder) Error(err error) *ResponseBuilder {
+	b.err = err
+	return b
+}
+
+// answers req with a new response, can be used as a DoFunc
+func (b *ResponseBuilder) Do(req *http.Request) (*http.Response, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	resp := b.Build()
+	resp.Request = req
+	return resp, nil
+}
+
+func (b *ResponseBuilder) Build() *http.Response {
+	status := b.status
+	if status == "" {
+		status = http.StatusText(b.code)
+	}
+
+	chunks := b.chunks
+	if chunks == nil {
+		chunks = [][]byte{b.body}
+	}
+	n := b.contentLength
+	if n < 0 && b.chunks == nil {
+		n = int64(len(b.body))
+	}
+
+	resp := &http.Response{
+		Status:        strconv.Itoa(b.code) + " " + status,
+		StatusCode:    b.code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        b.header.Clone(),
+		ContentLength: n,
+	}
+	if n >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	}
+	body := &body{
+		chunks:   chunks,
+		interval: b.interval,
+		delay:    b.delay,
+	}
+	if b.trailer != nil {
+		// announced up front, the values arrive with the end of the body like net/http
+		resp.Trailer = http.Header{}
+		for k := range b.trailer {
+			resp.Trailer[k] = nil
+		}
+		trailer := b.trailer.Clone()
+		body.eof = func() {
+			for k, vs := range trailer {
+				resp.Trailer[k] = vs
+			}
+		}
+	}
+	resp.Body = body
+	return resp
+}
+
+// reads chunks one after the other, sleeping before each
+type body struct {
+	chunks   [][]byte
+	cur      io.Reader
+	interval time.Duration
+	delay    time.Duration
+	read     bool
+	eof      func()
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	for {
+		if b.cur != nil {
+			if n, _ := b.cur.Read(p); n > 0 {
+				return n, nil
+			}
+			b.cur = nil
+		}
+		if len(b.chunks) == 0 {
+			if b.eof != nil {
+				b.eof()
+				b.eof = nil
+			}
+			return 0, io.EOF
+		}
+		if !b.read {
+			time.Sleep(b.delay)
+			b.read = true
+		} else {
+			time.Sleep(b.interval)
+		}
+		b.cur = bytes.NewReader(b.chunks[0])
+		b.chunks = b.chunks[1:]
+	}
+}
+
+func (b *body) Close() error {
+	return nil
+}
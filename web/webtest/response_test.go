@@ -0,0 +1,104 @@
+package webtest_test
+
+import (
+	"errors"
+	"github.com/mousybusiness/go-web/web"
+	"github.com/mousybusiness/go-web/web/webtest"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseBuilder(t *testing.T) {
+	b := webtest.NewResponse(429).
+		Status("Slow Down").
+		Header("Retry-After", "30").
+		Header("Link", `<https://example.com/users?page=2>; rel="next"`).
+		JSON(map[string]string{"error": "rate limited"})
+
+	// every response gets its own body
+	for i := 0; i < 2; i++ {
+		resp := b.Build()
+		body, err := ioutil.ReadAll(resp.Body)
+		checkErr(t, err)
+		if string(body) != `{"error":"rate limited"}` {
+			t.Fatalf("unexpected body %s", body)
+		}
+		if resp.Status != "429 Slow Down" || resp.Header.Get("Retry-After") != "30" ||
+			resp.Header.Get("Content-Type") != "application/json" || resp.Header.Get("Link") == "" {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+		if resp.ContentLength != int64(len(body)) || resp.Header.Get("Content-Length") != "24" {
+			t.Fatalf("unexpected content length %d", resp.ContentLength)
+		}
+	}
+
+	resp := webtest.NewResponse(200).Body("stub").ContentLength(100).Build()
+	if resp.ContentLength != 100 || resp.Status != "200 OK" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	_, err := webtest.NewResponse(200).Error(errors.New("stub")).Do(&http.Request{})
+	if err == nil {
+		t.Fatal("expected the request to fail")
+	}
+}
+
+func TestResponseTrailer(t *testing.T) {
+	resp := webtest.NewResponse(200).Body("stub").Trailer("X-Checksum", "abc").Build()
+	if _, ok := resp.Trailer["X-Checksum"]; !ok || resp.Trailer.Get("X-Checksum") != "" {
+		t.Fatalf("trailer should be announced without a value before the body is read, got %v", resp.Trailer)
+	}
+	_, err := ioutil.ReadAll(resp.Body)
+	checkErr(t, err)
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf("trailer should be set once the body is read, got %v", resp.Trailer)
+	}
+}
+
+func TestResponseStream(t *testing.T) {
+	resp := webtest.NewResponse(200).
+		Delay(time.Millisecond*20).
+		Stream(time.Millisecond*10, "a", "b", "c").
+		Build()
+	if resp.ContentLength != -1 {
+		t.Fatalf("streamed bodies have no content length, got %d", resp.ContentLength)
+	}
+
+	start := time.Now()
+	body, err := ioutil.ReadAll(resp.Body)
+	checkErr(t, err)
+	if string(body) != "abc" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if d := time.Since(start); d < time.Millisecond*40 {
+		t.Fatalf("expected body to be delayed and streamed, took %v", d)
+	}
+}
+
+func TestMockCalls(t *testing.T) {
+	w, m := webtest.NewInstance(t)
+	m.On("POST", "/users").ReplyWith(webtest.NewResponse(201).Header("Location", "/users/1"))
+	m.DoFunc(webtest.NewResponse(404).Do)
+
+	code, _, err := w.Post("https://example.com/users", time.Second, []byte(`{"name":"bob"}`), web.KV{Key: "X-Request-Id", Value: "1"})
+	if err != nil || code != 201 {
+		t.Fatalf("unexpected response %d %v", code, err)
+	}
+	code, _, _ = w.Get("https://example.com/users/2", time.Second)
+	if code != 404 {
+		t.Fatalf("want 404, got %d", code)
+	}
+
+	calls := m.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("want 2 calls, got %d", len(calls))
+	}
+	if r := calls[0].Request; r.Method != "POST" || r.Header.Get("X-Request-Id") != "1" || string(calls[0].Body) != `{"name":"bob"}` {
+		t.Fatalf("unexpected call %s %v %s", r.Method, r.Header, calls[0].Body)
+	}
+	if r := calls[1].Request; r.URL.Path != "/users/2" || calls[1].Body != nil {
+		t.Fatalf("unexpected call %s %s", r.URL, calls[1].Body)
+	}
+}
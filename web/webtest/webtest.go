@@ -1,8 +1,6 @@
 package webtest
 
 import (
-	"bytes"
-	"io/ioutil"
 	"net/http"
 	"time"
 )
@@ -19,9 +17,7 @@ func (m MockClient) Do(req *http.Request) (*http.Response, error) {
 func (m MockClient) SetTimeout(timeout time.Duration) {
 }
 
+// answers with code and body, see NewResponse for headers, trailers and streamed bodies
 func MockResponse(code int, body string, err error) (*http.Response, error) {
-	return &http.Response{
-		StatusCode: code,
-		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
-	}, err
+	return NewResponse(code).Body(body).Build(), err
 }
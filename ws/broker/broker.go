@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned once the broker has been closed
+var ErrClosed = errors.New("broker closed")
+
+// Broker publishes messages on channels to every subscriber, on any node sharing it
+type Broker interface {
+	Publish(ctx context.Context, channel string, data []byte) error
+	// fn is called for every message published on channel until the subscription is
+	// cancelled, calls for a channel are made in publish order from a single goroutine
+	Subscribe(ctx context.Context, channel string, fn func(data []byte)) (Subscription, error)
+	Close() error
+}
+
+// Subscription to a channel
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// fans messages for a channel out to local subscribers, shared by broker implementations
+type registry struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[string]map[int]func([]byte)
+}
+
+func newRegistry() *registry {
+	return &registry{subs: make(map[string]map[int]func([]byte))}
+}
+
+// adds fn to channel, first is true if channel had no subscribers
+func (r *registry) add(channel string, fn func([]byte)) (id int, first bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	subs, ok := r.subs[channel]
+	if !ok {
+		subs = make(map[int]func([]byte))
+		r.subs[channel] = subs
+	}
+	r.nextID++
+	subs[r.nextID] = fn
+	return r.nextID, !ok
+}
+
+// removes subscriber id from channel, last is true if channel has no subscribers left
+func (r *registry) remove(channel string, id int) (last bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	subs, ok := r.subs[channel]
+	if !ok {
+		return false
+	}
+	delete(subs, id)
+	if len(subs) == 0 {
+		delete(r.subs, channel)
+		return true
+	}
+	return false
+}
+
+func (r *registry) channels() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.subs))
+	for ch := range r.subs {
+		out = append(out, ch)
+	}
+	return out
+}
+
+func (r *registry) deliver(channel string, data []byte) {
+	r.mu.RLock()
+	fns := make([]func([]byte), 0, len(r.subs[channel]))
+	for _, fn := range r.subs[channel] {
+		fns = append(fns, fn)
+	}
+	r.mu.RUnlock()
+	for _, fn := range fns {
+		fn(data)
+	}
+}
+
+// cancels a registry subscription once
+type subscription struct {
+	once sync.Once
+	fn   func() error
+	err  error
+}
+
+func (s *subscription) Unsubscribe() error {
+	s.once.Do(func() { s.err = s.fn() })
+	return s.err
+}
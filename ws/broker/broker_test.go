@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// exercises any Broker, both subscribers must see every message in order
+func testBroker(t *testing.T, a, b Broker) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	gotA := make(chan string, 10)
+	gotB := make(chan string, 10)
+	subA, err := a.Subscribe(ctx, "chan", func(data []byte) { gotA <- string(data) })
+	checkErr(t, err)
+	_, err = b.Subscribe(ctx, "chan", func(data []byte) { gotB <- string(data) })
+	checkErr(t, err)
+
+	// other channels are not delivered
+	_, err = b.Subscribe(ctx, "other", func(data []byte) { gotB <- "other:" + string(data) })
+	checkErr(t, err)
+
+	for _, msg := range []string{"1", "2", "3"} {
+		checkErr(t, a.Publish(ctx, "chan", []byte(msg)))
+	}
+	for _, got := range []chan string{gotA, gotB} {
+		for _, want := range []string{"1", "2", "3"} {
+			select {
+			case s := <-got:
+				if s != want {
+					t.Fatalf("message; want: %v, got: %v", want, s)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected %s before timeout", want)
+			}
+		}
+	}
+
+	// unsubscribed, only b receives
+	checkErr(t, subA.Unsubscribe())
+	checkErr(t, b.Publish(ctx, "chan", []byte("4")))
+	select {
+	case s := <-gotB:
+		if s != "4" {
+			t.Fatalf("message; want: %v, got: %v", "4", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected message before timeout")
+	}
+	select {
+	case s := <-gotA:
+		t.Fatalf("unsubscribed handler called with %s", s)
+	case <-time.After(time.Millisecond * 20):
+	}
+
+	checkErr(t, a.Close())
+	checkErrNil(t, a.Publish(ctx, "chan", []byte("closed")))
+}
+
+func TestMemory(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	m := NewMemory()
+	testBroker(t, m, m)
+}
+
+func TestMemoryPublishFromSubscriber(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	m := NewMemory()
+	defer m.Close()
+	ctx := context.Background()
+
+	// each message is republished, more than any fixed queue would hold
+	const n = 5000
+	done := make(chan struct{})
+	_, err := m.Subscribe(ctx, "chan", func(data []byte) {
+		if len(data) == n {
+			close(done)
+			return
+		}
+		checkErr(t, m.Publish(ctx, "chan", append(data, '.')))
+		checkErr(t, m.Publish(ctx, "other", data))
+	})
+	checkErr(t, err)
+
+	checkErr(t, m.Publish(ctx, "chan", []byte(".")))
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("publishing from a subscriber shouldnt deadlock")
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
+
+func checkErrNil(t *testing.T, err error) {
+	if err == nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+type memory struct {
+	reg *registry
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when queue grows or the broker closes
+	queue  []message
+	closed bool
+	done   chan struct{}
+}
+
+type message struct {
+	channel string
+	data    []byte
+}
+
+// creates a Broker delivering within the process, for tests and single node deployments
+func NewMemory() Broker {
+	m := &memory{
+		reg:  newRegistry(),
+		done: make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	go m.run()
+	return m
+}
+
+// delivers from a single goroutine so publishers never run subscriber code
+func (m *memory) run() {
+	defer close(m.done)
+	for {
+		m.mu.Lock()
+		for len(m.queue) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		batch := m.queue
+		m.queue = nil
+		m.mu.Unlock()
+
+		if len(batch) == 0 {
+			// closed and drained
+			return
+		}
+		for _, msg := range batch {
+			m.reg.deliver(msg.channel, msg.data)
+		}
+	}
+}
+
+// queues data without blocking, so subscribers may publish from their callbacks
+func (m *memory) Publish(ctx context.Context, channel string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b := append([]byte(nil), data...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.queue = append(m.queue, message{channel: channel, data: b})
+	m.cond.Signal()
+	return nil
+}
+
+func (m *memory) Subscribe(ctx context.Context, channel string, fn func(data []byte)) (Subscription, error) {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	id, _ := m.reg.add(channel, fn)
+	return &subscription{fn: func() error {
+		m.reg.remove(channel, id)
+		return nil
+	}}, nil
+}
+
+// stops accepting messages and waits for those queued to be delivered
+func (m *memory) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.cond.Signal()
+	m.mu.Unlock()
+	<-m.done
+	return nil
+}
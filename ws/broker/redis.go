@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"context"
+	errs "github.com/pkg/errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// RedisOptions configures NewRedis, zero values use the defaults
+type RedisOptions struct {
+	Password      string
+	DialTimeout   time.Duration // defaults to 5 seconds
+	RetryInterval time.Duration // wait between redials of a lost subscriber connection, defaults to 1 second
+}
+
+type redis struct {
+	addr string
+	opts RedisOptions
+	reg  *registry
+
+	pmu sync.Mutex // one publish at a time on pub
+	pub *respConn
+
+	mu         sync.Mutex // held while the registry and the server's subscriptions change together
+	sub        *respConn
+	confirming map[string]*confirmation
+	closed     bool
+	done       chan struct{}
+}
+
+// SUBSCRIBEs sent for a channel the server hasn't confirmed yet, done closes once it has
+// confirmed them all
+type confirmation struct {
+	n    int
+	done chan struct{}
+}
+
+// creates a Broker publishing and subscribing through a Redis compatible server at addr,
+// every node connected to the same server receives every message
+func NewRedis(addr string, opts RedisOptions) (Broker, error) {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = time.Second * 5
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+
+	r := &redis{
+		addr:       addr,
+		opts:       opts,
+		reg:        newRegistry(),
+		confirming: make(map[string]*confirmation),
+		done:       make(chan struct{}),
+	}
+
+	sub, err := r.dial()
+	if err != nil {
+		return nil, err
+	}
+	r.sub = sub
+	go r.readLoop(sub)
+	return r, nil
+}
+
+func (r *redis) dial() (*respConn, error) {
+	nc, err := net.DialTimeout("tcp", r.addr, r.opts.DialTimeout)
+	if err != nil {
+		return nil, errs.Wrapf(err, "failed to dial %s", r.addr)
+	}
+	c := newRESPConn(nc)
+	if r.opts.Password != "" {
+		if _, err := c.do([]byte("AUTH"), []byte(r.opts.Password)); err != nil {
+			c.Close()
+			return nil, errs.Wrap(err, "failed to authenticate")
+		}
+	}
+	return c, nil
+}
+
+func (r *redis) Publish(ctx context.Context, channel string, data []byte) error {
+	r.pmu.Lock()
+	defer r.pmu.Unlock()
+
+	// retry once on a fresh connection if the idle one was dropped
+	var err error
+	for i := 0; i < 2; i++ {
+		if err = r.publish(ctx, channel, data); err == nil {
+			return nil
+		}
+		if _, ok := err.(RESPError); ok || ctx.Err() != nil {
+			break
+		}
+	}
+	return errs.Wrapf(err, "failed to publish on %s", channel)
+}
+
+// r.pmu must be held
+func (r *redis) publish(ctx context.Context, channel string, data []byte) error {
+	r.mu.Lock()
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	if r.pub == nil {
+		c, err := r.dial()
+		if err != nil {
+			return err
+		}
+		r.pub = c
+	}
+
+	deadline, _ := ctx.Deadline()
+	r.pub.conn.SetDeadline(deadline)
+	_, err := r.pub.do([]byte("PUBLISH"), []byte(channel), data)
+	if err != nil {
+		if _, ok := err.(RESPError); !ok {
+			r.pub.Close()
+			r.pub = nil
+		}
+	}
+	return err
+}
+
+// returns once the server confirmed the subscription, every subscriber to a channel
+// waits for the SUBSCRIBEs still pending for it so none misses a publish made after
+func (r *redis) Subscribe(ctx context.Context, channel string, fn func(data []byte)) (Subscription, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, ErrClosed
+	}
+	id, first := r.reg.add(channel, fn)
+	s := &subscription{fn: func() error { return r.unsubscribe(channel, id) }}
+	if first {
+		if err := r.sub.write([]byte("SUBSCRIBE"), []byte(channel)); err != nil {
+			r.mu.Unlock()
+			// the read loop redials and subscribes to every registered channel
+			log.Println("failed to subscribe to", channel, "retrying on reconnect,", err)
+			return s, nil
+		}
+		c := r.confirming[channel]
+		if c == nil {
+			c = &confirmation{done: make(chan struct{})}
+			r.confirming[channel] = c
+		}
+		c.n++
+	}
+	var confirmed chan struct{}
+	if c := r.confirming[channel]; c != nil {
+		confirmed = c.done
+	}
+	r.mu.Unlock()
+	if confirmed == nil {
+		return s, nil
+	}
+
+	select {
+	case <-confirmed:
+		return s, nil
+	case <-r.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		s.Unsubscribe()
+		return nil, ctx.Err()
+	}
+}
+
+func (r *redis) unsubscribe(channel string, id int) error {
+	// under r.mu so the UNSUBSCRIBE can't overtake the SUBSCRIBE of a new first subscriber
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.reg.remove(channel, id) || r.closed {
+		return nil
+	}
+	return r.sub.write([]byte("UNSUBSCRIBE"), []byte(channel))
+}
+
+// counts a subscription confirmed by the server, r.mu must be held
+func (r *redis) confirm(channel string) {
+	c := r.confirming[channel]
+	if c == nil {
+		return
+	}
+	if c.n--; c.n <= 0 {
+		close(c.done)
+		delete(r.confirming, channel)
+	}
+}
+
+func (r *redis) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	err := r.sub.Close()
+	r.mu.Unlock()
+
+	r.pmu.Lock()
+	if r.pub != nil {
+		r.pub.Close()
+		r.pub = nil
+	}
+	r.pmu.Unlock()
+
+	<-r.done
+	return err
+}
+
+// reads pushed messages, redialling and resubscribing when the connection is lost
+func (r *redis) readLoop(c *respConn) {
+	defer close(r.done)
+	for {
+		v, err := c.read()
+		if err != nil {
+			if c = r.reconnect(); c == nil {
+				return
+			}
+			continue
+		}
+
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) < 3 {
+			continue
+		}
+		kind, _ := msg[0].([]byte)
+		channel, _ := msg[1].([]byte)
+		switch string(kind) {
+		case "message":
+			if data, ok := msg[2].([]byte); ok {
+				r.reg.deliver(string(channel), data)
+			}
+		case "subscribe":
+			r.mu.Lock()
+			r.confirm(string(channel))
+			r.mu.Unlock()
+		}
+	}
+}
+
+// returns the new subscriber connection, nil once closed
+func (r *redis) reconnect() *respConn {
+	for {
+		r.mu.Lock()
+		closed := r.closed
+		r.mu.Unlock()
+		if closed {
+			return nil
+		}
+
+		c, err := r.dial()
+		if err == nil {
+			r.mu.Lock()
+			if r.closed {
+				r.mu.Unlock()
+				c.Close()
+				return nil
+			}
+			channels := r.reg.channels()
+			for _, ch := range channels {
+				if err = c.write([]byte("SUBSCRIBE"), []byte(ch)); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				// SUBSCRIBEs sent on the lost connection won't be confirmed, only these will
+				pending := r.confirming
+				r.confirming = make(map[string]*confirmation, len(channels))
+				for _, ch := range channels {
+					cf := pending[ch]
+					if cf == nil {
+						cf = &confirmation{done: make(chan struct{})}
+					}
+					delete(pending, ch)
+					cf.n = 1
+					r.confirming[ch] = cf
+				}
+				for _, cf := range pending {
+					close(cf.done)
+				}
+				r.sub = c
+				r.mu.Unlock()
+				return c
+			}
+			r.mu.Unlock()
+			c.Close()
+		}
+
+		log.Println("lost broker subscriber connection, retrying,", err)
+		time.Sleep(r.opts.RetryInterval)
+	}
+}
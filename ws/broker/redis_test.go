@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// in-process stand-in for a Redis server, speaking just enough of the protocol for pub/sub
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu    sync.Mutex
+	conns map[*fakeConn]struct{}
+	subs  map[string]map[*fakeConn]struct{}
+	held  chan struct{} // SUBSCRIBEs wait for it to close when set
+}
+
+type fakeConn struct {
+	*respConn
+	mu sync.Mutex
+}
+
+func (c *fakeConn) reply(s string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write([]byte(s))
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(t, err)
+	f := &fakeRedis{
+		ln:       ln,
+		password: password,
+		conns:    make(map[*fakeConn]struct{}),
+		subs:     make(map[string]map[*fakeConn]struct{}),
+	}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &fakeConn{respConn: newRESPConn(nc)}
+			f.mu.Lock()
+			f.conns[c] = struct{}{}
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(c *fakeConn) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, c)
+		for _, subs := range f.subs {
+			delete(subs, c)
+		}
+		f.mu.Unlock()
+		c.Close()
+	}()
+
+	authed := f.password == ""
+	for {
+		v, err := c.read()
+		if err != nil {
+			return
+		}
+		args, _ := v.([]interface{})
+		if len(args) == 0 {
+			c.reply("-ERR empty command\r\n")
+			continue
+		}
+		arg := func(i int) string { b, _ := args[i].([]byte); return string(b) }
+
+		cmd := strings.ToUpper(arg(0))
+		if !authed && cmd != "AUTH" {
+			c.reply("-NOAUTH Authentication required.\r\n")
+			continue
+		}
+
+		switch cmd {
+		case "AUTH":
+			if arg(1) != f.password {
+				c.reply("-WRONGPASS invalid password\r\n")
+				continue
+			}
+			authed = true
+			c.reply("+OK\r\n")
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			f.mu.Lock()
+			held := f.held
+			f.mu.Unlock()
+			if held != nil && cmd == "SUBSCRIBE" {
+				<-held
+			}
+			for i := 1; i < len(args); i++ {
+				f.mu.Lock()
+				if cmd == "SUBSCRIBE" {
+					if f.subs[arg(i)] == nil {
+						f.subs[arg(i)] = make(map[*fakeConn]struct{})
+					}
+					f.subs[arg(i)][c] = struct{}{}
+				} else {
+					delete(f.subs[arg(i)], c)
+				}
+				f.mu.Unlock()
+				c.reply("*3\r\n" + bulk(strings.ToLower(cmd)) + bulk(arg(i)) + ":1\r\n")
+			}
+		case "PUBLISH":
+			f.mu.Lock()
+			var receivers []*fakeConn
+			for s := range f.subs[arg(1)] {
+				receivers = append(receivers, s)
+			}
+			f.mu.Unlock()
+			for _, s := range receivers {
+				s.reply("*3\r\n" + bulk("message") + bulk(arg(1)) + bulk(arg(2)))
+			}
+			c.reply(fmt.Sprintf(":%d\r\n", len(receivers)))
+		default:
+			c.reply("-ERR unknown command '" + cmd + "'\r\n")
+		}
+	}
+}
+
+// holds SUBSCRIBEs back until release is called
+func (f *fakeRedis) hold() (release func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.held = make(chan struct{})
+	held := f.held
+	return func() {
+		f.mu.Lock()
+		f.held = nil
+		f.mu.Unlock()
+		close(held)
+	}
+}
+
+// drops every client connection, as if the server restarted
+func (f *fakeRedis) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.conns {
+		c.Close()
+	}
+}
+
+func (f *fakeRedis) Close() {
+	f.ln.Close()
+	f.dropConns()
+}
+
+func TestRedis(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	f := newFakeRedis(t, "secret")
+	defer f.Close()
+
+	opts := RedisOptions{Password: "secret", RetryInterval: time.Millisecond * 10}
+	a, err := NewRedis(f.ln.Addr().String(), opts)
+	checkErr(t, err)
+	b, err := NewRedis(f.ln.Addr().String(), opts)
+	checkErr(t, err)
+	defer b.Close()
+
+	testBroker(t, a, b)
+
+	// wrong password
+	_, err = NewRedis(f.ln.Addr().String(), RedisOptions{Password: "wrong"})
+	checkErrNil(t, err)
+}
+
+func TestRedisReconnect(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	f := newFakeRedis(t, "")
+	defer f.Close()
+
+	r, err := NewRedis(f.ln.Addr().String(), RedisOptions{RetryInterval: time.Millisecond * 10})
+	checkErr(t, err)
+	defer r.Close()
+
+	ctx := context.Background()
+	got := make(chan string, 10)
+	_, err = r.Subscribe(ctx, "chan", func(data []byte) { got <- string(data) })
+	checkErr(t, err)
+
+	f.dropConns()
+
+	// publishing redials and the subscription is restored
+	deadline := time.After(time.Second * 2)
+	for {
+		checkErr(t, r.Publish(ctx, "chan", []byte("after")))
+		select {
+		case s := <-got:
+			if s != "after" {
+				t.Fatalf("message; want: %v, got: %v", "after", s)
+			}
+			return
+		case <-time.After(time.Millisecond * 20):
+		case <-deadline:
+			t.Fatalf("subscription should be restored after reconnect")
+		}
+	}
+}
+
+func TestRedisSubscribeConfirmed(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	f := newFakeRedis(t, "")
+	defer f.Close()
+	b, err := NewRedis(f.ln.Addr().String(), RedisOptions{})
+	checkErr(t, err)
+	defer b.Close()
+	r := b.(*redis)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	got := make(chan string, 2)
+	subscribe := func() chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := b.Subscribe(ctx, "chan", func(data []byte) { got <- string(data) })
+			errc <- err
+		}()
+		return errc
+	}
+
+	release := f.hold()
+	first := subscribe()
+	for len(r.reg.channels()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a later subscriber waits for the first one's SUBSCRIBE to be confirmed too
+	second := subscribe()
+	select {
+	case err := <-second:
+		t.Fatalf("subscribe returned before the server confirmed it: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+	release()
+	checkErr(t, <-first)
+	checkErr(t, <-second)
+
+	checkErr(t, b.Publish(ctx, "chan", []byte("hi")))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-got:
+		case <-ctx.Done():
+			t.Fatalf("expected both subscribers to receive the message")
+		}
+	}
+}
+
+func TestRedisResubscribe(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	f := newFakeRedis(t, "")
+	defer f.Close()
+	b, err := NewRedis(f.ln.Addr().String(), RedisOptions{})
+	checkErr(t, err)
+	defer b.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 200; i++ {
+		old, err := b.Subscribe(ctx, "user", func([]byte) {})
+		checkErr(t, err)
+
+		// the last subscriber leaves as a new first one joins
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			old.Unsubscribe()
+		}()
+		got := make(chan struct{}, 1)
+		s, err := b.Subscribe(ctx, "user", func([]byte) {
+			select {
+			case got <- struct{}{}:
+			default:
+			}
+		})
+		checkErr(t, err)
+		wg.Wait()
+
+		checkErr(t, b.Publish(ctx, "user", []byte("hi")))
+		select {
+		case <-got:
+		case <-time.After(time.Second):
+			t.Fatalf("subscription %d lost to a concurrent unsubscribe", i)
+		}
+		checkErr(t, s.Unsubscribe())
+	}
+}
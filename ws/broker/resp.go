@@ -0,0 +1,120 @@
+package broker
+
+import (
+	"bufio"
+	errs "github.com/pkg/errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// RESPError is an error reply from a Redis protocol server
+type RESPError string
+
+func (e RESPError) Error() string {
+	return string(e)
+}
+
+// connection speaking the Redis serialization protocol
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func newRESPConn(conn net.Conn) *respConn {
+	return &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// writes a command as an array of bulk strings
+func (c *respConn) write(args ...[]byte) error {
+	c.w.WriteByte('*')
+	c.w.WriteString(strconv.Itoa(len(args)))
+	c.w.WriteString("\r\n")
+	for _, a := range args {
+		c.w.WriteByte('$')
+		c.w.WriteString(strconv.Itoa(len(a)))
+		c.w.WriteString("\r\n")
+		c.w.Write(a)
+		c.w.WriteString("\r\n")
+	}
+	return c.w.Flush()
+}
+
+// reads a reply, one of string, RESPError, int64, []byte, nil or []interface{}
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errs.New("empty resp line")
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return RESPError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, errs.Errorf("unexpected resp type %q", line[0])
+}
+
+// reads a line without its CRLF
+func (c *respConn) line() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errs.New("malformed resp line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// sends a command and reads its reply, error replies are returned as errors
+func (c *respConn) do(args ...[]byte) (interface{}, error) {
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	v, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := v.(RESPError); ok {
+		return nil, e
+	}
+	return v, nil
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
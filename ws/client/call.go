@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	errs "github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// CallTimeout bounds calls whose context has no deadline
+var CallTimeout = time.Second * 30
+
+// what a pending call is answered with
+type callResult struct {
+	e   envelope.Envelope
+	err error
+}
+
+// sends a call to method with params and waits for the result, which is unmarshalled
+// into result if it is not nil. Read or a Router must be serving the connection for the
+// result to be received. Calls can be made concurrently and are matched to their result
+// by correlation id, server errors are returned as *envelope.Error
+func (c *Connection) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	if _, ok := ctx.Deadline(); !ok && CallTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, CallTimeout)
+		defer cancel()
+	}
+
+	e, err := envelope.New(method, params)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.readErr != nil {
+		c.mu.Unlock()
+		return errs.Wrapf(c.readErr, "call %s, connection lost", method)
+	}
+	if c.pending == nil {
+		c.pending = make(map[string]chan callResult)
+	}
+	c.lastID++
+	e.ID = strconv.FormatUint(c.lastID, 10)
+	ch := make(chan callResult, 1)
+	c.pending[e.ID] = ch
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, e.ID)
+		c.mu.Unlock()
+	}()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Write(b); err != nil {
+		return errs.Wrapf(err, "failed to send call %s", method)
+	}
+
+	select {
+	case <-ctx.Done():
+		return errs.Wrapf(ctx.Err(), "call %s", method)
+	case res := <-ch:
+		if res.err != nil {
+			return errs.Wrapf(res.err, "call %s", method)
+		}
+		r := res.e
+		if r.Type == envelope.TypeError {
+			if err := r.Err(); err != nil {
+				return err
+			}
+			return errs.Errorf("call %s failed", method)
+		}
+		if result == nil || len(r.Payload) == 0 {
+			return nil
+		}
+		return errs.Wrapf(json.Unmarshal(r.Payload, result), "invalid result for %s", method)
+	}
+}
+
+// delivers m to the call waiting on it, false if m doesn't answer a pending call
+func (c *Connection) resolve(m []byte) bool {
+	c.mu.Lock()
+	waiting := len(c.pending) != 0
+	c.mu.Unlock()
+	if !waiting {
+		return false
+	}
+
+	e, err := envelope.Parse(m)
+	if err != nil || e.ID == "" || (e.Type != envelope.TypeResult && e.Type != envelope.TypeError) {
+		return false
+	}
+
+	c.mu.Lock()
+	ch, ok := c.pending[e.ID]
+	delete(c.pending, e.ID)
+	c.mu.Unlock()
+	if ok {
+		ch <- callResult{e: e}
+	}
+	return ok
+}
+
+// answers every pending call with err once the connection is lost
+func (c *Connection) failPending(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readErr = err
+	for id, ch := range c.pending {
+		ch <- callResult{err: errs.Wrap(err, "connection lost")}
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answers every call written to it with handler on the read side
+type echoServer struct {
+	recordingConn
+	handler func(e envelope.Envelope) *envelope.Envelope
+}
+
+func newEchoServer(handler func(e envelope.Envelope) *envelope.Envelope) *echoServer {
+	return &echoServer{
+		recordingConn: recordingConn{reads: make(chan []byte)},
+		handler:       handler,
+	}
+}
+
+func (s *echoServer) WriteMessage(messageType int, data []byte) error {
+	e, err := envelope.Parse(data)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if r := s.handler(e); r != nil {
+			b, _ := json.Marshal(r)
+			s.reads <- b
+		}
+	}()
+	return nil
+}
+
+func TestCall(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newEchoServer(func(e envelope.Envelope) *envelope.Envelope {
+		var p chatMsg
+		_ = json.Unmarshal(e.Payload, &p)
+		switch e.Type {
+		case "echo":
+			// answer the first call last to prove results are matched by id
+			if p.Text == "0" {
+				time.Sleep(time.Millisecond * 20)
+			}
+			r, _ := envelope.NewResult(e.ID, p)
+			return &r
+		case "fail":
+			r := envelope.NewCallError(e.ID, &envelope.Error{Code: "stub", Message: "stub"})
+			return &r
+		}
+		return nil // never answered
+	})
+	conn := &Connection{Name: "stub", Conn: srv}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn.Read(ctx, make(chan []byte))
+
+	// concurrent calls are multiplexed
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			var res chatMsg
+			if err := conn.Call(ctx, "echo", chatMsg{Text: text}, &res); err != nil {
+				t.Error(err)
+				return
+			}
+			if res.Text != text {
+				t.Errorf("call result; want: %v, got: %v", text, res.Text)
+			}
+		}(string(rune('0' + i)))
+	}
+	wg.Wait()
+
+	// server error
+	err := conn.Call(ctx, "fail", nil, nil)
+	var e *envelope.Error
+	if !errors.As(err, &e) || e.Code != "stub" {
+		t.Fatalf("expected server error envelope, got: %v", err)
+	}
+
+	// timeout
+	tctx, tcancel := context.WithTimeout(ctx, time.Millisecond*20)
+	defer tcancel()
+	err = conn.Call(tctx, "ignored", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got: %v", err)
+	}
+
+	// cancellation
+	cctx, ccancel := context.WithCancel(ctx)
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		ccancel()
+	}()
+	err = conn.Call(cctx, "ignored", nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got: %v", err)
+	}
+
+	if len(conn.pending) != 0 {
+		t.Fatalf("finished calls should not remain pending")
+	}
+}
+
+func TestCallConnectionLost(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newEchoServer(func(e envelope.Envelope) *envelope.Envelope { return nil })
+	conn := &Connection{Name: "stub", Conn: srv}
+	conn.Read(context.Background(), make(chan []byte))
+
+	errCh := make(chan error)
+	go func() { errCh <- conn.Call(context.Background(), "ignored", nil, nil) }()
+
+	time.Sleep(time.Millisecond * 10)
+	close(srv.reads)
+
+	select {
+	case err := <-errCh:
+		checkErrNil(t, err)
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("pending call should fail when the connection is lost")
+	}
+
+	// calls after the connection is lost fail immediately
+	checkErrNil(t, conn.Call(context.Background(), "ignored", nil, nil))
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/envelope"
 	errs "github.com/pkg/errors"
 	"net/http"
 	"net/url"
+	"sync"
 )
 
 type websocketIO interface {
@@ -22,13 +24,117 @@ type Dialer interface {
 type Connection struct {
 	Name string
 	Conn websocketIO
+
+	wmu     sync.Mutex // gorilla supports one concurrent writer
+	mu      sync.Mutex
+	lastID  uint64
+	pending map[string]chan callResult
+	readErr error // set once the read loop has stopped
+
+	interceptors []func(m []byte) bool
+	acks         map[uint64]struct{} // recently acked delivery sequence numbers
+	ackOrder     []uint64            // acks in the order they were made, oldest first
+	session      string
+	offset       uint64 // highest broadcast offset handled in session
+	resuming     envelope.Resume
+
+	compression *Compression // guarded by wmu
 }
 
-//  write to websocket
+// write to websocket
 func (c *Connection) Write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.compression != nil {
+		c.Conn.(compressor).EnableWriteCompression(len(b) >= c.compression.Threshold)
+	}
 	return c.Conn.WriteMessage(websocket.TextMessage, b)
 }
 
+// write payload to websocket wrapped in an envelope of msgType
+func (c *Connection) Send(msgType string, payload interface{}) error {
+	b, err := envelope.Marshal(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.Write(b)
+}
+
+// number of recent acks remembered to skip duplicate deliveries
+const maxAcks = 1024
+
+// acknowledges the delivery with seq, earlier deliveries are unaffected
+func (c *Connection) Ack(seq uint64) error {
+	if err := c.Send(envelope.TypeAck, envelope.Ack{Seq: seq}); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.acks[seq]; ok {
+		return nil
+	}
+	if c.acks == nil {
+		c.acks = make(map[uint64]struct{})
+	}
+	c.acks[seq] = struct{}{}
+	c.ackOrder = append(c.ackOrder, seq)
+	if len(c.ackOrder) > maxAcks {
+		delete(c.acks, c.ackOrder[0])
+		c.ackOrder = c.ackOrder[1:]
+	}
+	return nil
+}
+
+// true when seq has already been acked, so the delivery is a duplicate
+func (c *Connection) acked(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.acks[seq]
+	return ok
+}
+
+// session id assigned by the server and the last offset handled in it, pass both to
+// Resume on a new connection to have missed messages replayed
+func (c *Connection) Session() (string, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session, c.offset
+}
+
+// asks the server to resume session id, replaying every message after offset
+func (c *Connection) Resume(id string, offset uint64) error {
+	if id == "" {
+		return errors.New("session id is empty")
+	}
+	c.mu.Lock()
+	c.resuming = envelope.Resume{Session: id, Offset: offset}
+	c.mu.Unlock()
+	return c.Send(envelope.TypeResume, c.resuming)
+}
+
+// records the session the server says this connection is in
+func (c *Connection) setSession(s envelope.Session) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case s.ID == c.resuming.Session:
+		// replay continues from where the previous connection left off
+		c.session, c.offset = s.ID, c.resuming.Offset
+		c.resuming = envelope.Resume{}
+	case s.ID != c.session:
+		c.session, c.offset = s.ID, 0
+	}
+}
+
+// records offset as handled
+func (c *Connection) handled(offset uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if offset > c.offset {
+		c.offset = offset
+	}
+}
+
 // read loop for wesocket
 func (c *Connection) Read(ctx context.Context, msgCh chan []byte) {
 	go func() {
@@ -40,14 +146,42 @@ func (c *Connection) Read(ctx context.Context, msgCh chan []byte) {
 			}
 			_, m, err := c.Conn.ReadMessage()
 			if err != nil {
+				c.failPending(err)
 				close(msgCh)
 				return
 			}
-			msgCh <- m
+			if c.resolve(m) || c.intercept(m) {
+				continue
+			}
+			select {
+			case msgCh <- m:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
 
+// registers fn to see every message read before it is sent to the read channel,
+// fn returns true when it consumed the message
+func (c *Connection) Intercept(fn func(m []byte) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interceptors = append(c.interceptors, fn)
+}
+
+func (c *Connection) intercept(m []byte) bool {
+	c.mu.Lock()
+	interceptors := c.interceptors
+	c.mu.Unlock()
+	for _, fn := range interceptors {
+		if fn(m) {
+			return true
+		}
+	}
+	return false
+}
+
 // creates new Connection
 func NewConnection(d Dialer, secure bool, name, host, path, token string, query string) (*Connection, error) {
 	if name == "" || host == "" || path == "" {
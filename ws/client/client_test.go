@@ -1,8 +1,9 @@
-package client
+package client_test
 
 import (
 	"context"
 	"errors"
+	"github.com/mousybusiness/go-web/ws/client"
 	"github.com/mousybusiness/go-web/ws/wstest"
 	"io/ioutil"
 	"log"
@@ -30,7 +31,7 @@ func TestNewConnection(t *testing.T) {
 	md := wstest.MockDialer{}
 
 	for _, v := range tt {
-		_, err := NewConnection(md, false, v.name, v.host, v.path, v.token, "stub")
+		_, err := client.NewConnection(md, false, v.name, v.host, v.path, v.token, "stub")
 		if !v.isErr {
 			checkErr(t, err)
 		} else {
@@ -40,12 +41,12 @@ func TestNewConnection(t *testing.T) {
 
 	// happy path
 	md = wstest.MockDialer{}
-	_, err := NewConnection(md, false, "stub", "stub", "stub", "stub", "stub")
+	_, err := client.NewConnection(md, false, "stub", "stub", "stub", "stub", "stub")
 	checkErr(t, err)
 
 	// dial failed
 	md = wstest.MockDialer{Err: errors.New("stub")}
-	_, err = NewConnection(md, false, "stub", "stub", "stub", "stub", "stub")
+	_, err = client.NewConnection(md, false, "stub", "stub", "stub", "stub", "stub")
 	checkErrNil(t, err)
 }
 
@@ -71,7 +72,7 @@ func TestWrite(t *testing.T) {
 		Data:    nil,
 		Err:     nil,
 	}
-	conn := Connection{
+	conn := client.Connection{
 		Name: "stub",
 		Conn: w,
 	}
@@ -94,7 +95,7 @@ func TestRead(t *testing.T) {
 		Data:    []byte{1, 2, 3},
 		Err:     nil,
 	}
-	conn := Connection{
+	conn := client.Connection{
 		Name: "stub",
 		Conn: w,
 	}
@@ -118,7 +119,7 @@ func TestRead(t *testing.T) {
 		Data:    []byte{1, 2, 3},
 		Err:     errors.New("stub"),
 	}
-	conn = Connection{
+	conn = client.Connection{
 		Name: "stub",
 		Conn: w,
 	}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+)
+
+// Compression configures permessage-deflate on a Connection dialed with
+// websocket.Dialer.EnableCompression set. Gorilla only supports compression without
+// context takeover, so every message is compressed on its own
+type Compression struct {
+	// flate level, 0 keeps gorilla's default
+	Level int
+	// messages shorter than Threshold bytes are sent uncompressed
+	Threshold int
+}
+
+// implemented by *websocket.Conn
+type compressor interface {
+	EnableWriteCompression(enable bool)
+	SetCompressionLevel(level int) error
+}
+
+// compresses messages written to the connection according to cfg, compression is only
+// used if the server accepted it during the handshake
+func (c *Connection) Compress(cfg Compression) error {
+	cw, ok := c.Conn.(compressor)
+	if !ok {
+		return errors.New("connection doesn't support compression")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if cfg.Level != 0 {
+		if err := cw.SetCompressionLevel(cfg.Level); err != nil {
+			return err
+		}
+	}
+	c.compression = &cfg
+	return nil
+}
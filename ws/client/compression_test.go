@@ -0,0 +1,44 @@
+package client
+
+import (
+	"testing"
+)
+
+// records whether each write was compressed
+type compressingConn struct {
+	recordingConn
+	enabled    bool
+	level      int
+	compressed []bool
+}
+
+func (c *compressingConn) EnableWriteCompression(enable bool) { c.enabled = enable }
+func (c *compressingConn) SetCompressionLevel(level int) error {
+	c.level = level
+	return nil
+}
+
+func (c *compressingConn) WriteMessage(messageType int, data []byte) error {
+	c.compressed = append(c.compressed, c.enabled)
+	return c.recordingConn.WriteMessage(messageType, data)
+}
+
+func TestCompress(t *testing.T) {
+	cc := &compressingConn{}
+	conn := &Connection{Name: "stub", Conn: cc}
+	checkErr(t, conn.Compress(Compression{Level: 9, Threshold: 10}))
+	if cc.level != 9 {
+		t.Fatalf("expected level 9, got %d", cc.level)
+	}
+
+	checkErr(t, conn.Write([]byte("short")))
+	checkErr(t, conn.Write([]byte("long enough to compress")))
+	if len(cc.compressed) != 2 || cc.compressed[0] || !cc.compressed[1] {
+		t.Fatalf("expected only the long message to be compressed, got %v", cc.compressed)
+	}
+
+	plain := &Connection{Name: "stub", Conn: &recordingConn{}}
+	if err := plain.Compress(Compression{}); err == nil {
+		t.Fatal("expected connections without compression support to be refused")
+	}
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"time"
+)
+
+// TokenSource returns a fresh token for the connection's user
+type TokenSource func(ctx context.Context) (string, error)
+
+// sends token to the server to extend the connection, returning when the new
+// credentials expire. Read or a Router must be serving the connection
+func (c *Connection) Reauthenticate(ctx context.Context, token string) (time.Time, error) {
+	var r envelope.Reauth
+	if err := c.Call(ctx, envelope.TypeReauth, envelope.Reauth{Token: token}, &r); err != nil {
+		return time.Time{}, err
+	}
+	return r.ExpiresAt, nil
+}
+
+// re-authenticates with a token from ts whenever the server says the connection's
+// credentials are about to expire, until ctx is done
+func (c *Connection) RefreshWith(ctx context.Context, ts TokenSource) {
+	c.Intercept(func(m []byte) bool {
+		e, err := envelope.Parse(m)
+		if err != nil || e.Type != envelope.TypeReauth || e.ID != "" {
+			return false
+		}
+		if ctx.Err() != nil {
+			return true
+		}
+		// the result is read by the loop that called us, so don't wait for it here
+		go c.refresh(ctx, ts)
+		return true
+	})
+}
+
+func (c *Connection) refresh(ctx context.Context, ts TokenSource) {
+	token, err := ts(ctx)
+	if err != nil {
+		log.Println("failed to get a fresh token for", c.Name, err)
+		return
+	}
+	if _, err := c.Reauthenticate(ctx, token); err != nil {
+		log.Println("failed to re-authenticate", c.Name, err)
+	}
+}
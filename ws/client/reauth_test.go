@@ -0,0 +1,55 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestRefreshWith(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	tokens := make(chan string, 1)
+	srv := newEchoServer(func(e envelope.Envelope) *envelope.Envelope {
+		if e.Type != envelope.TypeReauth {
+			return nil
+		}
+		var p envelope.Reauth
+		_ = json.Unmarshal(e.Payload, &p)
+		tokens <- p.Token
+		r, _ := envelope.NewResult(e.ID, envelope.Reauth{ExpiresAt: expires})
+		return &r
+	})
+	conn := &Connection{Name: "stub", Conn: srv}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn.RefreshWith(ctx, func(ctx context.Context) (string, error) {
+		return "fresh", nil
+	})
+	go NewRouter().Serve(ctx, conn)
+
+	// the server says the credentials are about to expire
+	b, _ := envelope.Marshal(envelope.TypeReauth, envelope.Reauth{ExpiresAt: time.Now().Add(time.Second)})
+	srv.reads <- b
+
+	select {
+	case token := <-tokens:
+		if token != "fresh" {
+			t.Fatalf("expected fresh token, got %s", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to re-authenticate")
+	}
+
+	got, err := conn.Reauthenticate(ctx, "again")
+	checkErr(t, err)
+	if !got.Equal(expires) {
+		t.Fatalf("expected %v, got %v", expires, got)
+	}
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"reflect"
+	"sync"
+)
+
+var connectionType = reflect.TypeOf((*Connection)(nil))
+
+// Router dispatches envelopes read from a Connection to handlers registered per message type
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]envelope.Handler
+}
+
+// creates an empty Router
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]envelope.Handler)}
+}
+
+// registers fn for msgType, fn must be of the form func(context.Context, *Connection, T) error
+// where the envelope payload is unmarshalled into T, panics if fn is not a valid handler
+func (r *Router) Handle(msgType string, fn interface{}) {
+	h, err := envelope.NewHandler(fn, connectionType)
+	if err != nil {
+		panic(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = h
+}
+
+// parses b and calls the handler registered for its type, envelope and payload errors
+// are reported back to the server as error envelopes. Deliveries carrying a sequence
+// number are acked once handled without error, duplicates are acked and skipped.
+// Results of calls no longer waiting are dropped. Session envelopes and broadcast
+// offsets are recorded for Connection.Session
+func (r *Router) Dispatch(ctx context.Context, c *Connection, b []byte) error {
+	e, err := envelope.Parse(b)
+	if err != nil {
+		return reply(c, envelope.NewError(envelope.CodeBadEnvelope, err.Error()), err)
+	}
+
+	if e.Type == envelope.TypeSession {
+		var s envelope.Session
+		if err := json.Unmarshal(e.Payload, &s); err != nil {
+			return err
+		}
+		c.setSession(s)
+	}
+
+	if e.ID != "" && (e.Type == envelope.TypeResult || e.Type == envelope.TypeError) {
+		// answers a call no longer waiting, it timed out or was cancelled
+		return nil
+	}
+
+	r.mu.RLock()
+	h, ok := r.handlers[e.Type]
+	r.mu.RUnlock()
+	if !ok {
+		if e.Type == envelope.TypeSession || e.Type == envelope.TypeReauth {
+			// reauth is answered by Connection.RefreshWith when it is set up
+			return nil
+		}
+		if e.Type == envelope.TypeError {
+			// never answer an error with another error
+			return e.Err()
+		}
+		msg := "no handler for " + e.Type
+		if e.Seq != 0 {
+			// redelivering it won't find a handler either
+			if err := c.Ack(e.Seq); err != nil {
+				log.Println("failed to ack", e.Type, e.Seq, err)
+			}
+		}
+		return reply(c, envelope.NewError(envelope.CodeUnknownType, msg), errors.New(msg))
+	}
+
+	if e.Seq != 0 && c.acked(e.Seq) {
+		// redelivered after the ack was lost, ack again without handling it twice
+		return c.Ack(e.Seq)
+	}
+
+	payload, err := h.Decode(e.Payload)
+	if err != nil {
+		return reply(c, envelope.NewError(envelope.CodeBadPayload, err.Error()), err)
+	}
+
+	if _, err = h.Call(ctx, c, payload); err != nil {
+		return err
+	}
+	if e.Offset != 0 {
+		c.handled(e.Offset)
+	}
+	if e.Seq != 0 {
+		return c.Ack(e.Seq)
+	}
+	return nil
+}
+
+// reads from c and dispatches every message until ctx is done or the connection closes
+func (r *Router) Serve(ctx context.Context, c *Connection) error {
+	msgCh := make(chan []byte)
+	c.Read(ctx, msgCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, open := <-msgCh:
+			if !open {
+				return nil
+			}
+			if err := r.Dispatch(ctx, c, m); err != nil {
+				log.Println("failed to handle message on", c.Name, err)
+			}
+		}
+	}
+}
+
+// sends an error envelope to c, returning cause
+func reply(c *Connection, e envelope.Envelope, cause error) error {
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = c.Write(b)
+	}
+	if err != nil {
+		log.Println("failed to send error envelope,", err)
+	}
+	return cause
+}
@@ -0,0 +1,261 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+type chatMsg struct {
+	Text string `json:"text"`
+}
+
+// records every message written and replays reads
+type recordingConn struct {
+	mu      sync.Mutex
+	written [][]byte
+	reads   chan []byte
+}
+
+func (r *recordingConn) WriteMessage(messageType int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written = append(r.written, data)
+	return nil
+}
+
+func (r *recordingConn) ReadMessage() (int, []byte, error) {
+	b, open := <-r.reads
+	if !open {
+		return 0, nil, io.EOF
+	}
+	return 1, b, nil
+}
+
+func (r *recordingConn) last(t *testing.T) envelope.Envelope {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.written) == 0 {
+		t.Fatalf("expected a message to be written")
+	}
+	e, err := envelope.Parse(r.written[len(r.written)-1])
+	checkErr(t, err)
+	return e
+}
+
+func TestRouterDispatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rc := &recordingConn{}
+	conn := &Connection{Name: "stub", Conn: rc}
+
+	var got chatMsg
+	r := NewRouter()
+	r.Handle("chat.recv", func(ctx context.Context, c *Connection, m chatMsg) error {
+		got = m
+		return nil
+	})
+
+	// happy path
+	err := r.Dispatch(context.Background(), conn, []byte(`{"type":"chat.recv","payload":{"text":"hi"}}`))
+	checkErr(t, err)
+	if got.Text != "hi" {
+		t.Fatalf("handler payload; want: %v, got: %v", "hi", got.Text)
+	}
+
+	tt := []struct {
+		name string
+		msg  string
+		code string
+	}{
+		{"not json", `stub`, envelope.CodeBadEnvelope},
+		{"unknown type", `{"type":"chat.delete"}`, envelope.CodeUnknownType},
+		{"bad payload", `{"type":"chat.recv","payload":[]}`, envelope.CodeBadPayload},
+	}
+
+	for _, v := range tt {
+		err := r.Dispatch(context.Background(), conn, []byte(v.msg))
+		checkErrNil(t, err)
+		e := rc.last(t)
+		if e.Type != envelope.TypeError || e.Error == nil || e.Error.Code != v.code {
+			t.Fatalf("%s: expected %s error envelope, got: %+v", v.name, v.code, e)
+		}
+	}
+
+	// results of calls no longer waiting are dropped
+	n := len(rc.written)
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"result","id":"1","payload":{}}`)))
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"error","id":"2","error":{"code":"stub","message":"stub"}}`)))
+	if len(rc.written) != n {
+		t.Fatalf("shouldnt answer late results")
+	}
+
+	// error envelopes from the server are returned, not answered
+	err = r.Dispatch(context.Background(), conn, []byte(`{"type":"error","error":{"code":"stub","message":"stub"}}`))
+	checkErrNil(t, err)
+	if len(rc.written) != n {
+		t.Fatalf("shouldnt reply to error envelopes")
+	}
+}
+
+func TestRouterAck(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rc := &recordingConn{}
+	conn := &Connection{Name: "stub", Conn: rc}
+
+	handled := 0
+	r := NewRouter()
+	r.Handle("note", func(ctx context.Context, c *Connection, m chatMsg) error {
+		if m.Text == "fail" {
+			return errors.New("stub")
+		}
+		handled++
+		return nil
+	})
+
+	// deliveries are acked once handled
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","seq":3,"payload":{}}`)))
+	e := rc.last(t)
+	if e.Type != envelope.TypeAck || string(e.Payload) != `{"seq":3}` {
+		t.Fatalf("invalid ack: %+v", e)
+	}
+
+	// redelivery is acked again but not handled twice
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","seq":3,"payload":{}}`)))
+	if handled != 1 || len(rc.written) != 2 {
+		t.Fatalf("duplicate; want handled: %v acks: %v, got: %v %v", 1, 2, handled, len(rc.written))
+	}
+
+	// messages without a sequence number are not acked
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","payload":{}}`)))
+	if handled != 2 || len(rc.written) != 2 {
+		t.Fatalf("shouldnt ack messages without a sequence number")
+	}
+
+	// a failed delivery isn't acked, acking a later one doesn't make it a duplicate
+	checkErrNil(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","seq":4,"payload":{"text":"fail"}}`)))
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","seq":5,"payload":{}}`)))
+	if handled != 3 || len(rc.written) != 3 || string(rc.last(t).Payload) != `{"seq":5}` {
+		t.Fatalf("failed delivery; want handled: %v acks: %v, got: %v %v", 3, 3, handled, len(rc.written))
+	}
+	checkErr(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"note","seq":4,"payload":{}}`)))
+	if handled != 4 || string(rc.last(t).Payload) != `{"seq":4}` {
+		t.Fatalf("redelivered message should be handled once it succeeds")
+	}
+
+	// deliveries without a handler are acked as well as refused, redelivery can't help
+	n := len(rc.written)
+	checkErrNil(t, r.Dispatch(context.Background(), conn, []byte(`{"type":"unknown","seq":6,"payload":{}}`)))
+	ack, err := envelope.Parse(rc.written[n])
+	checkErr(t, err)
+	if ack.Type != envelope.TypeAck || string(ack.Payload) != `{"seq":6}` || rc.last(t).Type != envelope.TypeError {
+		t.Fatalf("expected delivery without a handler to be acked, got: %+v", ack)
+	}
+}
+
+func TestRouterSession(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rc := &recordingConn{}
+	conn := &Connection{Name: "stub", Conn: rc}
+	r := NewRouter()
+	r.Handle("headline", func(ctx context.Context, c *Connection, m chatMsg) error { return nil })
+
+	dispatch := func(msg string) {
+		t.Helper()
+		checkErr(t, r.Dispatch(context.Background(), conn, []byte(msg)))
+	}
+
+	dispatch(`{"type":"session","payload":{"id":"a","offset":0}}`)
+	dispatch(`{"type":"headline","topic":"news","offset":1,"payload":{}}`)
+	dispatch(`{"type":"headline","topic":"news","offset":2,"payload":{}}`)
+	if id, offset := conn.Session(); id != "a" || offset != 2 {
+		t.Fatalf("session; want: %v %v, got: %v %v", "a", 2, id, offset)
+	}
+
+	// reconnect, the server starts a new session which is swapped for the old one
+	rc2 := &recordingConn{}
+	conn2 := &Connection{Name: "stub", Conn: rc2}
+	id, offset := conn.Session()
+	conn = conn2
+
+	dispatch(`{"type":"session","payload":{"id":"b","offset":0}}`)
+	checkErr(t, conn2.Resume(id, offset))
+	e := rc2.last(t)
+	if e.Type != envelope.TypeResume || string(e.Payload) != `{"session":"a","offset":2}` {
+		t.Fatalf("invalid resume: %+v", e)
+	}
+
+	// nothing missed, the offset carries over
+	dispatch(`{"type":"session","payload":{"id":"a","offset":2}}`)
+	if id, offset := conn2.Session(); id != "a" || offset != 2 {
+		t.Fatalf("resumed session; want: %v %v, got: %v %v", "a", 2, id, offset)
+	}
+
+	checkErrNil(t, conn2.Resume("", 0))
+}
+
+func TestRouterServe(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rc := &recordingConn{reads: make(chan []byte)}
+	conn := &Connection{Name: "stub", Conn: rc}
+
+	got := make(chan string, 1)
+	r := NewRouter()
+	r.Handle("chat.recv", func(ctx context.Context, c *Connection, m *chatMsg) error {
+		got <- m.Text
+		return nil
+	})
+
+	done := make(chan error)
+	go func() { done <- r.Serve(context.Background(), conn) }()
+
+	rc.reads <- []byte(`{"type":"chat.recv","payload":{"text":"hi"}}`)
+	select {
+	case s := <-got:
+		if s != "hi" {
+			t.Fatalf("handler payload; want: %v, got: %v", "hi", s)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("handler should be called before timeout")
+	}
+
+	// connection closed
+	close(rc.reads)
+	select {
+	case err := <-done:
+		checkErr(t, err)
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("serve should return once the connection closes")
+	}
+
+	// send wraps payload
+	checkErr(t, conn.Send("chat.send", chatMsg{Text: "yo"}))
+	e := rc.last(t)
+	if e.Type != "chat.send" || string(e.Payload) != `{"text":"yo"}` {
+		t.Fatalf("invalid envelope sent: %+v", e)
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
+
+func checkErrNil(t *testing.T, err error) {
+	if err == nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,154 @@
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+	errs "github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// TypeError is the message type of envelopes reporting a failure back to the sender
+	TypeError = "error"
+	// TypeResult is the message type of envelopes answering a call
+	TypeResult = "result"
+	// TypeAck is the message type of envelopes acknowledging the delivery with a sequence number
+	TypeAck = "ack"
+	// TypeSession is the message type of envelopes telling the client its session
+	TypeSession = "session"
+	// TypeResume is the message type of envelopes asking to resume a previous session
+	TypeResume = "resume"
+	// TypeReauth is the message type of envelopes asking for, and calls carrying, a fresh token
+	TypeReauth = "reauth"
+)
+
+// standard error codes sent in error envelopes
+const (
+	CodeBadEnvelope = "bad_envelope"
+	CodeUnknownType = "unknown_type"
+	CodeBadPayload  = "bad_payload"
+	CodeCallFailed  = "call_failed"
+	CodeNoSession   = "no_session"
+	CodeRateLimited = "rate_limited"
+)
+
+// Envelope is the shared wire format for typed websocket messages
+type Envelope struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`  // correlates calls with their result
+	Seq     uint64          `json:"seq,omitempty"` // set on deliveries that must be acked
+	Topic   string          `json:"topic,omitempty"`
+	Offset  uint64          `json:"offset,omitempty"` // position in the session, set on broadcasts
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Ack is the payload of an ack envelope
+type Ack struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Session is the payload of a session envelope, Gap is set when a resumed session
+// lost messages that could no longer be replayed
+type Session struct {
+	ID     string `json:"id"`
+	Offset uint64 `json:"offset"`
+	Gap    bool   `json:"gap,omitempty"`
+}
+
+// Resume is the payload of a resume envelope, Offset is the last offset the client saw
+type Resume struct {
+	Session string `json:"session"`
+	Offset  uint64 `json:"offset"`
+}
+
+// Reauth is the payload of reauth envelopes. The server sends ExpiresAt when the
+// connection's credentials are about to expire, the client calls reauth with a fresh
+// Token and is answered with the new ExpiresAt
+type Reauth struct {
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Error describes why a message could not be handled
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// the error carried by the envelope, nil when there is none
+func (e Envelope) Err() error {
+	if e.Error == nil {
+		return nil
+	}
+	return e.Error
+}
+
+// creates an envelope of msgType with payload marshalled as json
+func New(msgType string, payload interface{}) (Envelope, error) {
+	if msgType == "" {
+		return Envelope{}, errs.New("message type is empty")
+	}
+
+	e := Envelope{Type: msgType}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return Envelope{}, errs.Wrapf(err, "failed to marshal %s payload", msgType)
+		}
+		e.Payload = b
+	}
+	return e, nil
+}
+
+// creates an error envelope
+func NewError(code, message string) Envelope {
+	return Envelope{
+		Type:  TypeError,
+		Error: &Error{Code: code, Message: message},
+	}
+}
+
+// creates the result envelope answering call id
+func NewResult(id string, result interface{}) (Envelope, error) {
+	e, err := New(TypeResult, result)
+	if err != nil {
+		return Envelope{}, err
+	}
+	e.ID = id
+	return e, nil
+}
+
+// creates the error envelope answering call id, err is sent as is when it is an *Error
+func NewCallError(id string, err error) Envelope {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: CodeCallFailed, Message: err.Error()}
+	}
+	return Envelope{Type: TypeError, ID: id, Error: e}
+}
+
+// marshals an envelope of msgType with payload
+func Marshal(msgType string, payload interface{}) ([]byte, error) {
+	e, err := New(msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// parses b as an envelope, b must carry a message type
+func Parse(b []byte) (Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Envelope{}, errs.Wrap(err, "invalid envelope")
+	}
+	if e.Type == "" {
+		return Envelope{}, errs.New("envelope has no type")
+	}
+	return e, nil
+}
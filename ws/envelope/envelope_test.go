@@ -0,0 +1,156 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type chat struct {
+	Text string `json:"text"`
+}
+
+type conn struct{}
+
+var connType = reflect.TypeOf((*conn)(nil))
+
+func TestMarshalParse(t *testing.T) {
+	b, err := Marshal("chat.send", chat{Text: "hi"})
+	checkErr(t, err)
+
+	e, err := Parse(b)
+	checkErr(t, err)
+	if e.Type != "chat.send" {
+		t.Fatalf("envelope type; want: %v, got: %v", "chat.send", e.Type)
+	}
+	if string(e.Payload) != `{"text":"hi"}` {
+		t.Fatalf("envelope payload; want: %v, got: %v", `{"text":"hi"}`, string(e.Payload))
+	}
+
+	// no type
+	_, err = Marshal("", nil)
+	checkErrNil(t, err)
+	_, err = Parse([]byte(`{"payload":{}}`))
+	checkErrNil(t, err)
+
+	// not json
+	_, err = Parse([]byte("stub"))
+	checkErrNil(t, err)
+
+	// error envelope
+	b, err = json.Marshal(NewError(CodeBadPayload, "stub"))
+	checkErr(t, err)
+	e, err = Parse(b)
+	checkErr(t, err)
+	if e.Type != TypeError || e.Err() == nil || e.Error.Code != CodeBadPayload {
+		t.Fatalf("invalid error envelope: %s", b)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	tt := []struct {
+		name  string
+		fn    interface{}
+		isErr bool
+	}{
+		{"value payload", func(context.Context, *conn, chat) error { return nil }, false},
+		{"pointer payload", func(context.Context, *conn, *chat) error { return nil }, false},
+		{"not a func", "stub", true},
+		{"no context", func(*conn, chat) error { return nil }, true},
+		{"wrong conn", func(context.Context, conn, chat) error { return nil }, true},
+		{"no error", func(context.Context, *conn, chat) {}, true},
+	}
+
+	for _, v := range tt {
+		_, err := NewHandler(v.fn, connType)
+		if v.isErr && err == nil {
+			t.Fatalf("%s: expected error", v.name)
+		}
+		if !v.isErr && err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+	}
+}
+
+func TestHandlerCall(t *testing.T) {
+	var got chat
+	h, err := NewHandler(func(ctx context.Context, c *conn, p *chat) error {
+		got = *p
+		if p.Text == "fail" {
+			return errors.New("stub")
+		}
+		return nil
+	}, connType)
+	checkErr(t, err)
+
+	v, err := h.Decode(json.RawMessage(`{"text":"hi"}`))
+	checkErr(t, err)
+	_, err = h.Call(context.Background(), &conn{}, v)
+	checkErr(t, err)
+	if got.Text != "hi" {
+		t.Fatalf("handler payload; want: %v, got: %v", "hi", got.Text)
+	}
+
+	// handler error is returned
+	v, err = h.Decode(json.RawMessage(`{"text":"fail"}`))
+	checkErr(t, err)
+	_, err = h.Call(context.Background(), &conn{}, v)
+	checkErrNil(t, err)
+
+	// payload of wrong shape
+	_, err = h.Decode(json.RawMessage(`{"text":1}`))
+	checkErrNil(t, err)
+}
+
+func TestCallHandler(t *testing.T) {
+	_, err := NewCallHandler(func(context.Context, *conn, chat) error { return nil }, connType)
+	checkErrNil(t, err)
+
+	h, err := NewCallHandler(func(ctx context.Context, c *conn, p chat) (chat, error) {
+		if p.Text == "fail" {
+			return chat{}, &Error{Code: "stub", Message: "stub"}
+		}
+		return chat{Text: p.Text + "!"}, nil
+	}, connType)
+	checkErr(t, err)
+	if !h.Returns() {
+		t.Fatalf("call handler should return a result")
+	}
+
+	v, err := h.Decode(json.RawMessage(`{"text":"hi"}`))
+	checkErr(t, err)
+	res, err := h.Call(context.Background(), &conn{}, v)
+	checkErr(t, err)
+	if res.(chat).Text != "hi!" {
+		t.Fatalf("call result; want: %v, got: %v", "hi!", res)
+	}
+
+	v, err = h.Decode(json.RawMessage(`{"text":"fail"}`))
+	checkErr(t, err)
+	_, err = h.Call(context.Background(), &conn{}, v)
+	e := NewCallError("1", err)
+	if e.ID != "1" || e.Error.Code != "stub" {
+		t.Fatalf("call error should keep its code, got: %+v", e.Error)
+	}
+
+	e = NewCallError("2", errors.New("stub"))
+	if e.Error.Code != CodeCallFailed {
+		t.Fatalf("call error code; want: %v, got: %v", CodeCallFailed, e.Error.Code)
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
+
+func checkErrNil(t *testing.T, err error) {
+	if err == nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package envelope
+
+import (
+	"context"
+	"encoding/json"
+	errs "github.com/pkg/errors"
+	"reflect"
+)
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Handler is a typed message handler of the form func(context.Context, C, T) error,
+// or func(context.Context, C, T) (R, error) when it answers calls, where C is the
+// connection type of the router, T is the payload type and R the result type
+type Handler struct {
+	fn      reflect.Value
+	payload reflect.Type
+	result  bool
+}
+
+// checks fn has the handler signature for connections of type conn
+func NewHandler(fn interface{}, conn reflect.Type) (Handler, error) {
+	return newHandler(fn, conn, false)
+}
+
+// checks fn has the call handler signature for connections of type conn
+func NewCallHandler(fn interface{}, conn reflect.Type) (Handler, error) {
+	return newHandler(fn, conn, true)
+}
+
+func newHandler(fn interface{}, conn reflect.Type, result bool) (Handler, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return Handler{}, errs.Errorf("handler must be a func, got %s", t)
+	}
+	if t.NumIn() != 3 || t.In(0) != contextType || t.In(1) != conn {
+		return Handler{}, errs.Errorf("handler must accept (context.Context, %s, T), got %s", conn, t)
+	}
+	if result {
+		if t.NumOut() != 2 || t.Out(1) != errorType {
+			return Handler{}, errs.Errorf("call handler must return (R, error), got %s", t)
+		}
+	} else if t.NumOut() != 1 || t.Out(0) != errorType {
+		return Handler{}, errs.Errorf("handler must return error, got %s", t)
+	}
+
+	return Handler{fn: v, payload: t.In(2), result: result}, nil
+}
+
+// true when the handler answers calls with a result
+func (h Handler) Returns() bool {
+	return h.result
+}
+
+// unmarshals payload into a new value of the handler's payload type
+func (h Handler) Decode(payload json.RawMessage) (reflect.Value, error) {
+	t := h.payload
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	v := reflect.New(t)
+	if len(payload) != 0 {
+		if err := json.Unmarshal(payload, v.Interface()); err != nil {
+			return reflect.Value{}, err
+		}
+	}
+	if h.payload.Kind() == reflect.Ptr {
+		return v, nil
+	}
+	return v.Elem(), nil
+}
+
+// calls the handler with a payload returned by Decode, result is always nil
+// unless the handler answers calls
+func (h Handler) Call(ctx context.Context, conn interface{}, payload reflect.Value) (interface{}, error) {
+	out := h.fn.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(conn), payload})
+	err, _ := out[len(out)-1].Interface().(error)
+	if !h.result || err != nil {
+		return nil, err
+	}
+	return out[0].Interface(), nil
+}
@@ -0,0 +1,49 @@
+// Package ginws mounts a server.Handler on a gin router
+package ginws
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/mousybusiness/go-web/ws/server"
+	"net/http"
+)
+
+type ctxKey struct{}
+
+// gin handler serving h, the gin context is reachable from the request through Context
+func Handler(h *server.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := c.Request.WithContext(context.WithValue(c.Request.Context(), ctxKey{}, c))
+		h.ServeHTTP(c.Writer, r)
+		c.Abort()
+	}
+}
+
+// gin context of a request served through Handler
+func Context(r *http.Request) (*gin.Context, bool) {
+	c, ok := r.Context().Value(ctxKey{}).(*gin.Context)
+	return c, ok
+}
+
+// Authenticator identifying users from the gin context, e.g. values set by auth middleware
+func Authenticator(fn func(c *gin.Context) (string, error)) server.Authenticator {
+	return func(r *http.Request) (string, error) {
+		c, ok := Context(r)
+		if !ok {
+			return "", errors.New("request wasn't served through ginws")
+		}
+		return fn(c)
+	}
+}
+
+// Authenticator reading the uid stored under key in the gin context
+func FromKey(key string, uid func(v interface{}) (string, error)) server.Authenticator {
+	return Authenticator(func(c *gin.Context) (string, error) {
+		v, ok := c.Get(key)
+		if !ok {
+			return "", errors.New("no " + key + " in context")
+		}
+		return uid(v)
+	})
+}
@@ -0,0 +1,98 @@
+package ginws
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/server"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// claims set by auth middleware
+type claims struct {
+	UID  string
+	Role string
+}
+
+func TestHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	gin.SetMode(gin.TestMode)
+
+	h := server.NewHandler(FromKey("claims", func(v interface{}) (string, error) {
+		c, ok := v.(claims)
+		if !ok {
+			return "", errors.New("invalid claims")
+		}
+		return c.UID, nil
+	}), server.NewRouter())
+	type connected struct {
+		uid  string
+		role string
+	}
+	connCh := make(chan connected, 1)
+	h.OnConnect = func(ctx context.Context, c *server.ConnectedClient, r *http.Request) error {
+		gc, ok := Context(r)
+		if !ok {
+			return errors.New("no gin context")
+		}
+		v, _ := gc.Get("claims")
+		connCh <- connected{uid: c.UID(), role: v.(claims).Role}
+		return nil
+	}
+
+	r := gin.New()
+	authed := r.Group("")
+	authed.Use(func(c *gin.Context) {
+		if uid := c.GetHeader("X-User"); uid != "" {
+			c.Set("claims", claims{UID: uid, Role: "admin"})
+		}
+	})
+	authed.GET("/connect", Handler(h))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect"
+
+	// no claims in the gin context
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v %v", resp, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User": {"gin-uid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-connCh:
+		if got.uid != "gin-uid" || got.role != "admin" {
+			t.Fatalf("expected gin-uid admin, got %+v", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connect hook to be called")
+	}
+	c, ok := server.Lookup("gin-uid")
+	if !ok {
+		t.Fatal("expected connection to be registered")
+	}
+
+	conn.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be cleaned up")
+	}
+}
+
+func TestAuthenticatorWithoutGin(t *testing.T) {
+	auth := FromKey("claims", func(v interface{}) (string, error) { return "stub", nil })
+	if _, err := auth(httptest.NewRequest(http.MethodGet, "/", nil)); err == nil {
+		t.Fatal("expected an error for requests not served through ginws")
+	}
+}
@@ -0,0 +1,216 @@
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	errs "github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+var (
+	ErrMalformed    = errors.New("malformed token")
+	ErrSignature    = errors.New("invalid token signature")
+	ErrExpired      = errors.New("token is expired")
+	ErrNotYetValid  = errors.New("token is not valid yet")
+	ErrUnsupported  = errors.New("unsupported signing algorithm")
+	ErrKeyMismatch  = errors.New("key doesn't match signing algorithm")
+	ErrInvalidClaim = errors.New("invalid claim")
+)
+
+// Header of a JWT
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims registered by RFC 7519, other claims are kept in Raw
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	NotBefore time.Time
+	IssuedAt  time.Time
+	Raw       map[string]interface{}
+}
+
+type registered struct {
+	Sub string      `json:"sub"`
+	Iss string      `json:"iss"`
+	Aud interface{} `json:"aud"`
+	Exp *float64    `json:"exp"`
+	Nbf *float64    `json:"nbf"`
+	Iat *float64    `json:"iat"`
+}
+
+// splits and decodes a compact JWT without verifying it
+func parse(token string) (Header, []byte, []byte, string, error) {
+	var h Header
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, nil, nil, "", ErrMalformed
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return h, nil, nil, "", errs.Wrap(ErrMalformed, "header")
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return h, nil, nil, "", errs.Wrap(ErrMalformed, "header")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return h, nil, nil, "", errs.Wrap(ErrMalformed, "payload")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return h, nil, nil, "", errs.Wrap(ErrMalformed, "signature")
+	}
+	return h, payload, sig, parts[0] + "." + parts[1], nil
+}
+
+// verifies sig over signed with key, the key type must match alg
+func verify(alg string, key interface{}, signed string, sig []byte) error {
+	sum := sha256.Sum256([]byte(signed))
+	switch alg {
+	case HS256:
+		k, ok := key.([]byte)
+		if !ok {
+			return ErrKeyMismatch
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return ErrSignature
+		}
+	case RS256:
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrKeyMismatch
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig) != nil {
+			return ErrSignature
+		}
+	case ES256:
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || k.Curve.Params().BitSize != 256 {
+			return ErrKeyMismatch
+		}
+		if len(sig) != 64 {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return ErrSignature
+		}
+	default:
+		return ErrUnsupported
+	}
+	return nil
+}
+
+// decodes the claims of a verified payload
+func claims(payload []byte) (*Claims, error) {
+	var reg registered
+	if err := json.Unmarshal(payload, &reg); err != nil {
+		return nil, errs.Wrap(ErrMalformed, "claims")
+	}
+	c := &Claims{Subject: reg.Sub, Issuer: reg.Iss}
+	if err := json.Unmarshal(payload, &c.Raw); err != nil {
+		return nil, errs.Wrap(ErrMalformed, "claims")
+	}
+	switch aud := reg.Aud.(type) {
+	case nil:
+	case string:
+		c.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			s, ok := a.(string)
+			if !ok {
+				return nil, errs.Wrap(ErrInvalidClaim, "aud")
+			}
+			c.Audience = append(c.Audience, s)
+		}
+	default:
+		return nil, errs.Wrap(ErrInvalidClaim, "aud")
+	}
+	c.ExpiresAt = unix(reg.Exp)
+	c.NotBefore = unix(reg.Nbf)
+	c.IssuedAt = unix(reg.Iat)
+	return c, nil
+}
+
+func unix(v *float64) time.Time {
+	if v == nil {
+		return time.Time{}
+	}
+	sec := int64(*v)
+	return time.Unix(sec, int64((*v-float64(sec))*1e9))
+}
+
+// Sign creates a compact JWT of claims signed with key, a []byte for HS256,
+// *rsa.PrivateKey for RS256 or *ecdsa.PrivateKey for ES256
+func Sign(alg, kid string, key interface{}, claims interface{}) (string, error) {
+	hb, err := json.Marshal(Header{Alg: alg, Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	pb, err := json.Marshal(claims)
+	if err != nil {
+		return "", errs.Wrap(err, "couldn't marshal claims")
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(pb)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg {
+	case HS256:
+		k, ok := key.([]byte)
+		if !ok {
+			return "", ErrKeyMismatch
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case RS256:
+		k, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return "", ErrKeyMismatch
+		}
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		if err != nil {
+			return "", err
+		}
+	case ES256:
+		k, ok := key.(*ecdsa.PrivateKey)
+		if !ok || k.Curve.Params().BitSize != 256 {
+			return "", ErrKeyMismatch
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	default:
+		return "", errs.Wrap(ErrUnsupported, alg)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
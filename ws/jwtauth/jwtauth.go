@@ -0,0 +1,219 @@
+// Package jwtauth authenticates websocket upgrades with bearer JWTs
+package jwtauth
+
+import (
+	"context"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/server"
+	errs "github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol is the Sec-WebSocket-Protocol browsers send the token with, as
+// `bearer, <jwt>`, add it to server.Handler.Protocols so it is negotiated
+const Protocol = "bearer"
+
+var ErrMissingToken = errors.New("no bearer token in request")
+
+// Verifier validates JWTs signed by Keys
+type Verifier struct {
+	Keys Keys
+	// expected iss and aud claims, not checked when empty
+	Issuer   string
+	Audience string
+	// allowed signing algorithms, defaults to HS256, RS256 and ES256
+	Algorithms []string
+	// tolerated clock skew for exp and nbf
+	Leeway time.Duration
+	// accepts tokens without an exp claim, they never expire so connections they
+	// authorize are never asked to reauthenticate
+	AllowNoExpiry bool
+	// query parameter carrying the token, defaults to access_token
+	QueryParam string
+
+	now func() time.Time
+
+	mu       sync.Mutex
+	verified map[*http.Request]*Claims // by Authenticate, for TrackExpiry while r is served
+}
+
+// creates a Verifier for tokens signed by keys
+func New(keys Keys) *Verifier {
+	return &Verifier{Keys: keys, Leeway: time.Minute}
+}
+
+// Authenticate is a server.Authenticator identifying the user by the sub claim
+func (v *Verifier) Authenticate(r *http.Request) (string, error) {
+	c, err := v.VerifyRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if c.Subject == "" {
+		return "", errs.Wrap(ErrInvalidClaim, "sub")
+	}
+	v.remember(r, c)
+	return c.Subject, nil
+}
+
+// Reauthenticate is a server.Verifier for tokens sent over established connections
+func (v *Verifier) Reauthenticate(ctx context.Context, token string) (string, time.Time, error) {
+	c, err := v.Verify(ctx, token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if c.Subject == "" {
+		return "", time.Time{}, errs.Wrap(ErrInvalidClaim, "sub")
+	}
+	return c.Subject, v.expires(c), nil
+}
+
+// TrackExpiry is a server.Handler OnConnect hook enforcing the exp claim of the
+// upgrade request's token on the new connection. The claims Authenticate verified are
+// used, the token is only verified again when another Authenticator let r in
+func (v *Verifier) TrackExpiry(e *server.Expiry) func(ctx context.Context, c *server.ConnectedClient, r *http.Request) error {
+	return func(ctx context.Context, c *server.ConnectedClient, r *http.Request) error {
+		claims := v.recall(r)
+		if claims == nil {
+			var err error
+			if claims, err = v.VerifyRequest(r); err != nil {
+				return err
+			}
+		}
+		e.Track(c, v.expires(claims))
+		return nil
+	}
+}
+
+// when a connection authorized by c expires, tokens are accepted until Leeway past exp
+func (v *Verifier) expires(c *Claims) time.Time {
+	if c.ExpiresAt.IsZero() {
+		return time.Time{}
+	}
+	return c.ExpiresAt.Add(v.Leeway)
+}
+
+// keeps c for TrackExpiry until r is done being served
+func (v *Verifier) remember(r *http.Request, c *Claims) {
+	done := r.Context().Done()
+	if done == nil {
+		// never done, r isn't being served
+		return
+	}
+	v.mu.Lock()
+	if v.verified == nil {
+		v.verified = make(map[*http.Request]*Claims)
+	}
+	v.verified[r] = c
+	v.mu.Unlock()
+	go func() {
+		<-done
+		v.recall(r)
+	}()
+}
+
+// the claims Authenticate verified for r, nil if it didn't
+func (v *Verifier) recall(r *http.Request) *Claims {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c := v.verified[r]
+	delete(v.verified, r)
+	return c
+}
+
+// verifies the token carried by r
+func (v *Verifier) VerifyRequest(r *http.Request) (*Claims, error) {
+	t := v.Token(r)
+	if t == "" {
+		return nil, ErrMissingToken
+	}
+	return v.Verify(r.Context(), t)
+}
+
+// Token extracts the bearer token from the Authorization header, the query
+// parameter or the Sec-WebSocket-Protocol header, in that order
+func (v *Verifier) Token(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	param := v.QueryParam
+	if param == "" {
+		param = "access_token"
+	}
+	if t := r.URL.Query().Get(param); t != "" {
+		return t
+	}
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		ps := strings.Split(h, ",")
+		for i := 0; i < len(ps)-1; i++ {
+			if strings.TrimSpace(ps[i]) == Protocol {
+				return strings.TrimSpace(ps[i+1])
+			}
+		}
+	}
+	return ""
+}
+
+// Verify checks the signature and claims of token
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	h, payload, sig, signed, err := parse(token)
+	if err != nil {
+		return nil, err
+	}
+	if !v.allowed(h.Alg) {
+		return nil, errs.Wrap(ErrUnsupported, h.Alg)
+	}
+	if v.Keys == nil {
+		return nil, ErrUnknownKey
+	}
+	key, err := v.Keys.Key(ctx, h.Kid, h.Alg)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(h.Alg, key, signed, sig); err != nil {
+		return nil, err
+	}
+
+	c, err := claims(payload)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	if c.ExpiresAt.IsZero() && !v.AllowNoExpiry {
+		return nil, errs.Wrap(ErrInvalidClaim, "exp")
+	}
+	if !c.ExpiresAt.IsZero() && now.After(c.ExpiresAt.Add(v.Leeway)) {
+		return nil, ErrExpired
+	}
+	if !c.NotBefore.IsZero() && now.Add(v.Leeway).Before(c.NotBefore) {
+		return nil, ErrNotYetValid
+	}
+	if v.Issuer != "" && c.Issuer != v.Issuer {
+		return nil, errs.Wrap(ErrInvalidClaim, "iss")
+	}
+	if v.Audience != "" && !contains(c.Audience, v.Audience) {
+		return nil, errs.Wrap(ErrInvalidClaim, "aud")
+	}
+	return c, nil
+}
+
+func (v *Verifier) allowed(alg string) bool {
+	if len(v.Algorithms) == 0 {
+		return alg == HS256 || alg == RS256 || alg == ES256
+	}
+	return contains(v.Algorithms, alg)
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/server"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testClaims struct {
+	Sub string `json:"sub,omitempty"`
+	Iss string `json:"iss,omitempty"`
+	Aud string `json:"aud,omitempty"`
+	Exp int64  `json:"exp,omitempty"`
+	Nbf int64  `json:"nbf,omitempty"`
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret")
+	keys := KeySet{
+		"hs": secret,
+		"rs": &rsaKey.PublicKey,
+		"es": &ecKey.PublicKey,
+	}
+	v := New(keys)
+	v.Issuer = "issuer"
+	v.Audience = "ws"
+	v.Leeway = 0
+	now := time.Unix(1600000000, 0)
+	v.now = func() time.Time { return now }
+
+	valid := testClaims{Sub: "uid", Iss: "issuer", Aud: "ws", Exp: now.Add(time.Hour).Unix()}
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		key    interface{}
+		claims testClaims
+		err    error
+	}{
+		{"hs256", HS256, "hs", secret, valid, nil},
+		{"rs256", RS256, "rs", rsaKey, valid, nil},
+		{"es256", ES256, "es", ecKey, valid, nil},
+		{"wrong secret", HS256, "hs", []byte("other"), valid, ErrSignature},
+		{"alg confusion", HS256, "rs", secret, valid, ErrKeyMismatch},
+		{"unknown kid", HS256, "nope", secret, valid, ErrUnknownKey},
+		{"expired", HS256, "hs", secret, testClaims{Sub: "uid", Iss: "issuer", Aud: "ws", Exp: now.Add(-time.Second).Unix()}, ErrExpired},
+		{"not yet valid", HS256, "hs", secret, testClaims{Sub: "uid", Iss: "issuer", Aud: "ws", Nbf: now.Add(time.Hour).Unix(), Exp: now.Add(time.Hour * 2).Unix()}, ErrNotYetValid},
+		{"no expiry", HS256, "hs", secret, testClaims{Sub: "uid", Iss: "issuer", Aud: "ws"}, ErrInvalidClaim},
+		{"wrong issuer", HS256, "hs", secret, testClaims{Sub: "uid", Iss: "other", Aud: "ws", Exp: now.Add(time.Hour).Unix()}, ErrInvalidClaim},
+		{"wrong audience", HS256, "hs", secret, testClaims{Sub: "uid", Iss: "issuer", Aud: "other", Exp: now.Add(time.Hour).Unix()}, ErrInvalidClaim},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := Sign(tt.alg, tt.kid, tt.key, tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := v.Verify(context.Background(), token)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && c.Subject != "uid" {
+				t.Fatalf("expected uid, got %s", c.Subject)
+			}
+		})
+	}
+
+	// tokens without expiry only when allowed
+	noExp, _ := Sign(HS256, "hs", secret, testClaims{Sub: "uid", Iss: "issuer", Aud: "ws"})
+	v.AllowNoExpiry = true
+	if c, err := v.Verify(context.Background(), noExp); err != nil || !c.ExpiresAt.IsZero() {
+		t.Fatalf("expected token without expiry to be allowed, got %v", err)
+	}
+	v.AllowNoExpiry = false
+
+	// unsigned tokens are never accepted
+	none := b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"uid"}`)) + "."
+	if _, err := v.Verify(context.Background(), none); !errors.Is(err, ErrUnsupported) {
+		t.Fatalf("expected unsupported, got %v", err)
+	}
+	if _, err := v.Verify(context.Background(), "not.a.jwt!"); !errors.Is(err, ErrMalformed) {
+		t.Fatalf("expected malformed, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := []byte("secret")
+	v := New(KeySet{"": secret})
+	token, err := Sign(HS256, "", secret, testClaims{Sub: "uid", Exp: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		req  func(r *http.Request)
+	}{
+		{"header", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }},
+		{"query", func(r *http.Request) { r.URL.RawQuery = "access_token=" + token }},
+		{"protocol", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Protocol", "bearer, "+token) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/connect", nil)
+			tt.req(r)
+			uid, err := v.Authenticate(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uid != "uid" {
+				t.Fatalf("expected uid, got %s", uid)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/connect", nil)
+	if _, err := v.Authenticate(r); err != ErrMissingToken {
+		t.Fatalf("expected missing token, got %v", err)
+	}
+}
+
+// counts the keys looked up
+type countingKeys struct {
+	Keys
+	n int32
+}
+
+func (k *countingKeys) Key(ctx context.Context, kid, alg string) (interface{}, error) {
+	atomic.AddInt32(&k.n, 1)
+	return k.Keys.Key(ctx, kid, alg)
+}
+
+func TestTrackExpiry(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	secret := []byte("secret")
+	keys := &countingKeys{Keys: KeySet{"": secret}}
+	v := New(keys)
+	exp := server.NewExpiry(v.Reauthenticate, time.Second)
+
+	tracked := make(chan time.Time, 1)
+	h := server.NewHandler(v.Authenticate, nil)
+	h.OnConnect = func(ctx context.Context, c *server.ConnectedClient, r *http.Request) error {
+		if err := v.TrackExpiry(exp)(ctx, c, r); err != nil {
+			return err
+		}
+		tracked <- c.ExpiresAt()
+		return nil
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	// expired, but within the leeway Verify allows
+	expires := time.Now().Add(-time.Second * 10).Truncate(time.Second)
+	token, err := Sign(HS256, "", secret, testClaims{Sub: "expiry-uid", Exp: expires.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case got := <-tracked:
+		if want := expires.Add(v.Leeway); !got.Equal(want) {
+			t.Fatalf("expected expiry at %v, got %v", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the connection to be tracked")
+	}
+	if n := atomic.LoadInt32(&keys.n); n != 1 {
+		t.Fatalf("expected the token to be verified once, looked up %d keys", n)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.verified) != 0 {
+		t.Fatalf("verified claims should be dropped once used, %d kept", len(v.verified))
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits int32
+	var rotated int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		keys := []map[string]string{{
+			"kty": "RSA", "kid": "rs", "alg": RS256, "use": "sig",
+			"n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}
+		if atomic.LoadInt32(&rotated) == 1 {
+			keys = append(keys, map[string]string{
+				"kty": "EC", "kid": "es", "crv": "P-256",
+				"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes()),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer srv.Close()
+
+	j := NewJWKS(srv.URL, time.Hour)
+	j.MinRefresh = 0
+	v := New(j)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	rs, _ := Sign(RS256, "rs", rsaKey, testClaims{Sub: "uid", Exp: exp})
+	for i := 0; i < 3; i++ {
+		if _, err := v.Verify(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected keys to be cached, fetched %d times", n)
+	}
+
+	// an unknown kid refetches the set to pick up rotated keys
+	atomic.StoreInt32(&rotated, 1)
+	es, _ := Sign(ES256, "es", ecKey, testClaims{Sub: "uid", Exp: exp})
+	if _, err := v.Verify(context.Background(), es); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Fatalf("expected keys to be refetched once, fetched %d times", n)
+	}
+
+	// the key's alg is enforced
+	if _, err := j.Key(context.Background(), "rs", HS256); err != ErrKeyMismatch {
+		t.Fatalf("expected key mismatch, got %v", err)
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var hits int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "rs", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		}}})
+	}))
+	defer srv.Close()
+
+	// zero ttl caches for DefaultTTL
+	j := NewJWKS(srv.URL, 0)
+	now := time.Now()
+	j.now = func() time.Time { return now }
+
+	// concurrent lookups share a single fetch
+	errCh := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := j.Key(context.Background(), "rs", RS256)
+			errCh <- err
+		}()
+	}
+	time.Sleep(time.Millisecond * 20)
+
+	// the lock isn't held while fetching, a waiter can give up
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := j.Key(ctx, "rs", RS256); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded while the fetch is in flight, got %v", err)
+	}
+
+	close(release)
+	for i := 0; i < 5; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := j.Key(context.Background(), "rs", RS256); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected a single fetch, fetched %d times", n)
+	}
+}
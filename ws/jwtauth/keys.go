@@ -0,0 +1,237 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	errs "github.com/pkg/errors"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// DefaultTTL is how long JWKS caches keys when its TTL is zero
+const DefaultTTL = time.Hour
+
+// Keys looks up the key verifying tokens signed by kid with alg
+type Keys interface {
+	Key(ctx context.Context, kid, alg string) (interface{}, error)
+}
+
+// KeySet is a static set of verification keys by kid, a []byte for HS256,
+// *rsa.PublicKey for RS256 or *ecdsa.PublicKey for ES256. The key under ""
+// verifies tokens without a kid
+type KeySet map[string]interface{}
+
+func (s KeySet) Key(ctx context.Context, kid, alg string) (interface{}, error) {
+	k, ok := s[kid]
+	if !ok {
+		return nil, errs.Wrap(ErrUnknownKey, kid)
+	}
+	return k, nil
+}
+
+// JWKS fetches verification keys from a JSON Web Key Set URL and caches them
+type JWKS struct {
+	URL string
+	// keys are refetched once older than TTL, DefaultTTL when zero
+	TTL time.Duration
+	// a token signed by an unknown kid triggers a refetch at most every MinRefresh
+	MinRefresh time.Duration
+	Client     *http.Client
+
+	mu         sync.Mutex
+	keys       map[string]jwk
+	err        error // of the last fetch
+	fetched    time.Time
+	refreshing chan struct{} // closed once the fetch in flight is done, nil when idle
+	now        func() time.Time
+}
+
+// creates a JWKS for url caching keys for ttl
+func NewJWKS(url string, ttl time.Duration) *JWKS {
+	return &JWKS{
+		URL:        url,
+		TTL:        ttl,
+		MinRefresh: time.Minute,
+		Client:     &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+type jwk struct {
+	alg string
+	key interface{}
+}
+
+// Key looks kid up in the cached keys, refetching them when they are stale or kid is
+// unknown. Only one fetch is in flight at a time, concurrent callers wait for it
+func (j *JWKS) Key(ctx context.Context, kid, alg string) (interface{}, error) {
+	refreshed := false
+	for {
+		j.mu.Lock()
+		k, ok := j.keys[kid]
+		if refreshed || !j.needsFetch(ok) {
+			keys, err := j.keys, j.err
+			j.mu.Unlock()
+			if keys == nil && err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, errs.Wrap(ErrUnknownKey, kid)
+			}
+			if k.alg != "" && k.alg != alg {
+				return nil, ErrKeyMismatch
+			}
+			return k.key, nil
+		}
+
+		wait := j.refreshing
+		if wait == nil {
+			done := make(chan struct{})
+			j.refreshing = done
+			j.mu.Unlock()
+			j.refresh(ctx, done)
+		} else {
+			j.mu.Unlock()
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		refreshed = true
+	}
+}
+
+// true when the keys are stale, or a key isn't known and the set may be refetched, must hold mu
+func (j *JWKS) needsFetch(known bool) bool {
+	ttl := j.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	age := j.clock().Sub(j.fetched)
+	return j.keys == nil || age > ttl || (!known && age > j.MinRefresh)
+}
+
+// fetches the keys without holding mu and wakes callers waiting on done. Cached keys
+// are kept while the endpoint is down
+func (j *JWKS) refresh(ctx context.Context, done chan struct{}) {
+	keys, err := j.fetch(ctx)
+
+	j.mu.Lock()
+	j.err = err
+	if err == nil {
+		j.keys, j.fetched = keys, j.clock()
+	}
+	j.refreshing = nil
+	j.mu.Unlock()
+	close(done)
+}
+
+func (j *JWKS) clock() time.Time {
+	if j.now != nil {
+		return j.now()
+	}
+	return time.Now()
+}
+
+type rawJWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// keys served at URL
+func (j *JWKS) fetch(ctx context.Context) (map[string]jwk, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := j.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errs.Wrap(err, "couldn't fetch jwks")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("couldn't fetch jwks, status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []rawJWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, errs.Wrap(err, "couldn't decode jwks")
+	}
+
+	keys := make(map[string]jwk, len(set.Keys))
+	for _, r := range set.Keys {
+		if r.Use != "" && r.Use != "sig" {
+			continue
+		}
+		k, err := r.key()
+		if err != nil {
+			// skip keys of unsupported types rather than failing the whole set
+			continue
+		}
+		keys[r.Kid] = jwk{alg: r.Alg, key: k}
+	}
+	return keys, nil
+}
+
+func (r rawJWK) key() (interface{}, error) {
+	switch r.Kty {
+	case "RSA":
+		n, err := b64int(r.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64int(r.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if r.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", r.Crv)
+		}
+		x, err := b64int(r.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64int(r.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(r.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", r.Kty)
+}
+
+func b64int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
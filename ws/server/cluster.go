@@ -0,0 +1,243 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/broker"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	errs "github.com/pkg/errors"
+	"log"
+	"sync"
+)
+
+// Cluster routes messages for users and topics through a Broker, so they reach
+// connections held by any node sharing it
+type Cluster struct {
+	Broker broker.Broker
+	// when set topic broadcasts are buffered per session, and subscriptions outlive
+	// connections until Unsubscribe is called
+	Sessions *Sessions
+	Prefix   string // prepended to broker channel names
+
+	smu    sync.Mutex // serializes topic subscription changes
+	mu     sync.Mutex
+	users  map[*ConnectedClient]broker.Subscription
+	topics map[string]*topicSub
+}
+
+// local members of a topic and the broker subscription feeding them
+type topicSub struct {
+	sub     broker.Subscription
+	members map[interface{}]*ConnectedClient
+}
+
+// creates a Cluster over b, ss may be nil
+func NewCluster(b broker.Broker, ss *Sessions) *Cluster {
+	cl := &Cluster{
+		Broker:   b,
+		Sessions: ss,
+		Prefix:   "ws",
+		users:    make(map[*ConnectedClient]broker.Subscription),
+		topics:   make(map[string]*topicSub),
+	}
+	if ss != nil {
+		ss.mu.Lock()
+		ss.onRemove = append(ss.onRemove, cl.expire)
+		ss.mu.Unlock()
+	}
+	return cl
+}
+
+// subscribes c to messages sent to its uid from any node, until c is cleaned up
+func (cl *Cluster) Register(ctx context.Context, c *ConnectedClient) error {
+	sub, err := cl.Broker.Subscribe(ctx, cl.userChannel(c.uid), func(data []byte) {
+		if err := c.Write(data); err != nil {
+			log.Println("failed to write to", c.uid, err)
+		}
+	})
+	if err != nil {
+		return errs.Wrapf(err, "failed to register %s", c.uid)
+	}
+
+	cl.mu.Lock()
+	cl.users[c] = sub
+	cl.mu.Unlock()
+
+	c.onDone(func() { cl.unregister(c) })
+	return nil
+}
+
+// sends payload as a message of msgType to uid, wherever it is connected
+func (cl *Cluster) SendToUser(ctx context.Context, uid, msgType string, payload interface{}) error {
+	b, err := envelope.Marshal(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return cl.Broker.Publish(ctx, cl.userChannel(uid), b)
+}
+
+// subscribes c to topic
+func (cl *Cluster) Subscribe(ctx context.Context, c *ConnectedClient, topic string) error {
+	if cl.Sessions != nil {
+		if err := cl.Sessions.Subscribe(c, topic); err != nil {
+			return err
+		}
+	}
+
+	// broker calls are made without cl.mu held, deliveries need it
+	cl.smu.Lock()
+	defer cl.smu.Unlock()
+
+	cl.mu.Lock()
+	ts, ok := cl.topics[topic]
+	cl.mu.Unlock()
+	if !ok {
+		sub, err := cl.Broker.Subscribe(ctx, cl.topicChannel(topic), func(data []byte) {
+			cl.deliver(topic, data)
+		})
+		if err != nil {
+			return errs.Wrapf(err, "failed to subscribe to %s", topic)
+		}
+		ts = &topicSub{sub: sub, members: make(map[interface{}]*ConnectedClient)}
+	}
+
+	cl.mu.Lock()
+	cl.topics[topic] = ts
+	ts.members[cl.member(c)] = c
+	cl.mu.Unlock()
+	return nil
+}
+
+// unsubscribes c from topic
+func (cl *Cluster) Unsubscribe(c *ConnectedClient, topic string) {
+	key := cl.member(c)
+	if cl.Sessions != nil {
+		cl.Sessions.Unsubscribe(c, topic)
+	}
+	cl.leave(key, topic)
+}
+
+// sends payload as a message of msgType to every subscriber of topic on every node
+func (cl *Cluster) Broadcast(ctx context.Context, topic, msgType string, payload interface{}) error {
+	e, err := envelope.New(msgType, payload)
+	if err != nil {
+		return err
+	}
+	e.Topic = topic
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return cl.Broker.Publish(ctx, cl.topicChannel(topic), b)
+}
+
+// hands a broadcast received from the broker to local subscribers
+func (cl *Cluster) deliver(topic string, data []byte) {
+	if cl.Sessions != nil {
+		e, err := envelope.Parse(data)
+		if err != nil {
+			log.Println("invalid broadcast on", topic, err)
+			return
+		}
+		if err := cl.Sessions.Broadcast(topic, e.Type, e.Payload); err != nil {
+			log.Println("failed to broadcast", topic, err)
+		}
+		return
+	}
+
+	cl.mu.Lock()
+	var conns []*ConnectedClient
+	if ts, ok := cl.topics[topic]; ok {
+		for _, c := range ts.members {
+			conns = append(conns, c)
+		}
+	}
+	cl.mu.Unlock()
+
+	for _, c := range conns {
+		if err := c.Write(data); err != nil {
+			log.Println("failed to write", topic, "to", c.uid, err)
+		}
+	}
+}
+
+func (cl *Cluster) unregister(c *ConnectedClient) {
+	cl.mu.Lock()
+	sub, ok := cl.users[c]
+	delete(cl.users, c)
+	var topics []string
+	if cl.Sessions == nil {
+		// with sessions, the session keeps its topics to buffer for a resume
+		for topic, ts := range cl.topics {
+			if _, ok := ts.members[c]; ok {
+				topics = append(topics, topic)
+			}
+		}
+	}
+	cl.mu.Unlock()
+
+	if ok {
+		if err := sub.Unsubscribe(); err != nil {
+			log.Println("failed to unsubscribe", c.uid, err)
+		}
+	}
+	for _, topic := range topics {
+		cl.leave(c, topic)
+	}
+}
+
+// drops an expired session from every topic it was a member of
+func (cl *Cluster) expire(sess *Session) {
+	cl.mu.Lock()
+	var topics []string
+	for topic, ts := range cl.topics {
+		if _, ok := ts.members[sess]; ok {
+			topics = append(topics, topic)
+		}
+	}
+	cl.mu.Unlock()
+
+	for _, topic := range topics {
+		cl.leave(sess, topic)
+	}
+}
+
+// removes member key from topic, dropping the broker subscription with the last member
+func (cl *Cluster) leave(key interface{}, topic string) {
+	cl.smu.Lock()
+	defer cl.smu.Unlock()
+
+	cl.mu.Lock()
+	ts, ok := cl.topics[topic]
+	if ok {
+		delete(ts.members, key)
+		if ok = len(ts.members) == 0; ok {
+			delete(cl.topics, topic)
+		}
+	}
+	cl.mu.Unlock()
+
+	if ok {
+		if err := ts.sub.Unsubscribe(); err != nil {
+			log.Println("failed to unsubscribe from", topic, err)
+		}
+	}
+}
+
+// topic members are sessions when there are any, so they survive a resume
+func (cl *Cluster) member(c *ConnectedClient) interface{} {
+	if cl.Sessions != nil {
+		if sess, ok := cl.Sessions.session(c); ok {
+			return sess
+		}
+	}
+	return c
+}
+
+func (cl *Cluster) userChannel(uid string) string {
+	return cl.Prefix + ":user:" + uid
+}
+
+func (cl *Cluster) topicChannel(topic string) string {
+	return cl.Prefix + ":topic:" + topic
+}
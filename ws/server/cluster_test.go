@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"github.com/mousybusiness/go-web/ws/broker"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// waits for n messages to be written to c
+func waitWritten(t *testing.T, srv *connServer, c CleanableConnection, n int) []envelope.Envelope {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if w := srv.of(c); len(w) >= n {
+			return w
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d messages, got: %+v", n, srv.of(c))
+	return nil
+}
+
+func TestCluster(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	Server = srv
+	ctx := context.Background()
+
+	b := broker.NewMemory()
+	defer b.Close()
+	nodeA := NewCluster(b, nil)
+	nodeB := NewCluster(b, nil)
+
+	// uid connected to node A, sent from node B
+	conn := &tagConn{name: "a"}
+	c := NewConnection("cluster-uid", conn)
+	checkErr(t, nodeA.Register(ctx, c))
+	checkErr(t, nodeB.SendToUser(ctx, "cluster-uid", "note", chatMsg{Text: "hi"}))
+	w := waitWritten(t, srv, conn, 1)
+	if w[0].Type != "note" || string(w[0].Payload) != `{"text":"hi"}` {
+		t.Fatalf("invalid message sent to user: %+v", w[0])
+	}
+
+	// topic broadcast from node B
+	checkErr(t, nodeA.Subscribe(ctx, c, "news"))
+	checkErr(t, nodeB.Broadcast(ctx, "news", "headline", chatMsg{Text: "1"}))
+	w = waitWritten(t, srv, conn, 2)
+	if w[1].Topic != "news" || w[1].Type != "headline" {
+		t.Fatalf("invalid broadcast: %+v", w[1])
+	}
+
+	// unsubscribed
+	nodeA.Unsubscribe(c, "news")
+	checkErr(t, nodeB.Broadcast(ctx, "news", "headline", chatMsg{Text: "2"}))
+	time.Sleep(time.Millisecond * 10)
+	if len(srv.of(conn)) != 2 {
+		t.Fatalf("unsubscribed connection shouldnt receive broadcasts")
+	}
+
+	// disconnect drops the subscriptions
+	checkErr(t, nodeA.Subscribe(ctx, c, "news"))
+	c.cleanUp()
+	deadline := time.Now().Add(time.Second)
+	for {
+		nodeA.mu.Lock()
+		n := len(nodeA.users) + len(nodeA.topics)
+		nodeA.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subscriptions should be dropped on disconnect")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClusterSessions(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	Server = srv
+	ctx := context.Background()
+
+	b := broker.NewMemory()
+	defer b.Close()
+	ss := NewSessions(10, time.Minute)
+	nodeA := NewCluster(b, ss)
+	nodeB := NewCluster(b, nil)
+
+	conn1 := &tagConn{name: "1"}
+	c1 := NewConnection("cluster-session-uid", conn1)
+	sess, err := ss.Attach(c1)
+	checkErr(t, err)
+	checkErr(t, nodeA.Subscribe(ctx, c1, "news"))
+
+	checkErr(t, nodeB.Broadcast(ctx, "news", "headline", chatMsg{Text: "1"}))
+	w := waitWritten(t, srv, conn1, 2)
+	if w[1].Offset != 1 || w[1].Topic != "news" {
+		t.Fatalf("broadcast should be numbered by the session: %+v", w[1])
+	}
+
+	// broadcasts during a disconnect are buffered by the session
+	c1.cleanUp()
+	time.Sleep(time.Millisecond * 10)
+	checkErr(t, nodeB.Broadcast(ctx, "news", "headline", chatMsg{Text: "2"}))
+	time.Sleep(time.Millisecond * 10)
+
+	conn2 := &tagConn{name: "2"}
+	c2 := NewConnection("cluster-session-uid", conn2)
+	_, err = ss.Resume(c2, sess.ID(), 1)
+	checkErr(t, err)
+	w = waitWritten(t, srv, conn2, 2)
+	if w[1].Offset != 2 || string(w[1].Payload) != `{"text":"2"}` {
+		t.Fatalf("invalid replay: %+v", w[1])
+	}
+
+	// unsubscribing through the resumed connection drops the topic
+	nodeA.Unsubscribe(c2, "news")
+	nodeA.mu.Lock()
+	n := len(nodeA.topics)
+	nodeA.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("topic should be dropped once the session unsubscribes")
+	}
+	c2.cleanUp()
+
+	// members are dropped once their session expires
+	ss.TTL = time.Millisecond
+	conn3 := &tagConn{name: "3"}
+	c3 := NewConnection("cluster-session-uid", conn3)
+	_, err = ss.Attach(c3)
+	checkErr(t, err)
+	checkErr(t, nodeA.Subscribe(ctx, c3, "news"))
+	c3.cleanUp()
+	eventually(t, "session detached", func() bool {
+		_, ok := ss.session(c3)
+		return !ok
+	})
+	time.Sleep(time.Millisecond * 5)
+
+	// expired sessions are swept when the next session is attached
+	c4 := NewConnection("cluster-session-uid", &tagConn{name: "4"})
+	_, err = ss.Attach(c4)
+	checkErr(t, err)
+	nodeA.mu.Lock()
+	n = len(nodeA.topics)
+	nodeA.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("topic should be dropped once the session expires")
+	}
+	c4.cleanUp()
+}
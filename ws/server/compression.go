@@ -0,0 +1,184 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression configures permessage-deflate (RFC 7692)
+type Compression struct {
+	// flate level, 0 defaults to flate.DefaultCompression
+	Level int
+	// messages shorter than Threshold bytes are sent uncompressed
+	Threshold int
+	// compress every message on its own rather than keep the window between messages,
+	// trading ratio for memory as compressors are pooled instead of held per connection
+	ServerNoContextTakeover bool
+	// require clients to do the same, sparing the server a decompression window per connection
+	ClientNoContextTakeover bool
+}
+
+// the tail of a sync flush, stripped from compressed messages
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// flate writers shared by connections without server context takeover, by level
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// implemented by CleanableConnections that negotiated permessage-deflate
+type compressedConn interface {
+	compression() *deflateState
+}
+
+// compression state of one connection, writes are serialized by the client's write
+// mutex and reads by its read loop
+type deflateState struct {
+	cfg    Compression
+	params wsflate.Parameters
+
+	fw     *flate.Writer // kept with server context takeover only
+	wbuf   bytes.Buffer
+	window []byte // latest decompressed bytes, the dictionary of the next message
+}
+
+// negotiates a permessage-deflate offer, accepting what the server can honour
+func (cfg Compression) negotiate(opt httphead.Option, accepted *wsflate.Parameters, ok *bool) (httphead.Option, error) {
+	if *ok || !bytes.Equal(opt.Name, wsflate.ExtensionNameBytes) {
+		return httphead.Option{}, nil
+	}
+	var offer wsflate.Parameters
+	if err := offer.Parse(opt); err != nil {
+		// decline offers we can't parse rather than fail the upgrade
+		return httphead.Option{}, nil
+	}
+	if offer.ServerMaxWindowBits.Defined() && offer.ServerMaxWindowBits < 15 {
+		// compress/flate always uses a 32KB window
+		return httphead.Option{}, nil
+	}
+	p := wsflate.Parameters{
+		ServerNoContextTakeover: cfg.ServerNoContextTakeover || offer.ServerNoContextTakeover,
+		ClientNoContextTakeover: cfg.ClientNoContextTakeover || offer.ClientNoContextTakeover,
+	}
+	*accepted, *ok = p, true
+	return p.Option(), nil
+}
+
+func (d *deflateState) level() int {
+	if d.cfg.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return d.cfg.Level
+}
+
+// compresses a message, false when it is below the threshold and goes uncompressed
+func (d *deflateState) compress(p []byte) ([]byte, bool, error) {
+	if len(p) < d.cfg.Threshold {
+		return p, false, nil
+	}
+	d.wbuf.Reset()
+	fw, err := d.writer()
+	if err != nil {
+		return nil, false, err
+	}
+	if d.params.ServerNoContextTakeover {
+		defer d.release(fw)
+	}
+	if _, err := fw.Write(p); err != nil {
+		return nil, false, err
+	}
+	if err := fw.Flush(); err != nil {
+		return nil, false, err
+	}
+	return bytes.TrimSuffix(d.wbuf.Bytes(), deflateTail), true, nil
+}
+
+// the connection's writer with context takeover, otherwise a pooled one reset onto wbuf
+func (d *deflateState) writer() (*flate.Writer, error) {
+	level := d.level()
+	if !d.params.ServerNoContextTakeover || level < flate.HuffmanOnly || level > flate.BestCompression {
+		if d.fw == nil {
+			fw, err := flate.NewWriter(&d.wbuf, level)
+			if err != nil {
+				return nil, err
+			}
+			d.fw = fw
+		}
+		return d.fw, nil
+	}
+	if fw, ok := flateWriters[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(&d.wbuf)
+		return fw, nil
+	}
+	return flate.NewWriter(&d.wbuf, level)
+}
+
+// returns a pooled writer once a message is compressed
+func (d *deflateState) release(fw *flate.Writer) {
+	if fw == d.fw {
+		return
+	}
+	fw.Reset(ioutil.Discard) // don't keep wbuf reachable from the pool
+	flateWriters[d.level()-flate.HuffmanOnly].Put(fw)
+}
+
+// decompresses a message, failing with ErrMessageTooBig once it inflates past max
+func (d *deflateState) decompress(p []byte, max int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateTail), bytes.NewReader([]byte{0x01, 0x00, 0x00, 0xff, 0xff}))
+	var fr io.ReadCloser
+	if d.params.ClientNoContextTakeover {
+		fr = flate.NewReader(src)
+	} else {
+		fr = flate.NewReaderDict(src, d.window)
+	}
+	defer fr.Close()
+
+	r := io.Reader(fr)
+	if max > 0 {
+		r = io.LimitReader(fr, max+1)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(len(b)) > max {
+		return nil, ErrMessageTooBig
+	}
+
+	if !d.params.ClientNoContextTakeover {
+		d.window = append(d.window, b...)
+		if n := len(d.window) - wsflate.MaxLZ77WindowSize; n > 0 {
+			d.window = append(d.window[:0], d.window[n:]...)
+		}
+	}
+	return b, nil
+}
+
+// writes a server text message, compressed when negotiated and above the threshold
+func writeCompressed(w io.Writer, d *deflateState, b []byte) error {
+	p, compressed, err := d.compress(b)
+	if err != nil {
+		return err
+	}
+	f := ws.NewTextFrame(p)
+	if compressed {
+		if f.Header, err = wsflate.SetBit(f.Header); err != nil {
+			return err
+		}
+	}
+	return ws.WriteFrame(w, f)
+}
+
+// wraps an upgraded connection which negotiated permessage-deflate
+type flateConn struct {
+	wrappedConn
+	state *deflateState
+}
+
+func (f flateConn) compression() *deflateState {
+	return f.state
+}
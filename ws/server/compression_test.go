@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/client"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeflateState(t *testing.T) {
+	msg := []byte(strings.Repeat(`{"type":"headline","payload":{"title":"hello"}}`, 20))
+
+	for _, noTakeover := range []bool{false, true} {
+		params := wsflate.Parameters{ServerNoContextTakeover: noTakeover, ClientNoContextTakeover: noTakeover}
+		sender := &deflateState{params: params}
+		receiver := &deflateState{params: params}
+
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			p, compressed, err := sender.compress(msg)
+			checkErr(t, err)
+			if !compressed || len(p) >= len(msg) {
+				t.Fatalf("expected message to be compressed, %d bytes", len(p))
+			}
+			sizes = append(sizes, len(p))
+			b, err := receiver.decompress(p, 0)
+			checkErr(t, err)
+			if string(b) != string(msg) {
+				t.Fatalf("message %d didn't round trip", i)
+			}
+		}
+		// with context takeover repeats are back references into the previous message
+		if !noTakeover && sizes[1] >= sizes[0] {
+			t.Fatalf("expected context takeover to shrink later messages, got %v", sizes)
+		}
+		if noTakeover && sizes[1] != sizes[0] {
+			t.Fatalf("expected messages to be compressed independently, got %v", sizes)
+		}
+		// without context takeover the compressor goes back to the pool
+		if noTakeover && sender.fw != nil {
+			t.Fatal("expected no compressor to be kept per connection")
+		}
+	}
+
+	d := &deflateState{cfg: Compression{Threshold: 1024}, params: wsflate.Parameters{ServerNoContextTakeover: true}}
+	if p, compressed, _ := d.compress([]byte("short")); compressed || string(p) != "short" {
+		t.Fatal("expected message below threshold to be sent as is")
+	}
+
+	// inflating past the size limit is refused
+	bomb, _, err := (&deflateState{params: wsflate.Parameters{ServerNoContextTakeover: true}}).compress(make([]byte, 1<<20))
+	checkErr(t, err)
+	receiver := &deflateState{params: wsflate.Parameters{ClientNoContextTakeover: true}}
+	if _, err := receiver.decompress(bomb, 1024); err != ErrMessageTooBig {
+		t.Fatalf("expected message too big, got %v", err)
+	}
+}
+
+func TestCompressionInterop(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	type echo struct {
+		Text string `json:"text"`
+	}
+	r := NewRouter()
+	r.HandleCall("echo", func(ctx context.Context, c *ConnectedClient, e echo) (echo, error) {
+		return e, nil
+	})
+	h := NewHandler(func(req *http.Request) (string, error) {
+		return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "), nil
+	}, r)
+	h.Compression = &Compression{Level: 9, Threshold: 64}
+	h.ReadLimits = ReadLimits{MaxMessageSize: 1 << 20}
+	srv := serveHandler(t, h)
+
+	for _, uid := range []string{"deflate-uid", "plain-uid"} {
+		t.Run(uid, func(t *testing.T) {
+			d := &websocket.Dialer{EnableCompression: uid == "deflate-uid"}
+			conn, err := client.NewConnection(d, false, uid, strings.TrimPrefix(srv.URL, "http://"), "/connect", uid, "")
+			checkErr(t, err)
+			defer conn.Conn.(*websocket.Conn).Close()
+			checkErr(t, conn.Compress(client.Compression{Threshold: 64}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go client.NewRouter().Serve(ctx, conn)
+
+			var c *ConnectedClient
+			eventually(t, "connection to be registered", func() bool {
+				var ok bool
+				c, ok = Lookup(uid)
+				return ok
+			})
+			if _, compressed := c.conn.(compressedConn); compressed != d.EnableCompression {
+				t.Fatalf("expected compression negotiated to be %v", d.EnableCompression)
+			}
+
+			// above and below the threshold both ways
+			for _, text := range []string{"hi", strings.Repeat("compress me ", 1000)} {
+				var res echo
+				ctx, cancel := context.WithTimeout(ctx, time.Second)
+				err := conn.Call(ctx, "echo", echo{Text: text}, &res)
+				cancel()
+				checkErr(t, err)
+				if res.Text != text {
+					t.Fatalf("expected echo of %d bytes, got %d", len(text), len(res.Text))
+				}
+			}
+		})
+	}
+}
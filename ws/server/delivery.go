@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"sync"
+	"time"
+)
+
+// Delivery sends messages at least once, every message gets a sequence number and is
+// retained in Store until the client acks it, unacked messages are redelivered in
+// order when the uid reconnects
+type Delivery struct {
+	Store     Store
+	Retention Retention
+
+	mu    sync.Mutex
+	locks map[string]*uidLock
+}
+
+// keeps sends and redeliveries for a uid in sequence order
+type uidLock struct {
+	sync.Mutex
+	refs int
+}
+
+// creates a Delivery retaining unacked messages in s, NewMemoryStore is used if s is nil
+func NewDelivery(s Store, r Retention) *Delivery {
+	if s == nil {
+		s = NewMemoryStore()
+	}
+	return &Delivery{
+		Store:     s,
+		Retention: r,
+		locks:     make(map[string]*uidLock),
+	}
+}
+
+// retains payload for uid as a message of msgType and writes it if uid is connected,
+// a failed write is not an error as the message is redelivered on reconnect
+func (d *Delivery) Send(uid, msgType string, payload interface{}) (uint64, error) {
+	e, err := envelope.New(msgType, payload)
+	if err != nil {
+		return 0, err
+	}
+
+	unlock := d.lock(uid)
+	defer unlock()
+
+	m, err := d.Store.Append(uid, Message{Type: e.Type, Payload: e.Payload, Time: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	if err := d.trim(uid); err != nil {
+		log.Println("failed to trim messages for", uid, err)
+	}
+
+	if c, ok := Lookup(uid); ok {
+		if err := d.write(c, m); err != nil {
+			log.Println("failed to deliver", m.Seq, "to", uid, err)
+		}
+	}
+	return m.Seq, nil
+}
+
+// removes the message for uid with seq, older unacked messages are still redelivered
+func (d *Delivery) Ack(uid string, seq uint64) error {
+	return d.Store.Ack(uid, seq)
+}
+
+// writes every unacked message for c in sequence order, call it once c is connected
+func (d *Delivery) Redeliver(c *ConnectedClient) error {
+	unlock := d.lock(c.uid)
+	defer unlock()
+
+	if err := d.trim(c.uid); err != nil {
+		return err
+	}
+	msgs, err := d.Store.Pending(c.uid)
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if err := d.write(c, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// registers the ack handler on r
+func (d *Delivery) Route(r *Router) {
+	r.Handle(envelope.TypeAck, func(ctx context.Context, c *ConnectedClient, a envelope.Ack) error {
+		return d.Ack(c.uid, a.Seq)
+	})
+}
+
+func (d *Delivery) write(c *ConnectedClient, m Message) error {
+	b, err := json.Marshal(envelope.Envelope{Type: m.Type, Seq: m.Seq, Payload: m.Payload})
+	if err != nil {
+		return err
+	}
+	return c.Write(b)
+}
+
+func (d *Delivery) trim(uid string) error {
+	if d.Retention.MaxMessages <= 0 && d.Retention.MaxAge <= 0 {
+		return nil
+	}
+	var cutoff time.Time
+	if d.Retention.MaxAge > 0 {
+		cutoff = time.Now().Add(-d.Retention.MaxAge)
+	}
+	return d.Store.Trim(uid, d.Retention.MaxMessages, cutoff)
+}
+
+func (d *Delivery) lock(uid string) func() {
+	d.mu.Lock()
+	if d.locks == nil {
+		d.locks = make(map[string]*uidLock)
+	}
+	l, ok := d.locks[uid]
+	if !ok {
+		l = &uidLock{}
+		d.locks[uid] = l
+	}
+	l.refs++
+	d.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		d.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(d.locks, uid)
+		}
+		d.mu.Unlock()
+	}
+}
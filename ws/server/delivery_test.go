@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+)
+
+func TestDelivery(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{}
+	Server = rs
+	d := NewDelivery(nil, Retention{MaxMessages: 3})
+
+	// offline, retained
+	for i := 0; i < 4; i++ {
+		_, err := d.Send("delivery-uid", "note", chatMsg{Text: "offline"})
+		checkErr(t, err)
+	}
+	if len(rs.written) != 0 {
+		t.Fatalf("nothing should be written while offline")
+	}
+
+	// reconnect redelivers in order, oldest dropped by retention
+	c := NewConnection("delivery-uid", stubConn{})
+	checkErr(t, d.Redeliver(c))
+	if len(rs.written) != 3 {
+		t.Fatalf("redelivered; want: %v, got: %v", 3, len(rs.written))
+	}
+	e := rs.last(t)
+	if e.Type != "note" || e.Seq != 4 {
+		t.Fatalf("invalid redelivery: %+v", e)
+	}
+
+	// online, written straight away
+	seq, err := d.Send("delivery-uid", "note", chatMsg{Text: "online"})
+	checkErr(t, err)
+	e = rs.last(t)
+	if e.Seq != seq || seq != 5 || string(e.Payload) != `{"text":"online"}` {
+		t.Fatalf("invalid delivery: %+v", e)
+	}
+
+	// client acks through the router
+	r := NewRouter()
+	d.Route(r)
+	checkErr(t, r.Dispatch(context.Background(), c, []byte(`{"type":"ack","payload":{"seq":2}}`)))
+	checkErr(t, r.Dispatch(context.Background(), c, []byte(`{"type":"ack","payload":{"seq":4}}`)))
+	pending, err := d.Store.Pending("delivery-uid")
+	checkErr(t, err)
+	if len(pending) != 2 || pending[0].Seq != 3 || pending[1].Seq != 5 {
+		t.Fatalf("pending after ack; want: %v and %v, got: %+v", 3, 5, pending)
+	}
+
+	// unacked messages come back in order, even those older than an ack
+	n := len(rs.written)
+	checkErr(t, d.Redeliver(c))
+	if len(rs.written) != n+2 {
+		t.Fatalf("redelivered; want: %v, got: %v", 2, len(rs.written)-n)
+	}
+	if e := rs.last(t); e.Seq != 5 {
+		t.Fatalf("invalid redelivery: %+v", e)
+	}
+
+	c.cleanUp()
+}
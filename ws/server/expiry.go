@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"sync"
+	"time"
+)
+
+// Verifier validates a fresh token sent over an established connection, returning
+// the uid it identifies and when it expires
+type Verifier func(ctx context.Context, token string) (uid string, expires time.Time, err error)
+
+// Expiry closes connections once the credentials they were authorized with expire.
+// Notice before expiry the client is sent a reauth envelope and can extend the
+// connection by calling reauth with a fresh token
+type Expiry struct {
+	Verify Verifier
+	Notice time.Duration
+
+	mu    sync.Mutex
+	conns map[*ConnectedClient]*expiryTimers
+}
+
+type expiryTimers struct {
+	notice, expire *time.Timer
+}
+
+// creates an Expiry asking clients to re-authenticate notice before their credentials expire
+func NewExpiry(verify Verifier, notice time.Duration) *Expiry {
+	return &Expiry{
+		Verify: verify,
+		Notice: notice,
+		conns:  make(map[*ConnectedClient]*expiryTimers),
+	}
+}
+
+// registers the reauth call on r
+func (e *Expiry) Route(r *Router) {
+	r.HandleCall(envelope.TypeReauth, e.reauth)
+}
+
+// enforces expires on c, replacing any expiry tracked before. A zero expires never expires
+func (e *Expiry) Track(c *ConnectedClient, expires time.Time) {
+	c.setExpiry(expires)
+	if e.track(c, expires) {
+		// registered without e.mu held, it runs straight away if c is already done
+		c.onDone(func() { e.untrack(c) })
+	}
+}
+
+// starts the timers for c, true when c wasn't tracked before
+func (e *Expiry) track(c *ConnectedClient, expires time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conns == nil {
+		e.conns = make(map[*ConnectedClient]*expiryTimers)
+	}
+	t, tracked := e.conns[c]
+	if tracked {
+		t.stop()
+	} else {
+		t = &expiryTimers{}
+		e.conns[c] = t
+	}
+	if expires.IsZero() {
+		return !tracked
+	}
+
+	until := time.Until(expires)
+	notice := until - e.Notice
+	if notice < 0 {
+		notice = 0
+	}
+	t.notice = time.AfterFunc(notice, func() {
+		if err := c.Send(envelope.TypeReauth, envelope.Reauth{ExpiresAt: expires}); err != nil {
+			log.Println("failed to ask", c.UID(), "to re-authenticate,", err)
+		}
+	})
+	t.expire = time.AfterFunc(until, func() {
+		if c.ExpiresAt().After(expires) {
+			return
+		}
+		log.Println("credentials expired, closing connection for", c.UID())
+		_ = c.CloseWith(ws.StatusPolicyViolation, "credentials expired")
+	})
+	return !tracked
+}
+
+// closes c with a policy violation straight away, e.g. once its token is revoked
+func (e *Expiry) Revoke(c *ConnectedClient) error {
+	e.untrack(c)
+	return c.CloseWith(ws.StatusPolicyViolation, "credentials revoked")
+}
+
+func (e *Expiry) untrack(c *ConnectedClient) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if t, ok := e.conns[c]; ok {
+		t.stop()
+		delete(e.conns, c)
+	}
+}
+
+func (e *Expiry) reauth(ctx context.Context, c *ConnectedClient, r envelope.Reauth) (envelope.Reauth, error) {
+	if e.Verify == nil {
+		return envelope.Reauth{}, errors.New("re-authentication is not supported")
+	}
+	uid, expires, err := e.Verify(ctx, r.Token)
+	if err != nil {
+		return envelope.Reauth{}, err
+	}
+	if uid != c.UID() {
+		// a token for someone else mustn't take over the connection
+		log.Println("re-authentication as", uid, "rejected for", c.UID())
+		return envelope.Reauth{}, errors.New("token is for another user")
+	}
+	if expires.IsZero() {
+		// would lift the deadline the connection was authorized with
+		log.Println("re-authentication without expiry rejected for", c.UID())
+		return envelope.Reauth{}, errors.New("token has no expiry")
+	}
+	e.Track(c, expires)
+	return envelope.Reauth{ExpiresAt: expires}, nil
+}
+
+func (t *expiryTimers) stop() {
+	if t.notice != nil {
+		t.notice.Stop()
+	}
+	if t.expire != nil {
+		t.expire.Stop()
+	}
+}
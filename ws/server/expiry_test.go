@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records close frames along with messages
+type closeServer struct {
+	connServer
+	cmu    sync.Mutex
+	closed map[CleanableConnection]ws.StatusCode
+}
+
+func (s *closeServer) WriteClose(c *CleanableConnection, code ws.StatusCode, reason string) error {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	s.closed[*c] = code
+	return nil
+}
+
+func (s *closeServer) closeCode(c CleanableConnection) (ws.StatusCode, bool) {
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	code, ok := s.closed[c]
+	return code, ok
+}
+
+func newCloseServer() *closeServer {
+	return &closeServer{
+		connServer: connServer{written: make(map[CleanableConnection][]envelope.Envelope)},
+		closed:     make(map[CleanableConnection]ws.StatusCode),
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newCloseServer()
+	Server = srv
+	verify := func(ctx context.Context, token string) (string, time.Time, error) {
+		switch token {
+		case "fresh":
+			return "expiry-uid", time.Now().Add(time.Millisecond * 150), nil
+		case "other":
+			return "other-uid", time.Now().Add(time.Hour), nil
+		case "forever":
+			return "expiry-uid", time.Time{}, nil
+		}
+		return "", time.Time{}, errors.New("invalid token")
+	}
+	e := NewExpiry(verify, time.Millisecond*40)
+	r := NewRouter()
+	e.Route(r)
+
+	conn := &tagConn{name: "expiry"}
+	c := NewConnection("expiry-uid", conn)
+	e.Track(c, time.Now().Add(time.Millisecond*50))
+
+	// asked to re-authenticate before expiry
+	w := waitWritten(t, &srv.connServer, conn, 1)
+	if w[0].Type != envelope.TypeReauth {
+		t.Fatalf("expected reauth, got %+v", w[0])
+	}
+
+	call := func(id, token string) envelope.Envelope {
+		b, _ := json.Marshal(envelope.Envelope{Type: envelope.TypeReauth, ID: id, Payload: json.RawMessage(`{"token":"` + token + `"}`)})
+		_ = r.Dispatch(context.Background(), c, b)
+		w := srv.of(conn)
+		return w[len(w)-1]
+	}
+	if res := call("1", "other"); res.Type != envelope.TypeError {
+		t.Fatalf("expected another user's token to be refused, got %+v", res)
+	}
+	if res := call("2", "bad"); res.Type != envelope.TypeError {
+		t.Fatalf("expected invalid token to be refused, got %+v", res)
+	}
+	if res := call("4", "forever"); res.Type != envelope.TypeError {
+		t.Fatalf("expected token without expiry to be refused, got %+v", res)
+	}
+	if c.ExpiresAt().IsZero() {
+		t.Fatal("expected the deadline to be kept")
+	}
+	res := call("3", "fresh")
+	if res.Type != envelope.TypeResult || res.ID != "3" {
+		t.Fatalf("expected result, got %+v", res)
+	}
+
+	// outlives the original expiry
+	time.Sleep(time.Millisecond * 70)
+	if _, ok := srv.closeCode(conn); ok {
+		t.Fatal("expected refreshed connection to stay open")
+	}
+	if _, ok := Lookup("expiry-uid"); !ok {
+		t.Fatal("expected refreshed connection to be registered")
+	}
+
+	// closed with a policy violation once the fresh token expires too
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be closed on expiry")
+	}
+	if code, _ := srv.closeCode(conn); code != ws.StatusPolicyViolation {
+		t.Fatalf("expected policy violation, got %d", code)
+	}
+	if _, ok := Lookup("expiry-uid"); ok {
+		t.Fatal("expected expired connection to be removed")
+	}
+}
+
+func TestExpiryRevoke(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newCloseServer()
+	Server = srv
+	e := NewExpiry(nil, time.Minute)
+
+	conn := &tagConn{name: "revoke"}
+	c := NewConnection("revoke-uid", conn)
+	e.Track(c, time.Time{})
+	if err := e.Revoke(c); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := srv.closeCode(conn); code != ws.StatusPolicyViolation {
+		t.Fatalf("expected policy violation, got %d", code)
+	}
+	if _, ok := Lookup("revoke-uid"); ok {
+		t.Fatal("expected revoked connection to be removed")
+	}
+}
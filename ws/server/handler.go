@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	errs "github.com/pkg/errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// Authenticator identifies the user making an upgrade request
+type Authenticator func(r *http.Request) (uid string, err error)
+
+// Handler upgrades requests to websockets, registers the connection for the
+// authenticated uid and starts reading from it
+type Handler struct {
+	Authenticate Authenticator
+	// messages are dispatched to Router when set, otherwise they are sent to MsgCh,
+	// and dropped if MsgCh is nil too
+	Router *Router
+	MsgCh  chan Msg
+	// limits the messages read from every connection when set
+	Limiter *RateLimiter
+	// bounds the size of messages read from every connection, unlimited when zero
+	ReadLimits ReadLimits
+	// reads connections with epoll instead of a goroutine each when set
+	Poller *Poller
+	// called once the connection is registered, before reading starts, an error
+	// closes the connection
+	OnConnect func(ctx context.Context, c *ConnectedClient, r *http.Request) error
+	// decides which origins may upgrade, defaults to SameOrigin so other sites can't
+	// open a websocket with the user's cookies
+	CheckOrigin OriginChecker
+	// negotiates permessage-deflate with clients which offer it when set
+	Compression *Compression
+	// subprotocols the handler accepts, the first one the client requests is negotiated
+	Protocols []string
+	// refuses an upgrade for a uid which is already connected with 409 Conflict when
+	// set, otherwise a uid may connect from several devices and Lookup returns the newest
+	SingleConnection bool
+
+	mu        sync.Mutex
+	upgrading map[string]struct{}
+}
+
+// creates a Handler identifying users with auth and dispatching their messages to r
+func NewHandler(auth Authenticator, r *Router) *Handler {
+	return &Handler{Authenticate: auth, Router: r}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	check := h.CheckOrigin
+	if check == nil {
+		check = SameOrigin
+	}
+	if !check(r) {
+		log.Println("websocket origin rejected,", r.Header.Get("Origin"), r.RemoteAddr)
+		writeError(w, http.StatusForbidden, http.StatusText(http.StatusForbidden))
+		return
+	}
+
+	if h.Authenticate == nil {
+		log.Println("websocket handler has no authenticator")
+		writeError(w, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		return
+	}
+	uid, err := h.Authenticate(r)
+	if err != nil || uid == "" {
+		log.Println("websocket authentication failed,", err)
+		writeError(w, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return
+	}
+
+	if h.SingleConnection {
+		if !h.reserve(uid) {
+			log.Println("conflict, connection already exists,", uid)
+			writeError(w, http.StatusConflict, "connection already exists")
+			return
+		}
+		defer h.release(uid)
+	}
+
+	u := ws.HTTPUpgrader{}
+	if len(h.Protocols) > 0 {
+		u.Protocol = h.acceptsProtocol
+	}
+	var deflate wsflate.Parameters
+	var compressed bool
+	if cfg := h.Compression; cfg != nil {
+		u.Negotiate = func(opt httphead.Option) (httphead.Option, error) {
+			return cfg.negotiate(opt, &deflate, &compressed)
+		}
+	}
+	conn, _, _, err := u.Upgrade(r, w)
+	if err != nil {
+		// the upgrader has already responded
+		log.Println(errs.Wrap(err, "couldn't upgrade websocket"))
+		return
+	}
+
+	cc := WrapConn(conn)
+	if compressed {
+		cc = flateConn{
+			wrappedConn: wrappedConn{conn: conn},
+			state:       &deflateState{cfg: *h.Compression, params: deflate},
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewConnection(uid, cc)
+	c.onDone(cancel)
+
+	c.SetReadLimits(h.ReadLimits)
+	if h.Limiter != nil {
+		c.Limit(h.Limiter)
+	}
+
+	if h.OnConnect != nil {
+		if err := h.OnConnect(ctx, c, r); err != nil {
+			log.Println("websocket connect hook failed for", uid, err)
+			c.cleanUp()
+			return
+		}
+	}
+
+	if h.Poller != nil {
+		if h.Router != nil {
+			err = h.Poller.Serve(ctx, c, h.Router)
+		} else {
+			err = h.Poller.Read(ctx, c, h.MsgCh)
+		}
+		if err != nil {
+			log.Println("failed to poll websocket for", uid, err)
+			c.cleanUp()
+		}
+		return
+	}
+	if h.Router != nil {
+		go h.Router.Serve(ctx, c)
+		return
+	}
+	if err := c.Read(ctx, h.MsgCh); err != nil {
+		log.Println("failed to read websocket for", uid, err)
+		c.cleanUp()
+	}
+}
+
+func (h *Handler) acceptsProtocol(p string) bool {
+	for _, v := range h.Protocols {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// claims uid for an upgrade, false if it is connected or already upgrading
+func (h *Handler) reserve(uid string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.upgrading == nil {
+		h.upgrading = make(map[string]struct{})
+	}
+	if _, ok := h.upgrading[uid]; ok {
+		return false
+	}
+	if _, ok := Lookup(uid); ok {
+		return false
+	}
+	h.upgrading[uid] = struct{}{}
+	return true
+}
+
+func (h *Handler) release(uid string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.upgrading, uid)
+}
+
+// wraps an upgraded connection, cleaning up closes it
+func WrapConn(conn io.ReadWriteCloser) CleanableConnection {
+	return wrappedConn{conn: conn}
+}
+
+type wrappedConn struct {
+	conn io.ReadWriteCloser
+}
+
+func (w wrappedConn) GetConnection() io.ReadWriteCloser {
+	return w.conn
+}
+
+func (w wrappedConn) CleanUp(uid string) error {
+	return w.conn.Close()
+}
+
+// responds with a json error body
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serves h until the test ends, then waits for every ServeHTTP call to return and for
+// every connection it made to stop reading, so the next test can swap Server
+func serveHandler(t *testing.T, h *Handler) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	var conns []*ConnectedClient
+	onConnect := h.OnConnect
+	h.OnConnect = func(ctx context.Context, c *ConnectedClient, r *http.Request) error {
+		mu.Lock()
+		conns = append(conns, c)
+		mu.Unlock()
+		if onConnect != nil {
+			return onConnect(ctx, c, r)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		wg.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			// the read loop is done with Server once the failed read cleaned up
+			_ = c.conn.GetConnection().Close()
+			select {
+			case <-c.Done():
+			case <-time.After(time.Second):
+				t.Errorf("connection for %s still reading", c.UID())
+			}
+		}
+	})
+	return srv
+}
+
+func TestHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	type echo struct {
+		Text string `json:"text"`
+	}
+	r := NewRouter()
+	r.HandleCall("echo", func(ctx context.Context, c *ConnectedClient, e echo) (echo, error) {
+		return e, nil
+	})
+	connected := make(chan string, 1)
+	h := NewHandler(func(req *http.Request) (string, error) {
+		uid := req.Header.Get("X-User")
+		if uid == "" {
+			return "", errors.New("no user")
+		}
+		return uid, nil
+	}, r)
+	h.OnConnect = func(ctx context.Context, c *ConnectedClient, req *http.Request) error {
+		connected <- c.UID()
+		return nil
+	}
+	srv := serveHandler(t, h)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	// unauthenticated
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %v %v", resp, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User": {"handler-uid"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case uid := <-connected:
+		if uid != "handler-uid" {
+			t.Fatalf("expected handler-uid, got %s", uid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected connect hook to be called")
+	}
+	c, ok := Lookup("handler-uid")
+	if !ok {
+		t.Fatal("expected connection to be registered")
+	}
+
+	// second connection for the same uid, refused when single connection is set
+	single := NewHandler(h.Authenticate, r)
+	single.SingleConnection = true
+	singleSrv := serveHandler(t, single)
+	_, resp, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(singleSrv.URL, "http"), http.Header{"X-User": {"handler-uid"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("expected 409, got %v %v", resp, err)
+	}
+	other, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User": {"handler-uid"}})
+	if err != nil {
+		t.Fatalf("second device should connect, got %v", err)
+	}
+	<-connected
+	second, _ := Lookup("handler-uid")
+	if second == c {
+		t.Fatal("expected the newest connection to be looked up")
+	}
+	other.Close()
+	select {
+	case <-second.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected second connection to be cleaned up")
+	}
+	if cur, ok := Lookup("handler-uid"); ok && cur == second {
+		t.Fatal("expected second connection to be removed")
+	}
+
+	b, _ := envelope.Marshal("echo", echo{Text: "hi"})
+	e, _ := envelope.Parse(b)
+	e.ID = "1"
+	if err := conn.WriteJSON(e); err != nil {
+		t.Fatal(err)
+	}
+	var res envelope.Envelope
+	if err := conn.ReadJSON(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Type != envelope.TypeResult || res.ID != "1" || string(res.Payload) != `{"text":"hi"}` {
+		t.Fatalf("unexpected result %+v", res)
+	}
+
+	conn.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be cleaned up")
+	}
+	if _, ok := Lookup("handler-uid"); ok {
+		t.Fatal("expected connection to be removed")
+	}
+}
+
+func TestHandlerConnectFails(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	h := NewHandler(func(req *http.Request) (string, error) { return "refused-uid", nil }, nil)
+	h.OnConnect = func(ctx context.Context, c *ConnectedClient, req *http.Request) error {
+		return errors.New("refused")
+	}
+	srv := serveHandler(t, h)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected connection to be closed")
+	}
+	if _, ok := Lookup("refused-uid"); ok {
+		t.Fatal("expected connection to be removed")
+	}
+}
+
+func TestHandlerProtocols(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	h := NewHandler(func(req *http.Request) (string, error) { return "protocol-uid", nil }, nil)
+	h.Protocols = []string{"bearer"}
+	srv := serveHandler(t, h)
+
+	d := websocket.Dialer{Subprotocols: []string{"bearer", "token"}}
+	conn, resp, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if p := resp.Header.Get("Sec-WebSocket-Protocol"); p != "bearer" {
+		t.Fatalf("expected bearer to be negotiated, got %q", p)
+	}
+}
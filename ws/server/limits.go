@@ -0,0 +1,133 @@
+package server
+
+import (
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsflate"
+	"github.com/gobwas/ws/wsutil"
+	"io"
+	"io/ioutil"
+	"unicode/utf8"
+)
+
+var (
+	ErrMessageTooBig = errors.New("message exceeds the maximum size")
+	ErrTooManyFrames = errors.New("message exceeds the maximum number of frames")
+)
+
+// ReadLimits bounds the messages read from clients, zero fields are unlimited
+type ReadLimits struct {
+	MaxMessageSize int64 // bytes, summed over every frame of a fragmented message
+	MaxFrames      int
+}
+
+func (l ReadLimits) enabled() bool {
+	return l.MaxMessageSize > 0 || l.MaxFrames > 0
+}
+
+// implemented by WebsocketIO that can enforce ReadLimits
+type LimitedReader interface {
+	ReadLimited(c *CleanableConnection, l ReadLimits) ([]byte, error)
+}
+
+// reads the next client message, refusing it from the frame headers before its payload
+// is buffered when it exceeds l. Compressed messages are also refused once they inflate
+// past MaxMessageSize
+func (w websock) ReadLimited(c *CleanableConnection, l ReadLimits) ([]byte, error) {
+	rw := (*c).GetConnection()
+	control := wsutil.ControlFrameHandler(rw, ws.StateServerSide)
+
+	var size int64
+	var frames int
+	check := func(hdr ws.Header) error {
+		frames++
+		size += hdr.Length
+		if l.MaxFrames > 0 && frames > l.MaxFrames {
+			return ErrTooManyFrames
+		}
+		if l.MaxMessageSize > 0 && size > l.MaxMessageSize {
+			return ErrMessageTooBig
+		}
+		return nil
+	}
+	rd := wsutil.Reader{
+		Source:         rw,
+		State:          ws.StateServerSide,
+		CheckUTF8:      true,
+		OnIntermediate: control,
+		OnContinuation: func(hdr ws.Header, _ io.Reader) error {
+			return check(hdr)
+		},
+	}
+	var deflate *deflateState
+	var msg wsflate.MessageState
+	if cc, ok := (*c).(compressedConn); ok {
+		deflate = cc.compression()
+		rd.State = rd.State.Set(ws.StateExtended)
+		rd.Extensions = []wsutil.RecvExtension{&msg}
+		// compressed payloads are checked once inflated
+		rd.CheckUTF8 = false
+	}
+
+	for {
+		hdr, err := rd.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := control(hdr, &rd); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if hdr.OpCode&(ws.OpText|ws.OpBinary) == 0 {
+			if err := rd.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		size, frames = 0, 0
+		if err := check(hdr); err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(&rd)
+		if err != nil || deflate == nil {
+			return b, err
+		}
+		if msg.IsCompressed() {
+			if b, err = deflate.decompress(b, l.MaxMessageSize); err != nil {
+				return nil, err
+			}
+		}
+		if hdr.OpCode == ws.OpText && !utf8.Valid(b) {
+			return nil, wsutil.ErrInvalidUTF8
+		}
+		return b, nil
+	}
+}
+
+// bounds the messages read from the connection, must be set before Read
+func (c *ConnectedClient) SetReadLimits(l ReadLimits) {
+	c.readLimits = l
+}
+
+func (c *ConnectedClient) readMessage() ([]byte, error) {
+	if lr, ok := Server.(LimitedReader); ok && c.readLimits.enabled() {
+		return lr.ReadLimited(&c.conn, c.readLimits)
+	}
+	return Server.ReadMessage(&c.conn)
+}
+
+// closes the connection after a failed read, with the status code RFC 6455 gives
+// the violation if there is one
+func (c *ConnectedClient) readFailed(err error) {
+	switch {
+	case errors.Is(err, ErrMessageTooBig), errors.Is(err, ErrTooManyFrames):
+		_ = c.CloseWith(ws.StatusMessageTooBig, err.Error())
+	case errors.Is(err, wsutil.ErrInvalidUTF8):
+		_ = c.CloseWith(ws.StatusInvalidFramePayloadData, "invalid utf-8")
+	default:
+		c.cleanUp()
+	}
+}
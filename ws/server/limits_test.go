@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// reads client frames from a buffer, discarding writes
+type frameConn struct {
+	bytes.Buffer
+}
+
+func (f *frameConn) GetConnection() io.ReadWriteCloser { return f }
+func (f *frameConn) CleanUp(uid string) error          { return nil }
+func (f *frameConn) Write(p []byte) (int, error)       { return len(p), nil }
+func (f *frameConn) Close() error                      { return nil }
+
+func frames(t *testing.T, parts ...string) *frameConn {
+	t.Helper()
+	f := &frameConn{}
+	for i, p := range parts {
+		op := ws.OpContinuation
+		if i == 0 {
+			op = ws.OpText
+		}
+		fr := ws.MaskFrame(ws.NewFrame(op, i == len(parts)-1, []byte(p)))
+		checkErr(t, ws.WriteFrame(&f.Buffer, fr))
+	}
+	return f
+}
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name   string
+		parts  []string
+		limits ReadLimits
+		err    error
+	}{
+		{"within limits", []string{"hello", " ", "world"}, ReadLimits{MaxMessageSize: 11, MaxFrames: 3}, nil},
+		{"unlimited", []string{"hello", " ", "world"}, ReadLimits{}, nil},
+		{"single frame too big", []string{"hello world"}, ReadLimits{MaxMessageSize: 10}, ErrMessageTooBig},
+		{"fragments too big", []string{"hello", " ", "world"}, ReadLimits{MaxMessageSize: 10}, ErrMessageTooBig},
+		{"too many frames", []string{"hello", " ", "world"}, ReadLimits{MaxFrames: 2}, ErrTooManyFrames},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c CleanableConnection = frames(t, tt.parts...)
+			b, err := websock{}.ReadLimited(&c, tt.limits)
+			if err != tt.err {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if err == nil && string(b) != strings.Join(tt.parts, "") {
+				t.Fatalf("unexpected message %q", b)
+			}
+		})
+	}
+}
+
+func TestHandlerReadLimits(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	h := NewHandler(func(req *http.Request) (string, error) { return req.Header.Get("X-User"), nil }, NewRouter())
+	h.ReadLimits = ReadLimits{MaxMessageSize: 16, MaxFrames: 4}
+	srv := serveHandler(t, h)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	tests := []struct {
+		uid  string
+		msg  []byte
+		code int
+	}{
+		{"too-big-uid", []byte(strings.Repeat("a", 17)), websocket.CloseMessageTooBig},
+		{"bad-utf8-uid", []byte{'a', 0xff, 0xfe}, websocket.CloseInvalidFramePayloadData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.uid, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-User": {tt.uid}})
+			checkErr(t, err)
+			defer conn.Close()
+
+			checkErr(t, conn.WriteMessage(websocket.TextMessage, tt.msg))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err = conn.ReadMessage()
+			if !websocket.IsCloseError(err, tt.code) {
+				t.Fatalf("expected close %d, got %v", tt.code, err)
+			}
+			eventually(t, "connection to be removed", func() bool {
+				_, ok := Lookup(tt.uid)
+				return !ok
+			})
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+var (
+	ErrPollerUnsupported = errors.New("poller is only supported on linux")
+	ErrNotPollable       = errors.New("connection has no file descriptor to poll")
+	ErrPollerClosed      = errors.New("poller is closed")
+)
+
+// Serve dispatches every message read from c to r on the poller's workers, the
+// poller equivalent of Router.Serve
+func (p *Poller) Serve(ctx context.Context, c *ConnectedClient, r *Router) error {
+	return p.add(ctx, c, func(m []byte) {
+		if err := r.Dispatch(ctx, c, m); err != nil {
+			log.Println("failed to handle message from", c.UID(), err)
+		}
+	})
+}
+
+// Read sends every message read from c to msgCh, the poller equivalent of
+// ConnectedClient.Read. A full msgCh holds up one of the poller's workers
+func (p *Poller) Read(ctx context.Context, c *ConnectedClient, msgCh chan Msg) error {
+	return p.add(ctx, c, func(m []byte) {
+		if msgCh == nil {
+			return
+		}
+		select {
+		case msgCh <- Msg{From: c.uid, Data: m}:
+		case <-ctx.Done():
+		}
+	})
+}
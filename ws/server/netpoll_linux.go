@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Poller reads connections without a goroutine each. Idle connections are registered
+// with epoll, only once one is readable does a goroutine from a bounded pool of
+// workers read its next message
+type Poller struct {
+	// bounds reading a message once a connection is readable, so a client sending
+	// part of a frame can't hold a worker. Unbounded when zero
+	ReadTimeout time.Duration
+
+	epfd  int
+	wake  [2]int // pipe, written to by Close to stop wait
+	ready chan *pollConn
+
+	mu     sync.Mutex
+	conns  map[int]*pollConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type pollConn struct {
+	ctx    context.Context
+	c      *ConnectedClient
+	fd     int
+	handle func(m []byte)
+}
+
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// creates a Poller reading with workers goroutines, connections wait for a free worker
+// when every worker is busy. Reading a message times out after 10 seconds
+func NewPoller(workers int) (*Poller, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &Poller{
+		ReadTimeout: time.Second * 10,
+		epfd:        epfd,
+		ready:       make(chan *pollConn, workers),
+		conns:       make(map[int]*pollConn),
+	}
+	if err := syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], &ev); err != nil {
+		p.closeFds()
+		return nil, err
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	go p.wait()
+	return p, nil
+}
+
+// number of connections registered
+func (p *Poller) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// stops polling and closes every registered connection, returning once the poller's
+// goroutines have
+func (p *Poller) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPollerClosed
+	}
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[int]*pollConn)
+	p.mu.Unlock()
+
+	_, err := syscall.Write(p.wake[1], []byte{0})
+	// workers reading these fail and go back for the next connection
+	for _, pc := range conns {
+		pc.c.cleanUp()
+		_ = pc.c.conn.GetConnection().Close()
+	}
+	// wait closes ready once woken, the workers return once it's drained
+	p.wg.Wait()
+	if cerr := p.closeFds(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (p *Poller) closeFds() error {
+	err := syscall.Close(p.epfd)
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	return err
+}
+
+func (p *Poller) add(ctx context.Context, c *ConnectedClient, handle func(m []byte)) error {
+	if c.conn == nil {
+		return ErrNotPollable
+	}
+	fd, err := connFd(c.conn.GetConnection())
+	if err != nil {
+		return err
+	}
+	pc := &pollConn{ctx: ctx, c: c, fd: fd, handle: handle}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPollerClosed
+	}
+	ev := syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	p.conns[fd] = pc
+	p.mu.Unlock()
+
+	// however the connection ends, e.g. closed by a write failing or credentials expiring
+	c.onDone(func() { p.remove(pc) })
+	return nil
+}
+
+// waits for readable connections and hands them to the workers
+func (p *Poller) wait() {
+	defer close(p.ready)
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Println("failed to wait for readable connections,", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			if int(events[i].Fd) == p.wake[0] {
+				// closed
+				return
+			}
+			p.mu.Lock()
+			pc, ok := p.conns[int(events[i].Fd)]
+			p.mu.Unlock()
+			if ok {
+				p.ready <- pc
+			}
+		}
+	}
+}
+
+func (p *Poller) work() {
+	defer p.wg.Done()
+	for pc := range p.ready {
+		p.serve(pc)
+	}
+}
+
+// reads one message from a readable connection, then rearms it
+func (p *Poller) serve(pc *pollConn) {
+	c := pc.c
+	if pc.ctx.Err() != nil {
+		p.remove(pc)
+		_ = c.conn.GetConnection().Close()
+		return
+	}
+
+	dl, hasDeadline := c.conn.GetConnection().(readDeadliner)
+	hasDeadline = hasDeadline && p.ReadTimeout > 0
+	if hasDeadline {
+		_ = dl.SetReadDeadline(time.Now().Add(p.ReadTimeout))
+	}
+	m, err := c.readMessage()
+	if err != nil {
+		c.readFailed(err)
+		_ = c.conn.GetConnection().Close()
+		return
+	}
+	if hasDeadline {
+		_ = dl.SetReadDeadline(time.Time{})
+	}
+	if c.limiter == nil || c.limiter.Allow(c) {
+		pc.handle(m)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.conns[pc.fd]; !ok {
+		return
+	}
+	ev := syscall.EpollEvent{Events: pollEvents, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &ev); err != nil {
+		log.Println("failed to rearm connection for", c.UID(), err)
+	}
+}
+
+// implemented by net.Conn
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// unregisters a connection, its fd may have been closed and reused by another already
+func (p *Poller) remove(pc *pollConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur, ok := p.conns[pc.fd]; ok && cur == pc {
+		delete(p.conns, pc.fd)
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	}
+}
+
+// file descriptor of a connection backed by a socket
+func connFd(conn io.ReadWriteCloser) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrNotPollable
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
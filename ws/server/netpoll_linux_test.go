@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/broker"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// a connected pair of unix sockets, both backed by file descriptors
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	checkErr(t, err)
+	conn := func(fd int) net.Conn {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		defer f.Close()
+		c, err := net.FileConn(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	return conn(fds[0]), conn(fds[1])
+}
+
+func TestPoller(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	p, err := NewPoller(2)
+	checkErr(t, err)
+	defer p.Close()
+
+	srv, cli := socketPair(t)
+	c := NewConnection("poll-uid", WrapConn(srv))
+	msgCh := make(chan Msg, 10)
+	checkErr(t, p.Read(context.Background(), c, msgCh))
+	if p.Len() != 1 {
+		t.Fatalf("expected 1 connection, got %d", p.Len())
+	}
+
+	// the connection is rearmed after every message
+	for _, m := range []string{"one", "two", "three"} {
+		checkErr(t, wsutil.WriteClientText(cli, []byte(m)))
+		select {
+		case got := <-msgCh:
+			if string(got.Data) != m || got.From != "poll-uid" {
+				t.Fatalf("expected %s, got %+v", m, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to be read", m)
+		}
+	}
+
+	// writes still go straight to the connection
+	checkErr(t, c.Write([]byte("reply")))
+	b, err := wsutil.ReadServerText(cli)
+	checkErr(t, err)
+	if string(b) != "reply" {
+		t.Fatalf("expected reply, got %s", b)
+	}
+
+	cli.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected connection to be cleaned up once the peer closed")
+	}
+	eventually(t, "connection to be unregistered", func() bool { return p.Len() == 0 })
+
+	// closed some other way, e.g. expired
+	srv, cli = socketPair(t)
+	defer cli.Close()
+	c = NewConnection("poll-closed-uid", WrapConn(srv))
+	checkErr(t, p.Read(context.Background(), c, nil))
+	c.Close()
+	c.cleanUp()
+	if p.Len() != 0 {
+		t.Fatalf("expected connection to be unregistered, got %d", p.Len())
+	}
+
+	if err := p.Read(context.Background(), NewConnection("pipe-uid", stubConn{}), nil); err != ErrNotPollable {
+		t.Fatalf("expected not pollable, got %v", err)
+	}
+}
+
+func TestPollerClose(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	running := func() int {
+		buf := make([]byte, 1<<20)
+		stacks := string(buf[:runtime.Stack(buf, true)])
+		return strings.Count(stacks, "created by github.com/mousybusiness/go-web/ws/server.NewPoller")
+	}
+	before := running()
+
+	p, err := NewPoller(4)
+	checkErr(t, err)
+	srv, cli := socketPair(t)
+	defer cli.Close()
+	c := NewConnection("poll-close-uid", WrapConn(srv))
+	checkErr(t, p.Read(context.Background(), c, nil))
+	if n := running() - before; n != 5 {
+		t.Fatalf("expected a waiting goroutine and 4 workers, got %d", n)
+	}
+
+	checkErr(t, p.Close())
+	if n := running() - before; n != 0 {
+		t.Fatalf("expected the poller's goroutines to stop on close, %d still running", n)
+	}
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("expected registered connections to be closed")
+	}
+	if err := p.Close(); err != ErrPollerClosed {
+		t.Fatalf("expected poller closed, got %v", err)
+	}
+	srv, cli = socketPair(t)
+	defer cli.Close()
+	defer srv.Close()
+	if err := p.Read(context.Background(), NewConnection("poll-close-uid", WrapConn(srv)), nil); err != ErrPollerClosed {
+		t.Fatalf("expected poller closed, got %v", err)
+	}
+}
+
+func TestPollerReadTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	p, err := NewPoller(1)
+	checkErr(t, err)
+	defer p.Close()
+	p.ReadTimeout = time.Millisecond * 50
+
+	// half a frame header holds the only worker until the read times out
+	srv, cli := socketPair(t)
+	defer cli.Close()
+	stalled := NewConnection("poll-stalled-uid", WrapConn(srv))
+	checkErr(t, p.Read(context.Background(), stalled, nil))
+	_, err = cli.Write([]byte{0x81})
+	checkErr(t, err)
+
+	srv2, cli2 := socketPair(t)
+	defer cli2.Close()
+	c := NewConnection("poll-next-uid", WrapConn(srv2))
+	msgCh := make(chan Msg, 1)
+	checkErr(t, p.Read(context.Background(), c, msgCh))
+	checkErr(t, wsutil.WriteClientText(cli2, []byte("hi")))
+
+	select {
+	case <-stalled.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the stalled connection to be closed")
+	}
+	select {
+	case m := <-msgCh:
+		if string(m.Data) != "hi" {
+			t.Fatalf("expected hi, got %s", m.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the next connection to be read once the worker is free")
+	}
+
+	// the deadline is cleared between messages, an idle connection stays open
+	time.Sleep(p.ReadTimeout * 2)
+	select {
+	case <-c.Done():
+		t.Fatal("idle connection shouldnt time out")
+	default:
+	}
+}
+
+func TestHandlerPoller(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	p, err := NewPoller(2)
+	checkErr(t, err)
+	defer p.Close()
+
+	type echo struct {
+		Text string `json:"text"`
+	}
+	r := NewRouter()
+	r.HandleCall("echo", func(ctx context.Context, c *ConnectedClient, e echo) (echo, error) {
+		return e, nil
+	})
+	h := NewHandler(func(req *http.Request) (string, error) { return "handler-poll-uid", nil }, r)
+	h.Poller = p
+	srv := serveHandler(t, h)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	checkErr(t, err)
+	checkErr(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"echo","id":"1","payload":{"text":"hi"}}`)))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := conn.ReadMessage()
+	checkErr(t, err)
+	if string(b) != `{"type":"result","id":"1","payload":{"text":"hi"}}` {
+		t.Fatalf("unexpected result %s", b)
+	}
+
+	conn.Close()
+	eventually(t, "connection to be unregistered", func() bool {
+		_, ok := Lookup("handler-poll-uid")
+		return !ok && p.Len() == 0
+	})
+}
+
+// memory and goroutines held per idle connection, read by a goroutine each or by the
+// poller, alone or with the features tracking connections until they are done
+func BenchmarkIdleConnections(b *testing.B) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+	const n = 2000
+
+	heap := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapInuse + m.StackInuse
+	}
+
+	run := func(b *testing.B, read func(c *ConnectedClient) error) {
+		for i := 0; i < b.N; i++ {
+			peers := make([]net.Conn, 0, n)
+			conns := make([]*ConnectedClient, 0, n)
+			for j := 0; j < n; j++ {
+				fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for k, fd := range fds {
+					f := os.NewFile(uintptr(fd), "socketpair")
+					nc, err := net.FileConn(f)
+					f.Close()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if k == 0 {
+						conns = append(conns, &ConnectedClient{uid: "bench", conn: WrapConn(nc), done: make(chan struct{})})
+					} else {
+						peers = append(peers, nc)
+					}
+				}
+			}
+
+			before, goroutines := heap(), runtime.NumGoroutine()
+			for _, c := range conns {
+				if err := read(c); err != nil {
+					b.Fatal(err)
+				}
+			}
+			time.Sleep(time.Millisecond * 50) // let the readers block
+			after := heap()
+			b.ReportMetric(float64(after-before)/n, "B/conn")
+			b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/n, "goroutines/conn")
+
+			for j := range conns {
+				peers[j].Close()
+				<-conns[j].Done()
+			}
+		}
+	}
+
+	b.Run("goroutine", func(b *testing.B) {
+		run(b, func(c *ConnectedClient) error {
+			return c.Read(context.Background(), nil)
+		})
+	})
+	b.Run("epoll", func(b *testing.B) {
+		p, err := NewPoller(runtime.NumCPU())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer p.Close()
+		run(b, func(c *ConnectedClient) error {
+			return p.Read(context.Background(), c, nil)
+		})
+	})
+	b.Run("epoll with features", func(b *testing.B) {
+		p, err := NewPoller(runtime.NumCPU())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer p.Close()
+		br := broker.NewMemory()
+		defer br.Close()
+
+		ctx := context.Background()
+		limiter := NewRateLimiter(Rate{PerSecond: 10, Burst: 20}, Rate{}, LimitDrop)
+		ss := NewSessions(10, time.Minute)
+		cl := NewCluster(br, ss)
+		presence := NewPresence(nil, 0)
+		expiry := NewExpiry(nil, time.Minute)
+		run(b, func(c *ConnectedClient) error {
+			c.Limit(limiter)
+			limiter.Allow(c)
+			if _, err := ss.Attach(c); err != nil {
+				return err
+			}
+			if err := cl.Register(ctx, c); err != nil {
+				return err
+			}
+			if err := cl.Subscribe(ctx, c, "news"); err != nil {
+				return err
+			}
+			if _, err := presence.Connect(ctx, c, "", nil); err != nil {
+				return err
+			}
+			expiry.Track(c, time.Now().Add(time.Hour))
+			return p.Read(ctx, c, nil)
+		})
+	})
+}
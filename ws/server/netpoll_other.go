@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// Poller is only available on linux
+type Poller struct {
+	ReadTimeout time.Duration
+}
+
+// always fails with ErrPollerUnsupported outside linux
+func NewPoller(workers int) (*Poller, error) {
+	return nil, ErrPollerUnsupported
+}
+
+func (p *Poller) Close() error {
+	return ErrPollerUnsupported
+}
+
+func (p *Poller) Len() int {
+	return 0
+}
+
+func (p *Poller) add(ctx context.Context, c *ConnectedClient, handle func(m []byte)) error {
+	return ErrPollerUnsupported
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginChecker decides whether an upgrade request's Origin is allowed
+type OriginChecker func(r *http.Request) bool
+
+// allows requests without an Origin header, which browsers always send, and those
+// whose Origin host matches the request's Host
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// allows requests from the listed origins and those without an Origin header. An
+// origin is either exact, "https://app.example.com", or matches any subdomain,
+// "https://*.example.com", the scheme may be left out to allow any. "*" allows all
+func AllowOrigins(origins ...string) OriginChecker {
+	patterns := make([]string, len(origins))
+	for i, o := range origins {
+		patterns[i] = strings.ToLower(strings.TrimSuffix(o, "/"))
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(strings.ToLower(origin))
+		if err != nil || u.Host == "" {
+			return false
+		}
+		for _, p := range patterns {
+			if matchOrigin(p, u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchOrigin(pattern string, u *url.URL) bool {
+	if pattern == "*" {
+		return true
+	}
+	host := pattern
+	if i := strings.Index(pattern, "://"); i >= 0 {
+		if pattern[:i] != u.Scheme {
+			return false
+		}
+		host = pattern[i+3:]
+	}
+	if strings.HasPrefix(host, "*.") {
+		// the bare domain isn't a subdomain of itself
+		return strings.HasSuffix(u.Host, host[1:])
+	}
+	return u.Host == host
+}
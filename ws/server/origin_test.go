@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowOrigins(t *testing.T) {
+	check := AllowOrigins("https://app.example.com", "https://*.example.org", "*.example.net", "http://localhost:3000")
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"https://app.example.com", true},
+		{"https://APP.example.com/", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://a.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://a.example.net", true},
+		{"https://a.example.net", true},
+		{"http://localhost:3000", true},
+		{"http://localhost:4000", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/connect", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if ok := check(r); ok != tt.ok {
+			t.Errorf("origin %q: expected %v, got %v", tt.origin, tt.ok, ok)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/connect", nil)
+	r.Header.Set("Origin", "https://anything.com")
+	if !AllowOrigins("*")(r) {
+		t.Error("expected * to allow every origin")
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://api.example.com/connect", nil)
+	if !SameOrigin(r) {
+		t.Error("expected request without origin to be allowed")
+	}
+	r.Header.Set("Origin", "https://api.example.com")
+	if !SameOrigin(r) {
+		t.Error("expected same origin to be allowed")
+	}
+	r.Header.Set("Origin", "https://evil.com")
+	if SameOrigin(r) {
+		t.Error("expected other origin to be rejected")
+	}
+}
+
+func TestHandlerRejectsOrigin(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+	Server = websock{}
+
+	authenticated := false
+	h := NewHandler(func(req *http.Request) (string, error) {
+		authenticated = true
+		return "origin-uid", nil
+	}, nil)
+	h.CheckOrigin = AllowOrigins("https://app.example.com")
+	srv := serveHandler(t, h)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v %v", resp, err)
+	}
+	if authenticated {
+		t.Fatal("expected origin to be checked before authenticating")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/broker"
+	errs "github.com/pkg/errors"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Device is one connection of an online user
+type Device struct {
+	UID         string            `json:"uid"`
+	ID          string            `json:"id"`
+	Node        string            `json:"node"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// PresenceEvent reports a device going online or offline
+type PresenceEvent struct {
+	Online bool
+	Device Device
+	Time   time.Time
+}
+
+// Presence records which users are online and on which devices. With a Broker every
+// node announces its devices, so the view covers devices connected to any node
+type Presence struct {
+	Broker    broker.Broker // nil when running a single node
+	Node      string
+	Heartbeat time.Duration // remote devices not announced for 3 heartbeats go offline
+	Channel   string        // broker channel presence is announced on
+
+	mu       sync.RWMutex
+	devices  map[deviceKey]Device
+	owners   map[deviceKey]*ConnectedClient // connection holding each local device
+	seen     map[string]time.Time           // last announcement per remote node
+	watchers map[chan PresenceEvent]struct{}
+}
+
+type deviceKey struct {
+	uid, id string
+}
+
+// presence announcement exchanged between nodes
+type presenceMsg struct {
+	Kind    string   `json:"kind"` // online, offline, heartbeat, sync or leave
+	Node    string   `json:"node"`
+	Devices []Device `json:"devices,omitempty"`
+}
+
+// creates Presence announcing on b every heartbeat, b may be nil
+func NewPresence(b broker.Broker, heartbeat time.Duration) *Presence {
+	if heartbeat <= 0 {
+		heartbeat = time.Second * 10
+	}
+	node, _ := os.Hostname()
+	if id, err := newSessionID(); err == nil {
+		node += "-" + id[:8]
+	}
+	return &Presence{
+		Broker:    b,
+		Node:      node,
+		Heartbeat: heartbeat,
+		Channel:   "ws:presence",
+		devices:   make(map[deviceKey]Device),
+		owners:    make(map[deviceKey]*ConnectedClient),
+		seen:      make(map[string]time.Time),
+		watchers:  make(map[chan PresenceEvent]struct{}),
+	}
+}
+
+// subscribes to announcements from other nodes and announces this node every heartbeat
+// until ctx is done, when its devices are withdrawn
+func (p *Presence) Start(ctx context.Context) error {
+	if p.Broker == nil {
+		return nil
+	}
+
+	sub, err := p.Broker.Subscribe(ctx, p.Channel, p.receive)
+	if err != nil {
+		return errs.Wrap(err, "failed to subscribe to presence")
+	}
+	// ask the other nodes for their devices rather than wait a heartbeat
+	p.publish(ctx, presenceMsg{Kind: "sync"})
+
+	go func() {
+		defer sub.Unsubscribe()
+		t := time.NewTicker(p.Heartbeat)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				p.publish(context.Background(), presenceMsg{Kind: "leave", Devices: p.local()})
+				return
+			case <-t.C:
+				p.publish(ctx, presenceMsg{Kind: "heartbeat", Devices: p.local()})
+				p.expire(time.Now())
+			}
+		}
+	}()
+	return nil
+}
+
+// records c as online on deviceID, which defaults to a random id, until c is cleaned up.
+// A device reconnecting replaces its previous connection, which no longer takes it offline
+func (p *Presence) Connect(ctx context.Context, c *ConnectedClient, deviceID string, meta map[string]string) (Device, error) {
+	if deviceID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return Device{}, err
+		}
+		deviceID = id
+	}
+
+	d := Device{UID: c.uid, ID: deviceID, Node: p.Node, ConnectedAt: time.Now(), Meta: meta}
+	k := deviceKey{d.UID, d.ID}
+	p.mu.Lock()
+	prev, known := p.devices[k]
+	known = known && prev.Node == p.Node
+	p.devices[k] = d
+	p.owners[k] = c
+	p.mu.Unlock()
+	if !known {
+		p.notify(PresenceEvent{Online: true, Device: d, Time: d.ConnectedAt})
+	}
+	p.publish(ctx, presenceMsg{Kind: "online", Devices: []Device{d}})
+
+	c.onDone(func() { p.disconnect(context.Background(), c, d.UID, d.ID) })
+	return d, nil
+}
+
+// records deviceID of uid as offline
+func (p *Presence) Disconnect(ctx context.Context, uid, deviceID string) {
+	p.disconnect(ctx, nil, uid, deviceID)
+}
+
+// takes deviceID offline unless owner is set and the device has reconnected since
+func (p *Presence) disconnect(ctx context.Context, owner *ConnectedClient, uid, deviceID string) {
+	k := deviceKey{uid, deviceID}
+	p.mu.Lock()
+	d, ok := p.devices[k]
+	if ok = ok && d.Node == p.Node && (owner == nil || p.owners[k] == owner); ok {
+		delete(p.devices, k)
+		delete(p.owners, k)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	p.notify(PresenceEvent{Online: false, Device: d, Time: time.Now()})
+	p.publish(ctx, presenceMsg{Kind: "offline", Devices: []Device{d}})
+}
+
+// true when uid has a device connected to any node
+func (p *Presence) IsOnline(uid string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for k := range p.devices {
+		if k.uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// devices uid is connected on, oldest first
+func (p *Presence) Devices(uid string) []Device {
+	p.mu.RLock()
+	var out []Device
+	for k, d := range p.devices {
+		if k.uid == uid {
+			out = append(out, d)
+		}
+	}
+	p.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// uids with at least one device online, sorted
+func (p *Presence) ListOnline() []string {
+	p.mu.RLock()
+	set := make(map[string]struct{})
+	for k := range p.devices {
+		set[k.uid] = struct{}{}
+	}
+	p.mu.RUnlock()
+
+	out := make([]string, 0, len(set))
+	for uid := range set {
+		out = append(out, uid)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// streams presence changes until ctx is done, events are dropped if the
+// receiver falls more than buffer events behind
+func (p *Presence) Watch(ctx context.Context, buffer int) <-chan PresenceEvent {
+	ch := make(chan PresenceEvent, buffer)
+	p.mu.Lock()
+	p.watchers[ch] = struct{}{}
+	p.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		delete(p.watchers, ch)
+		p.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func (p *Presence) notify(e PresenceEvent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for ch := range p.watchers {
+		select {
+		case ch <- e:
+		default:
+			log.Println("presence watcher is full, dropping event for", e.Device.UID)
+		}
+	}
+}
+
+// devices connected to this node
+func (p *Presence) local() []Device {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	var out []Device
+	for _, d := range p.devices {
+		if d.Node == p.Node {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func (p *Presence) publish(ctx context.Context, m presenceMsg) {
+	if p.Broker == nil {
+		return
+	}
+	m.Node = p.Node
+	b, err := json.Marshal(m)
+	if err != nil {
+		log.Println("failed to marshal presence,", err)
+		return
+	}
+	if err := p.Broker.Publish(ctx, p.Channel, b); err != nil {
+		log.Println("failed to publish presence,", err)
+	}
+}
+
+// applies an announcement from another node
+func (p *Presence) receive(b []byte) {
+	var m presenceMsg
+	if err := json.Unmarshal(b, &m); err != nil {
+		log.Println("invalid presence announcement,", err)
+		return
+	}
+	if m.Node == p.Node {
+		return
+	}
+
+	now := time.Now()
+	switch m.Kind {
+	case "sync":
+		p.publish(context.Background(), presenceMsg{Kind: "heartbeat", Devices: p.local()})
+		return
+	case "online":
+		p.add(m.Devices, now)
+	case "offline":
+		p.remove(m.Devices, now)
+	case "heartbeat":
+		// the heartbeat is the node's full list, anything missing went offline
+		p.replace(m.Node, m.Devices, now)
+	case "leave":
+		p.replace(m.Node, nil, now)
+		p.mu.Lock()
+		delete(p.seen, m.Node)
+		p.mu.Unlock()
+		return
+	}
+
+	p.mu.Lock()
+	p.seen[m.Node] = now
+	p.mu.Unlock()
+}
+
+func (p *Presence) add(devices []Device, now time.Time) {
+	for _, d := range devices {
+		k := deviceKey{d.UID, d.ID}
+		p.mu.Lock()
+		_, known := p.devices[k]
+		p.devices[k] = d
+		if d.Node != p.Node {
+			// the device moved to another node, its connection here no longer holds it
+			delete(p.owners, k)
+		}
+		p.mu.Unlock()
+		if !known {
+			p.notify(PresenceEvent{Online: true, Device: d, Time: now})
+		}
+	}
+}
+
+func (p *Presence) remove(devices []Device, now time.Time) {
+	for _, d := range devices {
+		p.mu.Lock()
+		cur, ok := p.devices[deviceKey{d.UID, d.ID}]
+		// the device may have reconnected to another node since
+		if ok = ok && cur.Node == d.Node; ok {
+			delete(p.devices, deviceKey{d.UID, d.ID})
+		}
+		p.mu.Unlock()
+		if ok {
+			p.notify(PresenceEvent{Online: false, Device: cur, Time: now})
+		}
+	}
+}
+
+// makes devices the full list of what node has connected
+func (p *Presence) replace(node string, devices []Device, now time.Time) {
+	current := make(map[deviceKey]struct{}, len(devices))
+	for _, d := range devices {
+		current[deviceKey{d.UID, d.ID}] = struct{}{}
+	}
+
+	var gone []Device
+	p.mu.RLock()
+	for k, d := range p.devices {
+		if _, ok := current[k]; !ok && d.Node == node {
+			gone = append(gone, d)
+		}
+	}
+	p.mu.RUnlock()
+
+	p.remove(gone, now)
+	p.add(devices, now)
+}
+
+// drops devices of nodes that stopped announcing
+func (p *Presence) expire(now time.Time) {
+	p.mu.Lock()
+	var dead []string
+	for node, seen := range p.seen {
+		if now.Sub(seen) > p.Heartbeat*3 {
+			dead = append(dead, node)
+			delete(p.seen, node)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, node := range dead {
+		p.replace(node, nil, now)
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"github.com/mousybusiness/go-web/ws/broker"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// waits for cond to hold
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s before timeout", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	Server = &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	p := NewPresence(nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := p.Watch(ctx, 10)
+
+	c := NewConnection("presence-uid", &tagConn{name: "phone"})
+	_, err := p.Connect(ctx, c, "phone", map[string]string{"os": "android"})
+	checkErr(t, err)
+	c2 := NewConnection("presence-uid-2", &tagConn{name: "laptop"})
+	d2, err := p.Connect(ctx, c2, "", nil)
+	checkErr(t, err)
+	if d2.ID == "" {
+		t.Fatalf("device id should be generated")
+	}
+
+	if !p.IsOnline("presence-uid") || p.IsOnline("stub") {
+		t.Fatalf("invalid online status")
+	}
+	if online := p.ListOnline(); len(online) != 2 || online[0] != "presence-uid" {
+		t.Fatalf("invalid online list: %v", online)
+	}
+	devices := p.Devices("presence-uid")
+	if len(devices) != 1 || devices[0].ID != "phone" || devices[0].Meta["os"] != "android" || devices[0].ConnectedAt.IsZero() {
+		t.Fatalf("invalid devices: %+v", devices)
+	}
+
+	// cleaning up the connection takes the device offline
+	c.cleanUp()
+	eventually(t, "device offline", func() bool { return !p.IsOnline("presence-uid") })
+
+	var got []PresenceEvent
+	for len(got) < 3 {
+		select {
+		case e := <-events:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			t.Fatalf("expected presence events, got: %+v", got)
+		}
+	}
+	if !got[0].Online || got[0].Device.ID != "phone" || got[2].Online || got[2].Device.ID != "phone" {
+		t.Fatalf("invalid presence events: %+v", got)
+	}
+
+	// watch closes with its context
+	cancel()
+	eventually(t, "watch closed", func() bool {
+		_, open := <-events
+		return !open
+	})
+	c2.cleanUp()
+}
+
+func TestPresenceReconnect(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	Server = &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	p := NewPresence(nil, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := p.Watch(ctx, 10)
+
+	old := NewConnection("reconnect-uid", &tagConn{name: "old"})
+	_, err := p.Connect(ctx, old, "phone", nil)
+	checkErr(t, err)
+
+	// the device reconnects before its old connection is cleaned up
+	cur := NewConnection("reconnect-uid", &tagConn{name: "new"})
+	d, err := p.Connect(ctx, cur, "phone", nil)
+	checkErr(t, err)
+	old.cleanUp()
+	<-old.Done()
+	time.Sleep(time.Millisecond * 10)
+
+	if devices := p.Devices("reconnect-uid"); len(devices) != 1 || devices[0].ConnectedAt != d.ConnectedAt {
+		t.Fatalf("reconnected device should stay online: %+v", devices)
+	}
+	select {
+	case e := <-events:
+		if !e.Online {
+			t.Fatalf("unexpected event: %+v", e)
+		}
+	default:
+		t.Fatalf("expected online event")
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("reconnect shouldnt send more events, got: %+v", e)
+	default:
+	}
+
+	// the current connection still takes it offline
+	cur.cleanUp()
+	eventually(t, "device offline", func() bool { return !p.IsOnline("reconnect-uid") })
+}
+
+func TestPresenceNodes(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	Server = &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	b := broker.NewMemory()
+	defer b.Close()
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	defer stopA()
+	a := NewPresence(b, time.Millisecond*10)
+	checkErr(t, a.Start(ctxA))
+
+	c := NewConnection("node-uid", &tagConn{name: "node"})
+	_, err := a.Connect(ctxA, c, "tablet", nil)
+	checkErr(t, err)
+
+	// a node started later syncs what is already online
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	bb := NewPresence(b, time.Millisecond*10)
+	checkErr(t, bb.Start(ctxB))
+	eventually(t, "remote device online", func() bool { return bb.IsOnline("node-uid") })
+	if d := bb.Devices("node-uid"); len(d) != 1 || d[0].Node != a.Node {
+		t.Fatalf("invalid remote devices: %+v", d)
+	}
+
+	// disconnects are announced
+	c.cleanUp()
+	eventually(t, "remote device offline", func() bool { return !bb.IsOnline("node-uid") })
+
+	// a stopped node withdraws its devices
+	c = NewConnection("node-uid", &tagConn{name: "node"})
+	_, err = a.Connect(ctxA, c, "tablet", nil)
+	checkErr(t, err)
+	eventually(t, "remote device online", func() bool { return bb.IsOnline("node-uid") })
+	stopA()
+	eventually(t, "node left", func() bool { return !bb.IsOnline("node-uid") })
+
+	// a node that stops announcing without leaving expires
+	checkErr(t, b.Publish(context.Background(), bb.Channel, []byte(`{"kind":"online","node":"crashed","devices":[{"uid":"ghost","id":"1","node":"crashed"}]}`)))
+	eventually(t, "crashed node device online", func() bool { return bb.IsOnline("ghost") })
+	eventually(t, "crashed node expired", func() bool { return !bb.IsOnline("ghost") })
+	c.cleanUp()
+}
+
+func TestPresenceMove(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	Server = &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	b := broker.NewMemory()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a := NewPresence(b, time.Second)
+	checkErr(t, a.Start(ctx))
+	bb := NewPresence(b, time.Second)
+	checkErr(t, bb.Start(ctx))
+
+	owned := func(p *Presence) int {
+		p.mu.RLock()
+		defer p.mu.RUnlock()
+		return len(p.owners)
+	}
+	on := func(p *Presence, node string) func() bool {
+		return func() bool {
+			d := p.Devices("move-uid")
+			return len(d) == 1 && d[0].Node == node
+		}
+	}
+
+	ca := NewConnection("move-uid", &tagConn{name: "a"})
+	_, err := a.Connect(ctx, ca, "phone", nil)
+	checkErr(t, err)
+	eventually(t, "device online on a", on(bb, a.Node))
+
+	// the device moves to the other node before its old connection is cleaned up
+	cb := NewConnection("move-uid", &tagConn{name: "b"})
+	_, err = bb.Connect(ctx, cb, "phone", nil)
+	checkErr(t, err)
+	eventually(t, "device moved to b", on(a, bb.Node))
+	if n := owned(a); n != 0 {
+		t.Fatalf("a shouldnt hold a device that moved away, owns %d", n)
+	}
+	ca.cleanUp()
+	<-ca.Done()
+	if !on(a, bb.Node)() || !on(bb, bb.Node)() {
+		t.Fatalf("old connection shouldnt take the moved device offline")
+	}
+
+	// and back again, the connection on b no longer holds it either
+	ca = NewConnection("move-uid", &tagConn{name: "a"})
+	_, err = a.Connect(ctx, ca, "phone", nil)
+	checkErr(t, err)
+	eventually(t, "device moved back to a", on(bb, a.Node))
+	eventually(t, "b released the device", func() bool { return owned(bb) == 0 })
+	cb.cleanUp()
+	<-cb.Done()
+	if !on(a, a.Node)() || !on(bb, a.Node)() {
+		t.Fatalf("connection on b shouldnt take the moved device offline")
+	}
+
+	ca.cleanUp()
+	eventually(t, "device offline", func() bool { return !a.IsOnline("move-uid") && !bb.IsOnline("move-uid") })
+	if owned(a) != 0 || owned(bb) != 0 {
+		t.Fatalf("no device should be held once offline")
+	}
+}
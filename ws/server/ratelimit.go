@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gobwas/ws"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitAction is what happens to a message over the rate limit
+type LimitAction int
+
+const (
+	// the message is silently discarded
+	LimitDrop LimitAction = iota
+	// the message is discarded and the client sent a rate_limited error envelope
+	LimitError
+	// the connection is closed with 1008 Policy Violation
+	LimitClose
+)
+
+// Rate allows PerSecond messages on average with bursts of up to Burst, a zero
+// PerSecond is unlimited
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// LimitStats counts the messages seen by a RateLimiter
+type LimitStats struct {
+	Allowed uint64
+	Limited uint64
+	Closed  uint64 // connections closed for exceeding the limit
+}
+
+// RateLimiter limits inbound messages with a token bucket per connection and another
+// per uid, shared by the uid's connections
+type RateLimiter struct {
+	PerConn Rate
+	PerUser Rate
+	Action  LimitAction
+
+	mu    sync.Mutex
+	conns map[*ConnectedClient]*bucket
+	users map[string]*userBucket
+	now   func() time.Time
+
+	allowed, limited, closed uint64
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type userBucket struct {
+	bucket
+	refs int
+}
+
+// creates a RateLimiter applying action to messages over perConn or perUser
+func NewRateLimiter(perConn, perUser Rate, action LimitAction) *RateLimiter {
+	return &RateLimiter{
+		PerConn: perConn,
+		PerUser: perUser,
+		Action:  action,
+		conns:   make(map[*ConnectedClient]*bucket),
+		users:   make(map[string]*userBucket),
+	}
+}
+
+// counters for monitoring
+func (l *RateLimiter) Stats() LimitStats {
+	return LimitStats{
+		Allowed: atomic.LoadUint64(&l.allowed),
+		Limited: atomic.LoadUint64(&l.limited),
+		Closed:  atomic.LoadUint64(&l.closed),
+	}
+}
+
+// takes a token for a message read from c, false if it is over the limit and must be
+// discarded, in which case the limiter's action has been applied
+func (l *RateLimiter) Allow(c *ConnectedClient) bool {
+	if l.take(c) {
+		atomic.AddUint64(&l.allowed, 1)
+		return true
+	}
+	atomic.AddUint64(&l.limited, 1)
+
+	switch l.Action {
+	case LimitError:
+		b, err := json.Marshal(envelope.NewError(envelope.CodeRateLimited, "rate limit exceeded"))
+		if err == nil {
+			err = c.Write(b)
+		}
+		if err != nil {
+			log.Println("failed to send rate limit error to", c.UID(), err)
+		}
+	case LimitClose:
+		atomic.AddUint64(&l.closed, 1)
+		log.Println("rate limit exceeded, closing connection for", c.UID())
+		_ = c.CloseWith(ws.StatusPolicyViolation, "rate limit exceeded")
+	}
+	return false
+}
+
+func (l *RateLimiter) take(c *ConnectedClient) bool {
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+
+	l.mu.Lock()
+	if l.conns == nil {
+		l.conns = make(map[*ConnectedClient]*bucket)
+		l.users = make(map[string]*userBucket)
+	}
+	cb, known := l.conns[c]
+	if !known {
+		cb = &bucket{}
+		l.conns[c] = cb
+		ub, ok := l.users[c.uid]
+		if !ok {
+			ub = &userBucket{}
+			l.users[c.uid] = ub
+		}
+		ub.refs++
+	}
+	ub := l.users[c.uid]
+
+	cb.refill(l.PerConn, now)
+	ub.refill(l.PerUser, now)
+	ok := cb.has(l.PerConn) && ub.has(l.PerUser)
+	if ok {
+		cb.spend(l.PerConn)
+		ub.spend(l.PerUser)
+	}
+	l.mu.Unlock()
+
+	if !known {
+		// registered without l.mu held, it runs straight away if c is already done
+		c.onDone(func() { l.forget(c) })
+	}
+	return ok
+}
+
+// drops the buckets of a closed connection, the uid's once it has none left
+func (l *RateLimiter) forget(c *ConnectedClient) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.conns[c]; !ok {
+		return
+	}
+	delete(l.conns, c)
+	if ub, ok := l.users[c.uid]; ok {
+		ub.refs--
+		if ub.refs <= 0 {
+			delete(l.users, c.uid)
+		}
+	}
+}
+
+func (b *bucket) refill(r Rate, now time.Time) {
+	if r.PerSecond <= 0 {
+		return
+	}
+	if b.last.IsZero() {
+		b.tokens = r.burst()
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * r.PerSecond
+		if b.tokens > r.burst() {
+			b.tokens = r.burst()
+		}
+	}
+	b.last = now
+}
+
+func (b *bucket) has(r Rate) bool {
+	return r.PerSecond <= 0 || b.tokens >= 1
+}
+
+func (b *bucket) spend(r Rate) {
+	if r.PerSecond > 0 {
+		b.tokens--
+	}
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
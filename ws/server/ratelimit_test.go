@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"github.com/gobwas/ws"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newCloseServer()
+	Server = srv
+	now := time.Unix(1600000000, 0)
+	l := NewRateLimiter(Rate{PerSecond: 1, Burst: 2}, Rate{PerSecond: 2, Burst: 3}, LimitDrop)
+	l.now = func() time.Time { return now }
+
+	conn1, conn2 := &tagConn{name: "limit1"}, &tagConn{name: "limit2"}
+	c1 := &ConnectedClient{uid: "limit-uid", conn: conn1, done: make(chan struct{})}
+	c2 := &ConnectedClient{uid: "limit-uid", conn: conn2, done: make(chan struct{})}
+
+	// burst per connection
+	if !l.Allow(c1) || !l.Allow(c1) {
+		t.Fatal("expected burst to be allowed")
+	}
+	if l.Allow(c1) {
+		t.Fatal("expected connection to be limited after its burst")
+	}
+	// the uid's bucket is shared by its connections
+	if !l.Allow(c2) {
+		t.Fatal("expected second connection to be allowed")
+	}
+	if l.Allow(c2) {
+		t.Fatal("expected uid to be limited after its burst")
+	}
+
+	// refills over time
+	now = now.Add(time.Second)
+	if !l.Allow(c1) {
+		t.Fatal("expected connection to be allowed after refill")
+	}
+
+	s := l.Stats()
+	if s.Allowed != 4 || s.Limited != 2 || s.Closed != 0 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+	if len(srv.of(conn1)) != 0 {
+		t.Fatal("expected dropped messages not to be answered")
+	}
+
+	// buckets are forgotten as their connection is cleaned up
+	c1.cleanUp()
+	c2.cleanUp()
+	l.mu.Lock()
+	n := len(l.conns) + len(l.users)
+	l.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expected buckets to be forgotten")
+	}
+
+	// a connection already done when first limited isn't retained
+	l.Allow(c1)
+	l.mu.Lock()
+	n = len(l.conns)
+	l.mu.Unlock()
+	if n != 0 {
+		t.Fatal("expected buckets of a done connection to be forgotten")
+	}
+}
+
+func TestRateLimiterActions(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := newCloseServer()
+	Server = srv
+	one := Rate{PerSecond: 0.001, Burst: 1}
+
+	conn := &tagConn{name: "limit-error"}
+	c := NewConnection("limit-error-uid", conn)
+	l := NewRateLimiter(one, Rate{}, LimitError)
+	l.Allow(c)
+	if l.Allow(c) {
+		t.Fatal("expected second message to be limited")
+	}
+	w := srv.of(conn)
+	if len(w) != 1 || w[0].Type != envelope.TypeError || w[0].Error.Code != envelope.CodeRateLimited {
+		t.Fatalf("expected rate limited error, got %+v", w)
+	}
+
+	conn = &tagConn{name: "limit-close"}
+	c = NewConnection("limit-close-uid", conn)
+	l = NewRateLimiter(one, Rate{}, LimitClose)
+	l.Allow(c)
+	l.Allow(c)
+	if code, _ := srv.closeCode(conn); code != ws.StatusPolicyViolation {
+		t.Fatalf("expected policy violation, got %d", code)
+	}
+	if _, ok := Lookup("limit-close-uid"); ok {
+		t.Fatal("expected connection to be removed")
+	}
+	if s := l.Stats(); s.Closed != 1 {
+		t.Fatalf("expected a closed connection, got %+v", s)
+	}
+}
+
+func TestReadRateLimited(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{reads: make(chan []byte, 3)}
+	Server = rs
+	c := NewConnection("limit-read-uid", stubConn{})
+	c.Limit(NewRateLimiter(Rate{PerSecond: 0.001, Burst: 1}, Rate{}, LimitDrop))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgCh := make(chan Msg, 3)
+	checkErr(t, c.Read(ctx, msgCh))
+	for _, m := range []string{"1", "2", "3"} {
+		rs.reads <- []byte(m)
+	}
+	close(rs.reads)
+	<-c.Done()
+
+	if len(msgCh) != 1 {
+		t.Fatalf("expected one message through the limit, got %d", len(msgCh))
+	}
+	if m := <-msgCh; string(m.Data) != "1" {
+		t.Fatalf("expected first message, got %s", m.Data)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"log"
+	"reflect"
+	"sync"
+)
+
+var connectedClientType = reflect.TypeOf((*ConnectedClient)(nil))
+
+// Router dispatches envelopes read from a ConnectedClient to handlers registered per message type
+type Router struct {
+	mu       sync.RWMutex
+	handlers map[string]envelope.Handler
+}
+
+// creates an empty Router
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]envelope.Handler)}
+}
+
+// registers fn for msgType, fn must be of the form func(context.Context, *ConnectedClient, T) error
+// where the envelope payload is unmarshalled into T, panics if fn is not a valid handler
+func (r *Router) Handle(msgType string, fn interface{}) {
+	h, err := envelope.NewHandler(fn, connectedClientType)
+	if err != nil {
+		panic(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[msgType] = h
+}
+
+// registers fn as the call handler for method, fn must be of the form
+// func(context.Context, *ConnectedClient, P) (R, error) where P is unmarshalled from the
+// call params and R is sent back as the result, panics if fn is not a valid call handler
+func (r *Router) HandleCall(method string, fn interface{}) {
+	h, err := envelope.NewCallHandler(fn, connectedClientType)
+	if err != nil {
+		panic(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[method] = h
+}
+
+// parses b and calls the handler registered for its type, envelope and payload errors
+// are reported back to the sender as error envelopes, calls carrying an id are answered
+// with a result or error envelope with the same id
+func (r *Router) Dispatch(ctx context.Context, c *ConnectedClient, b []byte) error {
+	e, err := envelope.Parse(b)
+	if err != nil {
+		return reply(c, envelope.NewError(envelope.CodeBadEnvelope, err.Error()), err)
+	}
+	return r.dispatch(ctx, c, e)
+}
+
+func (r *Router) dispatch(ctx context.Context, c *ConnectedClient, e envelope.Envelope) error {
+	r.mu.RLock()
+	h, ok := r.handlers[e.Type]
+	r.mu.RUnlock()
+	if !ok {
+		if e.Type == envelope.TypeError {
+			// never answer an error with another error
+			return e.Err()
+		}
+		msg := "no handler for " + e.Type
+		return reply(c, envelope.NewCallError(e.ID, &envelope.Error{Code: envelope.CodeUnknownType, Message: msg}), errors.New(msg))
+	}
+
+	payload, err := h.Decode(e.Payload)
+	if err != nil {
+		return reply(c, envelope.NewCallError(e.ID, &envelope.Error{Code: envelope.CodeBadPayload, Message: err.Error()}), err)
+	}
+
+	res, err := h.Call(ctx, c, payload)
+	if e.ID == "" {
+		return err
+	}
+	if err != nil {
+		return reply(c, envelope.NewCallError(e.ID, err), err)
+	}
+	if !h.Returns() {
+		// called through Handle, answered with an empty result so the caller isn't left waiting
+		res = nil
+	}
+
+	result, err := envelope.NewResult(e.ID, res)
+	if err != nil {
+		return reply(c, envelope.NewCallError(e.ID, err), err)
+	}
+	return reply(c, result, nil)
+}
+
+// reads from c and dispatches every message until ctx is done or c is cleaned up. Messages
+// are handled in order, except calls which are handled concurrently so a slow call
+// doesn't hold up the others
+func (r *Router) Serve(ctx context.Context, c *ConnectedClient) error {
+	msgCh := make(chan Msg)
+	if err := c.Read(ctx, msgCh); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.Done():
+			return nil
+		case m := <-msgCh:
+			e, err := envelope.Parse(m.Data)
+			switch {
+			case err != nil:
+				err = reply(c, envelope.NewError(envelope.CodeBadEnvelope, err.Error()), err)
+			case e.ID != "":
+				go func(from string) {
+					if err := r.dispatch(ctx, c, e); err != nil {
+						log.Println("failed to handle call from", from, err)
+					}
+				}(m.From)
+				continue
+			default:
+				err = r.dispatch(ctx, c, e)
+			}
+			if err != nil {
+				log.Println("failed to handle message from", m.From, err)
+			}
+		}
+	}
+}
+
+// sends envelope e to c, returning cause
+func reply(c *ConnectedClient, e envelope.Envelope, cause error) error {
+	b, err := json.Marshal(e)
+	if err == nil {
+		err = c.Write(b)
+	}
+	if err != nil {
+		log.Println("failed to send", e.Type, "envelope,", err)
+	}
+	return cause
+}
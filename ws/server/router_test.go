@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+type chatMsg struct {
+	Text string `json:"text"`
+}
+
+// records every message written and replays Reads
+type recordingServer struct {
+	mu      sync.Mutex
+	written [][]byte
+	reads   chan []byte
+}
+
+func (r *recordingServer) WriteMessage(c *CleanableConnection, b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written = append(r.written, b)
+	return nil
+}
+
+func (r *recordingServer) ReadMessage(c *CleanableConnection) ([]byte, error) {
+	b, open := <-r.reads
+	if !open {
+		return nil, io.EOF
+	}
+	return b, nil
+}
+
+func (r *recordingServer) last(t *testing.T) envelope.Envelope {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.written) == 0 {
+		t.Fatalf("expected a message to be written")
+	}
+	e, err := envelope.Parse(r.written[len(r.written)-1])
+	checkErr(t, err)
+	return e
+}
+
+type stubConn struct{}
+
+func (stubConn) GetConnection() io.ReadWriteCloser { return nopRWCloser{} }
+func (stubConn) CleanUp(uid string) error          { return nil }
+
+type nopRWCloser struct{}
+
+func (nopRWCloser) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (nopRWCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopRWCloser) Close() error                { return nil }
+
+func TestRouterDispatch(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{}
+	Server = rs
+	c := NewConnection("router-uid", stubConn{})
+
+	var got chatMsg
+	r := NewRouter()
+	r.Handle("chat.send", func(ctx context.Context, cc *ConnectedClient, m chatMsg) error {
+		if cc.UID() != "router-uid" {
+			t.Fatalf("handler connection; want: %v, got: %v", "router-uid", cc.UID())
+		}
+		got = m
+		if m.Text == "fail" {
+			return errors.New("stub")
+		}
+		return nil
+	})
+
+	// happy path
+	err := r.Dispatch(context.Background(), c, []byte(`{"type":"chat.send","payload":{"text":"hi"}}`))
+	checkErr(t, err)
+	if got.Text != "hi" {
+		t.Fatalf("handler payload; want: %v, got: %v", "hi", got.Text)
+	}
+
+	// handler error is returned but not sent
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.send","payload":{"text":"fail"}}`))
+	checkErrNil(t, err)
+	if len(rs.written) != 0 {
+		t.Fatalf("handler errors shouldnt be sent to the client")
+	}
+
+	tt := []struct {
+		name string
+		msg  string
+		code string
+	}{
+		{"not json", `stub`, envelope.CodeBadEnvelope},
+		{"no type", `{"payload":{}}`, envelope.CodeBadEnvelope},
+		{"unknown type", `{"type":"chat.delete"}`, envelope.CodeUnknownType},
+		{"bad payload", `{"type":"chat.send","payload":{"text":1}}`, envelope.CodeBadPayload},
+	}
+
+	for _, v := range tt {
+		err := r.Dispatch(context.Background(), c, []byte(v.msg))
+		checkErrNil(t, err)
+		e := rs.last(t)
+		if e.Type != envelope.TypeError || e.Error == nil || e.Error.Code != v.code {
+			t.Fatalf("%s: expected %s error envelope, got: %+v", v.name, v.code, e)
+		}
+	}
+
+	// error envelopes from the client are not answered
+	n := len(rs.written)
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"error","error":{"code":"stub","message":"stub"}}`))
+	checkErrNil(t, err)
+	if len(rs.written) != n {
+		t.Fatalf("shouldnt reply to error envelopes")
+	}
+}
+
+func TestRouterHandleCall(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{}
+	Server = rs
+	c := NewConnection("call-uid", stubConn{})
+
+	r := NewRouter()
+	r.HandleCall("chat.history", func(ctx context.Context, cc *ConnectedClient, m chatMsg) ([]chatMsg, error) {
+		if m.Text == "fail" {
+			return nil, errors.New("stub")
+		}
+		return []chatMsg{m, m}, nil
+	})
+
+	// result carries the call id
+	err := r.Dispatch(context.Background(), c, []byte(`{"type":"chat.history","id":"7","payload":{"text":"hi"}}`))
+	checkErr(t, err)
+	e := rs.last(t)
+	if e.Type != envelope.TypeResult || e.ID != "7" || string(e.Payload) != `[{"text":"hi"},{"text":"hi"}]` {
+		t.Fatalf("invalid result envelope: %+v", e)
+	}
+
+	// handler error answers the call
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.history","id":"8","payload":{"text":"fail"}}`))
+	checkErrNil(t, err)
+	e = rs.last(t)
+	if e.Type != envelope.TypeError || e.ID != "8" || e.Error.Code != envelope.CodeCallFailed {
+		t.Fatalf("invalid call error envelope: %+v", e)
+	}
+
+	// unknown method answers the call
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.missing","id":"9"}`))
+	checkErrNil(t, err)
+	e = rs.last(t)
+	if e.ID != "9" || e.Error.Code != envelope.CodeUnknownType {
+		t.Fatalf("invalid call error envelope: %+v", e)
+	}
+
+	// calls to handlers registered with Handle are answered too
+	r.Handle("chat.send", func(ctx context.Context, cc *ConnectedClient, m chatMsg) error {
+		if m.Text == "fail" {
+			return errors.New("stub")
+		}
+		return nil
+	})
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.send","id":"10","payload":{"text":"hi"}}`))
+	checkErr(t, err)
+	e = rs.last(t)
+	if e.Type != envelope.TypeResult || e.ID != "10" {
+		t.Fatalf("invalid result envelope: %+v", e)
+	}
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.send","id":"11","payload":{"text":"fail"}}`))
+	checkErrNil(t, err)
+	e = rs.last(t)
+	if e.Type != envelope.TypeError || e.ID != "11" || e.Error.Code != envelope.CodeCallFailed {
+		t.Fatalf("invalid call error envelope: %+v", e)
+	}
+
+	// without an id the result is discarded
+	n := len(rs.written)
+	err = r.Dispatch(context.Background(), c, []byte(`{"type":"chat.history","payload":{"text":"hi"}}`))
+	checkErr(t, err)
+	if len(rs.written) != n {
+		t.Fatalf("shouldnt answer calls without an id")
+	}
+}
+
+func TestRouterHandlePanics(t *testing.T) {
+	register := []func(){
+		func() { NewRouter().Handle("stub", func(chatMsg) {}) },
+		func() {
+			NewRouter().HandleCall("stub", func(context.Context, *ConnectedClient, chatMsg) error { return nil })
+		},
+	}
+
+	for i, fn := range register {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("%d: expected panic on invalid handler", i)
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestRouterServe(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{reads: make(chan []byte)}
+	Server = rs
+	c := NewConnection("serve-uid", stubConn{})
+
+	got := make(chan string, 1)
+	r := NewRouter()
+	r.Handle("chat.send", func(ctx context.Context, cc *ConnectedClient, m *chatMsg) error {
+		got <- m.Text
+		return nil
+	})
+
+	done := make(chan error)
+	go func() { done <- r.Serve(context.Background(), c) }()
+
+	rs.reads <- []byte(`{"type":"chat.send","payload":{"text":"hi"}}`)
+	select {
+	case s := <-got:
+		if s != "hi" {
+			t.Fatalf("handler payload; want: %v, got: %v", "hi", s)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("handler should be called before timeout")
+	}
+
+	// client disconnects
+	close(rs.reads)
+	select {
+	case err := <-done:
+		checkErr(t, err)
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("serve should return once the connection is cleaned up")
+	}
+}
+
+func TestRouterServeCalls(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	rs := &recordingServer{reads: make(chan []byte)}
+	Server = rs
+	c := NewConnection("serve-calls-uid", stubConn{})
+
+	release := make(chan struct{})
+	r := NewRouter()
+	r.HandleCall("slow", func(ctx context.Context, cc *ConnectedClient, m chatMsg) (chatMsg, error) {
+		<-release
+		return m, nil
+	})
+	r.HandleCall("fast", func(ctx context.Context, cc *ConnectedClient, m chatMsg) (chatMsg, error) {
+		return m, nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Serve(ctx, c)
+
+	// a slow call doesn't hold up the next one
+	rs.reads <- []byte(`{"type":"slow","id":"1","payload":{}}`)
+	rs.reads <- []byte(`{"type":"fast","id":"2","payload":{}}`)
+	eventually(t, "fast call answered", func() bool {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		return len(rs.written) == 1
+	})
+	if e := rs.last(t); e.ID != "2" {
+		t.Fatalf("expected the fast call to be answered first, got: %+v", e)
+	}
+
+	close(release)
+	eventually(t, "slow call answered", func() bool {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+		return len(rs.written) == 2
+	})
+	if e := rs.last(t); e.ID != "1" {
+		t.Fatalf("expected the slow call to be answered, got: %+v", e)
+	}
+
+	// the read loop is done with Server once it sees the disconnect
+	close(rs.reads)
+	<-c.Done()
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
+
+func checkErrNil(t *testing.T, err error) {
+	if err == nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
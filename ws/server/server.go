@@ -5,14 +5,32 @@ import (
 	"errors"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/mousybusiness/go-web/ws/envelope"
 	"io"
+	"sync"
+	"time"
 )
 
 var Connections = make(map[string]*ConnectedClient)
 
+// guards Connections
+var connMu sync.RWMutex
+
 type ConnectedClient struct {
 	uid  string
 	conn CleanableConnection
+	wmu  sync.Mutex // serializes frames written by concurrent callers
+
+	done     chan struct{}
+	doneOnce sync.Once
+	hmu      sync.Mutex
+	hooks    []func() // run once done
+
+	emu     sync.Mutex
+	expires time.Time // when the credentials the connection was authorized with expire
+
+	limiter    *RateLimiter
+	readLimits ReadLimits
 }
 
 type CleanableConnection interface {
@@ -25,6 +43,11 @@ type WebsocketIO interface {
 	ReadMessage(c *CleanableConnection) ([]byte, error)
 }
 
+// implemented by WebsocketIO that can send close frames with a status code
+type CloseWriter interface {
+	WriteClose(c *CleanableConnection, code ws.StatusCode, reason string) error
+}
+
 // make websocket io funcs mockable
 var Server WebsocketIO
 
@@ -36,46 +59,147 @@ func init() {
 
 // wrap gobwas write
 func (w websock) WriteMessage(c *CleanableConnection, b []byte) error {
+	if cc, ok := (*c).(compressedConn); ok {
+		return writeCompressed((*c).GetConnection(), cc.compression(), b)
+	}
 	return wsutil.WriteServerMessage((*c).GetConnection(), ws.OpText, b)
 }
 
 // wrap gobwas read
 func (w websock) ReadMessage(c *CleanableConnection) ([]byte, error) {
+	if _, ok := (*c).(compressedConn); ok {
+		return w.ReadLimited(c, ReadLimits{})
+	}
 	read, _, err := wsutil.ReadClientData((*c).GetConnection())
 	return read, err
 }
 
+// send a close frame
+func (w websock) WriteClose(c *CleanableConnection, code ws.StatusCode, reason string) error {
+	return ws.WriteFrame((*c).GetConnection(), ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+}
+
 // creates new connected client and registers in connections lookup map
 func NewConnection(uid string, conn CleanableConnection) *ConnectedClient {
 	c := &ConnectedClient{
 		uid:  uid,
 		conn: conn,
+		done: make(chan struct{}),
 	}
+	connMu.Lock()
 	Connections[uid] = c
+	connMu.Unlock()
 	return c
 }
 
+// connected client registered for uid
+func Lookup(uid string) (*ConnectedClient, bool) {
+	connMu.RLock()
+	defer connMu.RUnlock()
+	c, ok := Connections[uid]
+	return c, ok
+}
+
+// uid the connection was registered with
+func (c *ConnectedClient) UID() string {
+	return c.uid
+}
+
+// closed once the connection has been cleaned up
+func (c *ConnectedClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// limits messages read from the connection with l, must be set before Read
+func (c *ConnectedClient) Limit(l *RateLimiter) {
+	c.limiter = l
+}
+
+// when the connection's credentials expire, zero if they don't
+func (c *ConnectedClient) ExpiresAt() time.Time {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	return c.expires
+}
+
+func (c *ConnectedClient) setExpiry(t time.Time) {
+	c.emu.Lock()
+	defer c.emu.Unlock()
+	c.expires = t
+}
+
 // write to websocket
 func (c *ConnectedClient) Write(b []byte) error {
 	if b == nil {
 		return errors.New("data is nil")
 	}
+	if len(b) == 0 {
+		return errors.New("data is empty")
+	}
 	if c.conn == nil {
 		return errors.New("connection is nil during write")
 	}
+	c.wmu.Lock()
 	err := Server.WriteMessage(&c.conn, b)
+	c.wmu.Unlock()
 	if err != nil {
 		if err == io.EOF {
-			if _, ok := Connections[c.uid]; ok {
-				c.conn.CleanUp(c.uid)
-				delete(Connections, c.uid)
-			}
+			c.cleanUp()
 		}
 		return err
 	}
 	return nil
 }
 
+// write payload to websocket wrapped in an envelope of msgType
+func (c *ConnectedClient) Send(msgType string, payload interface{}) error {
+	b, err := envelope.Marshal(msgType, payload)
+	if err != nil {
+		return err
+	}
+	return c.Write(b)
+}
+
+// removes the connection from the lookup and signals Done
+func (c *ConnectedClient) cleanUp() {
+	connMu.Lock()
+	cur, ok := Connections[c.uid]
+	ok = ok && cur == c // the uid may have reconnected since
+	if ok {
+		delete(Connections, c.uid)
+	}
+	connMu.Unlock()
+	if ok {
+		c.conn.CleanUp(c.uid)
+	}
+	if c.done != nil {
+		c.doneOnce.Do(func() {
+			close(c.done)
+			c.hmu.Lock()
+			hooks := c.hooks
+			c.hooks = nil
+			c.hmu.Unlock()
+			for _, fn := range hooks {
+				fn()
+			}
+		})
+	}
+}
+
+// runs fn once the connection is done, straight away if it already is, without
+// a goroutine waiting on Done
+func (c *ConnectedClient) onDone(fn func()) {
+	c.hmu.Lock()
+	select {
+	case <-c.done:
+		c.hmu.Unlock()
+		fn()
+	default:
+		c.hooks = append(c.hooks, fn)
+		c.hmu.Unlock()
+	}
+}
+
 // Msg describes what is read for who
 type Msg struct {
 	From string
@@ -97,17 +221,21 @@ func (c *ConnectedClient) Read(ctx context.Context, msgCh chan Msg) error {
 			default:
 			}
 
-			m, err := Server.ReadMessage(&c.conn)
+			m, err := c.readMessage()
 			if err != nil {
-				if _, ok := Connections[c.uid]; ok {
-					c.conn.CleanUp(c.uid)
-					delete(Connections, c.uid)
-				}
+				c.readFailed(err)
 				return
 			}
+			if c.limiter != nil && !c.limiter.Allow(c) {
+				continue
+			}
 
 			if msgCh != nil {
-				msgCh <- Msg{From: c.uid, Data: m}
+				select {
+				case msgCh <- Msg{From: c.uid, Data: m}:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
@@ -115,6 +243,21 @@ func (c *ConnectedClient) Read(ctx context.Context, msgCh chan Msg) error {
 	return nil
 }
 
+// sends a close frame with code and reason when Server supports it, then cleans up
+func (c *ConnectedClient) CloseWith(code ws.StatusCode, reason string) error {
+	var err error
+	if cw, ok := Server.(CloseWriter); ok && c.conn != nil {
+		c.wmu.Lock()
+		err = cw.WriteClose(&c.conn, code, reason)
+		c.wmu.Unlock()
+	}
+	c.cleanUp()
+	if c.conn != nil {
+		_ = c.conn.GetConnection().Close()
+	}
+	return err
+}
+
 func (c *ConnectedClient) Close() {
 	if c.conn != nil {
 		_ = c.conn.CleanUp(c.uid)
@@ -1,44 +1,54 @@
-package server
+package server_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/client"
+	"github.com/mousybusiness/go-web/ws/server"
 	"github.com/mousybusiness/go-web/ws/wstest"
 	"io"
 	"io/ioutil"
 	"log"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+// the real websocket io, before tests swap it
+var websock = server.Server
+
 type MockServer struct {
 	WriteErr  error
 	ReadBytes []byte
 	ReadErr   error
 }
 
-func (m MockServer) WriteMessage(c *CleanableConnection, b []byte) error {
+func (m MockServer) WriteMessage(c *server.CleanableConnection, b []byte) error {
 	return m.WriteErr
 }
 
-func (m MockServer) ReadMessage(c *CleanableConnection) ([]byte, error) {
+func (m MockServer) ReadMessage(c *server.CleanableConnection) ([]byte, error) {
 	return m.ReadBytes, m.ReadErr
 }
 
 func TestNewConnection(t *testing.T) {
 	log.SetOutput(ioutil.Discard) // discard logs
 
-	conn := wstest.MockCleanConn{}
+	conn := &wstest.MockCleanConn{}
 	uid := "stub"
-	c := NewConnection(uid, conn)
+	c := server.NewConnection(uid, conn)
 	if c == nil {
 		t.Fatalf("connection nil")
 	}
 
-	if v, ok := Connections[uid]; !ok {
+	if v, ok := server.Connections[uid]; !ok {
 		t.Fatalf("connection was not added to connections lookup")
 	} else {
-		if v.uid != uid {
+		if v.UID() != uid {
 			t.Fatalf("invalid uid assigned to connection")
 		}
 	}
@@ -47,11 +57,11 @@ func TestNewConnection(t *testing.T) {
 func TestWrite(t *testing.T) {
 	log.SetOutput(ioutil.Discard) // discard logs
 
-	Server = MockServer{}
+	server.Server = MockServer{}
 
-	conn := wstest.MockCleanConn{}
+	conn := &wstest.MockCleanConn{}
 	uid := "stub"
-	c := NewConnection(uid, conn)
+	c := server.NewConnection(uid, conn)
 
 	// nil data
 	err := c.Write(nil)
@@ -66,38 +76,40 @@ func TestWrite(t *testing.T) {
 	checkErr(t, err)
 
 	// error during write - non EOF
-	Server = MockServer{WriteErr: errors.New("error during write")}
+	server.Server = MockServer{WriteErr: errors.New("error during write")}
 	err = c.Write([]byte{1, 2, 3})
 	checkErrNil(t, err)
-	if _, ok := Connections[uid]; !ok {
+	if _, ok := server.Connections[uid]; !ok {
 		t.Fatalf("connection shouldnt be removed on non-EOF error")
 	}
+	conn.AssertNotCleanedUp(t, uid)
 
 	// EOF during write - client disconnected
-	Server = MockServer{WriteErr: io.EOF}
+	server.Server = MockServer{WriteErr: io.EOF}
 	err = c.Write([]byte{1, 2, 3})
 	checkErrNil(t, err)
-	if _, ok := Connections[uid]; ok {
+	if _, ok := server.Connections[uid]; ok {
 		t.Fatalf("connection should be removed if EOF")
 	}
+	conn.AssertCleanedUp(t, uid)
 }
 
 func TestRead(t *testing.T) {
 	log.SetOutput(ioutil.Discard) // discard logs
 
-	conn := wstest.MockCleanConn{
-		Conn: wstest.MockRWCloser{},
+	conn := &wstest.MockCleanConn{
+		Conn: &wstest.MockRWCloser{},
 	}
 	uid := "stub-uid"
-	c := NewConnection(uid, conn)
+	c := server.NewConnection(uid, conn)
 
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// happy path
-	Server = MockServer{ReadBytes: []byte("stub")}
+	server.Server = MockServer{ReadBytes: []byte("stub")}
 	timeout := time.NewTimer(time.Millisecond * 100)
 
-	msgCh := make(chan Msg)
+	msgCh := make(chan server.Msg)
 	c.Read(ctx, msgCh)
 
 	select {
@@ -118,8 +130,8 @@ func TestRead(t *testing.T) {
 	timeout.Reset(time.Millisecond * 10)
 
 	// ensure loop remains open if nil messages are returned
-	Server = MockServer{}
-	msgCh = make(chan Msg)
+	server.Server = MockServer{}
+	msgCh = make(chan server.Msg)
 	ctx, cancel = context.WithCancel(context.Background())
 	timeout.Reset(time.Millisecond * 10)
 	c.Read(ctx, msgCh)
@@ -132,7 +144,7 @@ func TestRead(t *testing.T) {
 
 	// cancel context
 	timeout.Reset(time.Millisecond * 100)
-	msgCh = make(chan Msg)
+	msgCh = make(chan server.Msg)
 	ctx, cancel = context.WithCancel(context.Background())
 	c.Read(ctx, msgCh)
 	cancel() // cancel context`
@@ -145,8 +157,8 @@ func TestRead(t *testing.T) {
 
 	// error during read
 	log.SetOutput(ioutil.Discard) // throw out error logs
-	Server = MockServer{ReadBytes: []byte("stub"), ReadErr: errors.New("error during read")}
-	msgCh = make(chan Msg)
+	server.Server = MockServer{ReadBytes: []byte("stub"), ReadErr: errors.New("error during read")}
+	msgCh = make(chan server.Msg)
 	ctx, cancel = context.WithCancel(context.Background())
 	timeout.Reset(time.Millisecond * 50)
 	c.Read(ctx, msgCh)
@@ -157,10 +169,137 @@ func TestRead(t *testing.T) {
 		t.Fatalf("shouldnt send to channel if error")
 	}
 
-	if _, ok := Connections[uid]; ok {
+	cancel()
+
+	if _, ok := server.Connections[uid]; ok {
 		t.Fatalf("should remove connection if error")
 	}
+	conn.AssertCleanedUp(t, uid)
+}
+
+func TestReadEOF(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	prev := server.Server
+	server.Server = websock
+	defer func() { server.Server = prev }()
+
+	// one masked text frame, as sent by a client, then EOF
+	var frame bytes.Buffer
+	checkErr(t, ws.WriteFrame(&frame, ws.MaskFrameInPlace(ws.NewTextFrame([]byte("hi")))))
+	rw := wstest.NewMockRWCloser(frame.Bytes())
+	conn := &wstest.MockCleanConn{Conn: rw}
+	uid := "stub-eof"
+	c := server.NewConnection(uid, conn)
+
+	// writes are framed
+	checkErr(t, c.Write([]byte("yo")))
+	f, err := ws.ReadFrame(bytes.NewReader(rw.Written()))
+	checkErr(t, err)
+	if f.Header.OpCode != ws.OpText || f.Header.Masked || string(f.Payload) != "yo" {
+		t.Fatalf("invalid frame written: %+v %s", f.Header, f.Payload)
+	}
+
+	msgCh := make(chan server.Msg)
+	checkErr(t, c.Read(context.Background(), msgCh))
+	select {
+	case m := <-msgCh:
+		if string(m.Data) != "hi" {
+			t.Fatalf("read; want: %v, got: %s", "hi", m.Data)
+		}
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("should read the frame before timeout")
+	}
+
+	conn.AssertCleanedUp(t, uid)
+	select {
+	case <-c.Done():
+	case <-time.After(time.Millisecond * 100):
+		t.Fatalf("connection should be done once cleaned up")
+	}
+	if _, ok := server.Lookup(uid); ok {
+		t.Fatalf("connection should be removed on EOF")
+	}
+	if rw.BytesRead() != frame.Len() || rw.Closes() != 1 {
+		t.Fatalf("want %d bytes read and 1 close, got %d %d", frame.Len(), rw.BytesRead(), rw.Closes())
+	}
+}
+
+func TestDeliveryFailedHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	prev := server.Server
+	server.Server = websock
+	defer func() { server.Server = prev }()
+
+	uid := "stub-delivery"
+	d := server.NewDelivery(nil, server.Retention{})
+	sr := server.NewRouter()
+	d.Route(sr)
+	for _, text := range []string{"one", "fail", "three"} {
+		_, err := d.Send(uid, "note", note{Text: text})
+		checkErr(t, err)
+	}
+
+	// the second handler call fails, the third succeeds
+	var mu sync.Mutex
+	var handled []string
+	fail := true
+	cr := client.NewRouter()
+	cr.Handle("note", func(ctx context.Context, c *client.Connection, n note) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if n.Text == "fail" && fail {
+			fail = false
+			return errors.New("stub")
+		}
+		handled = append(handled, n.Text)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc, cc := wstest.Pair(t, uid)
+	defer func() {
+		// the server's read loop is done with Server once it sees the client close
+		_ = cc.Conn.(*websocket.Conn).Close()
+		<-sc.Done()
+	}()
+	go sr.Serve(ctx, sc)
+	go cr.Serve(ctx, cc)
+	checkErr(t, d.Redeliver(sc))
+
+	pending := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			p, err := d.Store.Pending(uid)
+			checkErr(t, err)
+			if len(p) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("pending; want: %v, got: %+v", want, p)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// acking the third message leaves the failed one pending
+	pending(1)
+
+	// and it comes back
+	checkErr(t, d.Redeliver(sc))
+	pending(0)
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(handled, ",") != "one,three,fail" {
+		t.Fatalf("handled; want: %v, got: %v", "one,three,fail", handled)
+	}
+}
 
+type note struct {
+	Text string `json:"text"`
 }
 
 func checkErr(t *testing.T, err error) {
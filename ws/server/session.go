@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	errs "github.com/pkg/errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sessions assigns every connection a session with monotonically increasing message
+// offsets, and keeps the latest messages broadcast to each of its topics so a client
+// reconnecting after a network blip can resume and have what it missed replayed
+type Sessions struct {
+	BufferSize int           // messages kept per session and topic
+	TTL        time.Duration // how long a disconnected session can be resumed
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+	byConn   map[*ConnectedClient]*Session
+	topics   map[string]map[*Session]struct{}
+	onRemove []func(sess *Session) // called without ss.mu held once a session is gone
+}
+
+// Session outlives its connection for the Sessions TTL
+type Session struct {
+	id  string
+	uid string
+
+	mu      sync.Mutex
+	conn    *ConnectedClient // nil while disconnected
+	offset  uint64           // last assigned
+	evicted uint64           // highest offset dropped from a buffer
+	buffers map[string]*ring
+	expires time.Time
+}
+
+// creates Sessions keeping size messages per session and topic, disconnected sessions
+// can be resumed for ttl
+func NewSessions(size int, ttl time.Duration) *Sessions {
+	return &Sessions{
+		BufferSize: size,
+		TTL:        ttl,
+		sessions:   make(map[string]*Session),
+		byConn:     make(map[*ConnectedClient]*Session),
+		topics:     make(map[string]map[*Session]struct{}),
+	}
+}
+
+// session id
+func (s *Session) ID() string {
+	return s.id
+}
+
+// uid the session belongs to
+func (s *Session) UID() string {
+	return s.uid
+}
+
+// starts a new session for c and tells the client its id, the session is detached
+// once c is cleaned up
+func (ss *Sessions) Attach(c *ConnectedClient) (*Session, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	sess := &Session{
+		id:      id,
+		uid:     c.uid,
+		conn:    c,
+		buffers: make(map[string]*ring),
+	}
+
+	ss.mu.Lock()
+	removed := ss.sweep()
+	ss.sessions[id] = sess
+	ss.byConn[c] = sess
+	ss.mu.Unlock()
+	ss.removed(removed)
+
+	c.onDone(func() { ss.detach(c) })
+
+	if err := c.Send(envelope.TypeSession, envelope.Session{ID: id}); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// moves c onto the previous session id, writing every message after offset before
+// live messages resume. The session started by Attach for c is discarded
+func (ss *Sessions) Resume(c *ConnectedClient, id string, offset uint64) (*Session, error) {
+	ss.mu.Lock()
+	sess, ok := ss.sessions[id]
+	var prev *ConnectedClient
+	expired := false
+	if ok {
+		sess.mu.Lock()
+		prev, expired = sess.conn, sess.expired(time.Now())
+		sess.mu.Unlock()
+	}
+	if !ok || sess.uid != c.uid || expired {
+		ss.mu.Unlock()
+		return nil, errs.Errorf("no session %s for %s", id, c.uid)
+	}
+	var removed []*Session
+	if current, ok := ss.byConn[c]; ok && current != sess {
+		ss.remove(current)
+		removed = append(removed, current)
+	}
+	if prev != nil && prev != c {
+		delete(ss.byConn, prev)
+	}
+	ss.byConn[c] = sess
+	ss.mu.Unlock()
+	ss.removed(removed)
+
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.conn = c
+
+	info := envelope.Session{ID: id, Offset: sess.offset, Gap: sess.evicted > offset}
+	if err := c.Send(envelope.TypeSession, info); err != nil {
+		return nil, err
+	}
+	for _, e := range sess.since(offset) {
+		if err := sess.write(e); err != nil {
+			return nil, err
+		}
+	}
+	return sess, nil
+}
+
+// registers the resume handler on r, a failed resume is answered with an error
+// envelope and the client keeps its new session
+func (ss *Sessions) Route(r *Router) {
+	r.Handle(envelope.TypeResume, func(ctx context.Context, c *ConnectedClient, res envelope.Resume) error {
+		if _, err := ss.Resume(c, res.Session, res.Offset); err != nil {
+			return reply(c, envelope.NewError(envelope.CodeNoSession, err.Error()), err)
+		}
+		return nil
+	})
+}
+
+// subscribes the session of c to topic
+func (ss *Sessions) Subscribe(c *ConnectedClient, topic string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sess, ok := ss.byConn[c]
+	if !ok {
+		return errs.Errorf("no session attached for %s", c.uid)
+	}
+	subs, ok := ss.topics[topic]
+	if !ok {
+		subs = make(map[*Session]struct{})
+		ss.topics[topic] = subs
+	}
+	subs[sess] = struct{}{}
+	return nil
+}
+
+// unsubscribes the session of c from topic
+func (ss *Sessions) Unsubscribe(c *ConnectedClient, topic string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if sess, ok := ss.byConn[c]; ok {
+		ss.unsubscribe(sess, topic)
+	}
+}
+
+// buffers payload as a message of msgType for every session subscribed to topic and
+// writes it to those that are connected
+func (ss *Sessions) Broadcast(topic, msgType string, payload interface{}) error {
+	e, err := envelope.New(msgType, payload)
+	if err != nil {
+		return err
+	}
+	e.Topic = topic
+
+	ss.mu.Lock()
+	subs := make([]*Session, 0, len(ss.topics[topic]))
+	for sess := range ss.topics[topic] {
+		subs = append(subs, sess)
+	}
+	ss.mu.Unlock()
+
+	for _, sess := range subs {
+		sess.publish(e, ss.BufferSize)
+	}
+	return nil
+}
+
+// session c is attached to
+func (ss *Sessions) session(c *ConnectedClient) (*Session, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sess, ok := ss.byConn[c]
+	return sess, ok
+}
+
+// number of sessions, connected or resumable
+func (ss *Sessions) Len() int {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return len(ss.sessions)
+}
+
+// leaves the session of c resumable for the TTL once c is cleaned up
+func (ss *Sessions) detach(c *ConnectedClient) {
+	ss.mu.Lock()
+	sess, ok := ss.byConn[c]
+	delete(ss.byConn, c)
+	ss.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	// c may be cleaned up by a failed write made with sess.mu held
+	go func() {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if sess.conn == c {
+			sess.conn = nil
+			sess.expires = time.Now().Add(ss.TTL)
+		}
+	}()
+}
+
+// removes expired sessions and returns them, ss.mu must be held
+func (ss *Sessions) sweep() []*Session {
+	now := time.Now()
+	var removed []*Session
+	for _, sess := range ss.sessions {
+		sess.mu.Lock()
+		expired := sess.expired(now)
+		sess.mu.Unlock()
+		if expired {
+			ss.remove(sess)
+			removed = append(removed, sess)
+		}
+	}
+	return removed
+}
+
+// tells the onRemove hooks about removed sessions, ss.mu must not be held
+func (ss *Sessions) removed(sessions []*Session) {
+	if len(sessions) == 0 {
+		return
+	}
+	ss.mu.Lock()
+	hooks := append([]func(*Session){}, ss.onRemove...)
+	ss.mu.Unlock()
+	for _, sess := range sessions {
+		for _, fn := range hooks {
+			fn(sess)
+		}
+	}
+}
+
+// ss.mu must be held
+func (ss *Sessions) remove(sess *Session) {
+	delete(ss.sessions, sess.id)
+	for topic := range ss.topics {
+		ss.unsubscribe(sess, topic)
+	}
+}
+
+// ss.mu must be held
+func (ss *Sessions) unsubscribe(sess *Session, topic string) {
+	if subs, ok := ss.topics[topic]; ok {
+		delete(subs, sess)
+		if len(subs) == 0 {
+			delete(ss.topics, topic)
+		}
+	}
+}
+
+// sess.mu must be held
+func (s *Session) expired(now time.Time) bool {
+	return s.conn == nil && !s.expires.IsZero() && now.After(s.expires)
+}
+
+func (s *Session) publish(e envelope.Envelope, size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offset++
+	e.Offset = s.offset
+
+	b, ok := s.buffers[e.Topic]
+	if !ok {
+		b = newRing(size)
+		s.buffers[e.Topic] = b
+	}
+	if dropped, ok := b.push(e); ok && dropped.Offset > s.evicted {
+		s.evicted = dropped.Offset
+	}
+
+	if s.conn != nil {
+		if err := s.write(e); err != nil {
+			log.Println("failed to write", e.Topic, "to session", s.id, err)
+		}
+	}
+}
+
+// buffered messages after offset across every topic, s.mu must be held
+func (s *Session) since(offset uint64) []envelope.Envelope {
+	var out []envelope.Envelope
+	for _, b := range s.buffers {
+		out = append(out, b.since(offset)...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Offset < out[j].Offset })
+	return out
+}
+
+// s.mu must be held
+func (s *Session) write(e envelope.Envelope) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.conn.Write(b)
+}
+
+// fixed size buffer keeping the latest envelopes
+type ring struct {
+	buf  []envelope.Envelope
+	next int
+	full bool
+}
+
+func newRing(size int) *ring {
+	if size < 1 {
+		size = 1
+	}
+	return &ring{buf: make([]envelope.Envelope, size)}
+}
+
+// adds e, returning the envelope it replaced if the ring was full
+func (r *ring) push(e envelope.Envelope) (envelope.Envelope, bool) {
+	dropped, full := r.buf[r.next], r.full
+	r.buf[r.next] = e
+	r.next = (r.next + 1) % len(r.buf)
+	if r.next == 0 {
+		r.full = true
+	}
+	return dropped, full
+}
+
+// envelopes after offset, oldest first
+func (r *ring) since(offset uint64) []envelope.Envelope {
+	var out []envelope.Envelope
+	start, n := 0, r.next
+	if r.full {
+		start, n = r.next, len(r.buf)
+	}
+	for i := 0; i < n; i++ {
+		if e := r.buf[(start+i)%len(r.buf)]; e.Offset > offset {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errs.Wrap(err, "failed to generate session id")
+	}
+	return hex.EncodeToString(b), nil
+}
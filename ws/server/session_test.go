@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// records messages written per connection
+type connServer struct {
+	mu      sync.Mutex
+	written map[CleanableConnection][]envelope.Envelope
+}
+
+func (s *connServer) WriteMessage(c *CleanableConnection, b []byte) error {
+	e, err := envelope.Parse(b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.written[*c] = append(s.written[*c], e)
+	return nil
+}
+
+func (s *connServer) ReadMessage(c *CleanableConnection) ([]byte, error) {
+	select {}
+}
+
+func (s *connServer) of(c CleanableConnection) []envelope.Envelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written[c]
+}
+
+type tagConn struct {
+	stubConn
+	name string // keeps every tagConn distinct
+}
+
+func TestSessions(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv := &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	Server = srv
+	ss := NewSessions(2, time.Minute)
+	r := NewRouter()
+	ss.Route(r)
+
+	// attach tells the client its session
+	conn1 := &tagConn{name: "stub"}
+	c1 := NewConnection("session-uid", conn1)
+	sess, err := ss.Attach(c1)
+	checkErr(t, err)
+	w := srv.of(conn1)
+	if len(w) != 1 || w[0].Type != envelope.TypeSession || string(w[0].Payload) != `{"id":"`+sess.ID()+`","offset":0}` {
+		t.Fatalf("invalid session envelope: %+v", w)
+	}
+
+	checkErr(t, ss.Subscribe(c1, "news"))
+	checkErr(t, ss.Subscribe(c1, "sport"))
+	checkErr(t, ss.Broadcast("news", "headline", chatMsg{Text: "1"}))
+	w = srv.of(conn1)
+	if len(w) != 2 || w[1].Topic != "news" || w[1].Offset != 1 {
+		t.Fatalf("invalid live broadcast: %+v", w)
+	}
+
+	// disconnect, messages are buffered
+	c1.cleanUp()
+	time.Sleep(time.Millisecond * 10)
+	checkErr(t, ss.Broadcast("news", "headline", chatMsg{Text: "2"}))
+	checkErr(t, ss.Broadcast("sport", "score", chatMsg{Text: "3"}))
+	checkErr(t, ss.Broadcast("other", "stub", chatMsg{Text: "ignored"}))
+	if len(srv.of(conn1)) != 2 {
+		t.Fatalf("nothing should be written while disconnected")
+	}
+
+	// reconnect gets a fresh session, resuming replays in offset order
+	conn2 := &tagConn{name: "stub"}
+	c2 := NewConnection("session-uid", conn2)
+	_, err = ss.Attach(c2)
+	checkErr(t, err)
+	checkErr(t, r.Dispatch(context.Background(), c2, []byte(`{"type":"resume","payload":{"session":"`+sess.ID()+`","offset":1}}`)))
+	w = srv.of(conn2)
+	if len(w) != 4 {
+		t.Fatalf("resume; want: %v messages, got: %+v", 4, w)
+	}
+	if w[1].Type != envelope.TypeSession || string(w[1].Payload) != `{"id":"`+sess.ID()+`","offset":3}` {
+		t.Fatalf("invalid resumed session envelope: %+v", w[1])
+	}
+	if w[2].Offset != 2 || w[2].Topic != "news" || w[3].Offset != 3 || w[3].Topic != "sport" {
+		t.Fatalf("invalid replay: %+v", w[2:])
+	}
+	if ss.Len() != 1 {
+		t.Fatalf("the session started on reconnect should be discarded")
+	}
+
+	// live traffic resumes on the new connection
+	checkErr(t, ss.Broadcast("news", "headline", chatMsg{Text: "4"}))
+	if w = srv.of(conn2); w[len(w)-1].Offset != 4 {
+		t.Fatalf("invalid live broadcast after resume: %+v", w)
+	}
+
+	// buffers are bounded, resuming too far back reports a gap
+	checkErr(t, ss.Broadcast("news", "headline", chatMsg{Text: "5"}))
+	conn3 := &tagConn{name: "stub"}
+	c3 := NewConnection("session-uid", conn3)
+	_, err = ss.Resume(c3, sess.ID(), 0)
+	checkErr(t, err)
+	w = srv.of(conn3)
+	if string(w[0].Payload) != `{"id":"`+sess.ID()+`","offset":5,"gap":true}` {
+		t.Fatalf("expected gap, got: %s", w[0].Payload)
+	}
+	if len(w) != 4 || w[1].Offset != 3 || w[2].Offset != 4 || w[3].Offset != 5 {
+		t.Fatalf("invalid replay after eviction: %+v", w)
+	}
+
+	// other uids can't resume the session
+	conn4 := &tagConn{name: "stub"}
+	c4 := NewConnection("other-uid", conn4)
+	_, err = ss.Attach(c4)
+	checkErr(t, err)
+	checkErrNil(t, r.Dispatch(context.Background(), c4, []byte(`{"type":"resume","payload":{"session":"`+sess.ID()+`","offset":0}}`)))
+	w = srv.of(conn4)
+	if e := w[len(w)-1]; e.Type != envelope.TypeError || e.Error.Code != envelope.CodeNoSession {
+		t.Fatalf("expected no session error, got: %+v", e)
+	}
+
+	c3.cleanUp()
+	c4.cleanUp()
+}
+
+func TestSessionsExpire(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	Server = &connServer{written: make(map[CleanableConnection][]envelope.Envelope)}
+	ss := NewSessions(10, time.Millisecond)
+
+	c1 := NewConnection("expire-uid", &tagConn{name: "stub"})
+	sess, err := ss.Attach(c1)
+	checkErr(t, err)
+	c1.cleanUp()
+	time.Sleep(time.Millisecond * 20)
+
+	c2 := NewConnection("expire-uid", &tagConn{name: "stub"})
+	_, err = ss.Attach(c2)
+	checkErr(t, err)
+	_, err = ss.Resume(c2, sess.ID(), 0)
+	checkErrNil(t, err)
+	if ss.Len() != 1 {
+		t.Fatalf("expired sessions should be removed")
+	}
+	c2.cleanUp()
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	errs "github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Message is a delivery retained until the client acks it
+type Message struct {
+	Seq     uint64          `json:"seq"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Time    time.Time       `json:"time"`
+}
+
+// Store retains unacked messages per uid
+type Store interface {
+	// retains m for uid, assigning it the next sequence number for uid
+	Append(uid string, m Message) (Message, error)
+	// removes the message for uid with seq, others stay pending even when older
+	Ack(uid string, seq uint64) error
+	// unacked messages for uid in sequence order
+	Pending(uid string) ([]Message, error)
+	// keeps at most the newest max messages for uid, when max > 0, and drops those before cutoff
+	Trim(uid string, max int, cutoff time.Time) error
+}
+
+// Retention bounds what is retained per uid, zero values mean unbounded
+type Retention struct {
+	MaxMessages int
+	MaxAge      time.Duration
+}
+
+// messages retained for a single uid
+type mailbox struct {
+	LastSeq  uint64    `json:"last_seq"`
+	Messages []Message `json:"messages"`
+}
+
+func (b *mailbox) append(m Message) Message {
+	b.LastSeq++
+	m.Seq = b.LastSeq
+	b.Messages = append(b.Messages, m)
+	return m
+}
+
+func (b *mailbox) ack(seq uint64) {
+	for i, m := range b.Messages {
+		if m.Seq == seq {
+			b.Messages = append(b.Messages[:i:i], b.Messages[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *mailbox) trim(max int, cutoff time.Time) {
+	i := 0
+	if max > 0 && len(b.Messages) > max {
+		i = len(b.Messages) - max
+	}
+	for i < len(b.Messages) && b.Messages[i].Time.Before(cutoff) {
+		i++
+	}
+	b.Messages = append([]Message(nil), b.Messages[i:]...)
+}
+
+type memoryStore struct {
+	mu    sync.Mutex
+	boxes map[string]*mailbox
+}
+
+// creates a Store keeping messages in memory, they are lost on restart
+func NewMemoryStore() Store {
+	return &memoryStore{boxes: make(map[string]*mailbox)}
+}
+
+func (s *memoryStore) box(uid string) *mailbox {
+	b, ok := s.boxes[uid]
+	if !ok {
+		b = &mailbox{}
+		s.boxes[uid] = b
+	}
+	return b
+}
+
+func (s *memoryStore) Append(uid string, m Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.box(uid).append(m), nil
+}
+
+func (s *memoryStore) Ack(uid string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.boxes[uid]; ok {
+		b.ack(seq)
+	}
+	return nil
+}
+
+func (s *memoryStore) Pending(uid string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.boxes[uid]; ok {
+		return append([]Message(nil), b.Messages...), nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) Trim(uid string, max int, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := s.boxes[uid]; ok {
+		b.trim(max, cutoff)
+	}
+	return nil
+}
+
+type fileStore struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// creates a Store keeping one json file per uid in dir, so messages survive restarts
+func NewFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errs.Wrap(err, "failed to create store directory")
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+// uids are hex encoded so any uid is a safe file name
+func (s *fileStore) path(uid string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(uid))+".json")
+}
+
+func (s *fileStore) load(uid string) (*mailbox, error) {
+	b, err := ioutil.ReadFile(s.path(uid))
+	if os.IsNotExist(err) {
+		return &mailbox{}, nil
+	}
+	if err != nil {
+		return nil, errs.Wrapf(err, "failed to read messages for %s", uid)
+	}
+	var box mailbox
+	if err := json.Unmarshal(b, &box); err != nil {
+		return nil, errs.Wrapf(err, "corrupt messages for %s", uid)
+	}
+	return &box, nil
+}
+
+// writes to a temp file first so a crash never leaves a partial file behind
+func (s *fileStore) save(uid string, box *mailbox) error {
+	b, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(uid) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errs.Wrapf(err, "failed to write messages for %s", uid)
+	}
+	return errs.Wrapf(os.Rename(tmp, s.path(uid)), "failed to write messages for %s", uid)
+}
+
+// loads the mailbox for uid, applies fn and saves it
+func (s *fileStore) update(uid string, fn func(b *mailbox)) error {
+	box, err := s.load(uid)
+	if err != nil {
+		return err
+	}
+	fn(box)
+	return s.save(uid, box)
+}
+
+func (s *fileStore) Append(uid string, m Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.update(uid, func(b *mailbox) { m = b.append(m) })
+	return m, err
+}
+
+func (s *fileStore) Ack(uid string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(uid, func(b *mailbox) { b.ack(seq) })
+}
+
+func (s *fileStore) Pending(uid string) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	box, err := s.load(uid)
+	if err != nil {
+		return nil, err
+	}
+	return box.Messages, nil
+}
+
+func (s *fileStore) Trim(uid string, max int, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(uid, func(b *mailbox) { b.trim(max, cutoff) })
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		m, err := s.Append("stub", Message{Type: "stub", Payload: []byte(`{}`), Time: now.Add(time.Duration(i) * time.Minute)})
+		checkErr(t, err)
+		if m.Seq != uint64(i+1) {
+			t.Fatalf("sequence number; want: %v, got: %v", i+1, m.Seq)
+		}
+	}
+
+	// other uids have their own sequence
+	m, err := s.Append("other", Message{Type: "stub"})
+	checkErr(t, err)
+	if m.Seq != 1 {
+		t.Fatalf("sequence number; want: %v, got: %v", 1, m.Seq)
+	}
+
+	// acks remove exactly one message, older ones stay pending
+	checkErr(t, s.Ack("stub", 2))
+	pending, err := s.Pending("stub")
+	checkErr(t, err)
+	if len(pending) != 4 || pending[0].Seq != 1 || pending[1].Seq != 3 {
+		t.Fatalf("pending after ack; want: %v without %v, got: %+v", 4, 2, pending)
+	}
+	checkErr(t, s.Ack("stub", 1))
+	checkErr(t, s.Ack("stub", 1)) // acking twice is harmless
+	pending, err = s.Pending("stub")
+	checkErr(t, err)
+	if len(pending) != 3 || pending[0].Seq != 3 {
+		t.Fatalf("pending after ack; want: %v from %v, got: %+v", 3, 3, pending)
+	}
+
+	// trim by count, then by age
+	checkErr(t, s.Trim("stub", 2, time.Time{}))
+	pending, err = s.Pending("stub")
+	checkErr(t, err)
+	if len(pending) != 2 || pending[0].Seq != 4 {
+		t.Fatalf("pending after trim; want: %v from %v, got: %+v", 2, 4, pending)
+	}
+	checkErr(t, s.Trim("stub", 0, now.Add(time.Minute*4)))
+	pending, err = s.Pending("stub")
+	checkErr(t, err)
+	if len(pending) != 1 || pending[0].Seq != 5 {
+		t.Fatalf("pending after age trim; want: %v, got: %+v", 5, pending)
+	}
+
+	// sequence keeps increasing once everything is acked
+	checkErr(t, s.Ack("stub", 5))
+	m, err = s.Append("stub", Message{Type: "stub"})
+	checkErr(t, err)
+	if m.Seq != 6 {
+		t.Fatalf("sequence number after ack; want: %v, got: %v", 6, m.Seq)
+	}
+
+	pending, err = s.Pending("unknown")
+	checkErr(t, err)
+	if len(pending) != 0 {
+		t.Fatalf("unknown uid should have nothing pending")
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewFileStore(dir)
+	checkErr(t, err)
+	testStore(t, s)
+
+	// messages survive a restart
+	s, err = NewFileStore(dir)
+	checkErr(t, err)
+	pending, err := s.Pending("stub")
+	checkErr(t, err)
+	if len(pending) != 1 || pending[0].Seq != 6 {
+		t.Fatalf("pending after reopen; want: %v, got: %+v", 6, pending)
+	}
+}
@@ -0,0 +1,59 @@
+package wstest
+
+import (
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/client"
+	"github.com/mousybusiness/go-web/ws/server"
+	"net"
+	"testing"
+)
+
+// connects a real server.ConnectedClient registered for uid to a real client.Connection
+// over loopback tcp, so every message crosses the wire as websocket frames. Neither side
+// is read from until the test calls Read, both are closed once the test ends
+func Pair(t testing.TB, uid string) (*server.ConnectedClient, *client.Connection) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening for websocket pair: %v", err)
+	}
+	defer l.Close()
+
+	type accepted struct {
+		c   *server.ConnectedClient
+		err error
+	}
+	ch := make(chan accepted, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			ch <- accepted{err: err}
+			return
+		}
+		if _, err := ws.Upgrade(conn); err != nil {
+			conn.Close()
+			ch <- accepted{err: err}
+			return
+		}
+		ch <- accepted{c: server.NewConnection(uid, server.WrapConn(conn))}
+	}()
+
+	conn, err := client.NewConnection(websocket.DefaultDialer, false, uid, l.Addr().String(), "/", "", "")
+	if err != nil {
+		t.Fatalf("dialing websocket pair: %v", err)
+	}
+	a := <-ch
+	if a.err != nil {
+		t.Fatalf("upgrading websocket pair: %v", a.err)
+	}
+
+	t.Cleanup(func() {
+		_ = a.c.CloseWith(ws.StatusNormalClosure, "")
+		if wc, ok := conn.Conn.(*websocket.Conn); ok {
+			_ = wc.Close()
+		}
+	})
+	return a.c, conn
+}
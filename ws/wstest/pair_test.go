@@ -0,0 +1,109 @@
+package wstest_test
+
+import (
+	"context"
+	"errors"
+	"github.com/gobwas/ws"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"github.com/mousybusiness/go-web/ws/server"
+	"github.com/mousybusiness/go-web/ws/wstest"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+type chatMsg struct {
+	Text string `json:"text"`
+}
+
+func TestPair(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv, cli := wstest.Pair(t, "pair")
+	if c, ok := server.Lookup("pair"); !ok || c != srv {
+		t.Fatal("expected server side to be registered")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// client to server
+	msgCh := make(chan server.Msg)
+	checkErr(t, srv.Read(ctx, msgCh))
+	checkErr(t, cli.Send("chat.send", chatMsg{Text: "hi"}))
+	select {
+	case m := <-msgCh:
+		e, err := envelope.Parse(m.Data)
+		checkErr(t, err)
+		if m.From != "pair" || e.Type != "chat.send" || string(e.Payload) != `{"text":"hi"}` {
+			t.Fatalf("unexpected message from %s: %s", m.From, m.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("server should read the message before timeout")
+	}
+
+	// server to client
+	cliCh := make(chan []byte)
+	cli.Read(ctx, cliCh)
+	checkErr(t, srv.Send("chat.recv", chatMsg{Text: "yo"}))
+	select {
+	case b := <-cliCh:
+		e, err := envelope.Parse(b)
+		checkErr(t, err)
+		if e.Type != "chat.recv" || string(e.Payload) != `{"text":"yo"}` {
+			t.Fatalf("unexpected message: %s", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client should read the message before timeout")
+	}
+
+	// closing the server side ends the client's read loop
+	checkErr(t, srv.CloseWith(ws.StatusGoingAway, "bye"))
+	select {
+	case _, open := <-cliCh:
+		if open {
+			t.Fatal("expected the client's read channel to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client should see the connection close before timeout")
+	}
+	if _, ok := server.Lookup("pair"); ok {
+		t.Fatal("expected server side to be removed once closed")
+	}
+}
+
+func TestPairCall(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	srv, cli := wstest.Pair(t, "pair-call")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	r := server.NewRouter()
+	r.HandleCall("echo", func(ctx context.Context, c *server.ConnectedClient, m chatMsg) (chatMsg, error) {
+		return chatMsg{Text: c.UID() + ": " + m.Text}, nil
+	})
+	go r.Serve(ctx, srv)
+	cli.Read(ctx, make(chan []byte))
+
+	var res chatMsg
+	checkErr(t, cli.Call(ctx, "echo", chatMsg{Text: "hi"}, &res))
+	if res.Text != "pair-call: hi" {
+		t.Fatalf("call result; want: %v, got: %v", "pair-call: hi", res.Text)
+	}
+
+	// errors travel back as error envelopes
+	err := cli.Call(ctx, "missing", nil, nil)
+	var e *envelope.Error
+	if !errors.As(err, &e) || e.Code != envelope.CodeUnknownType {
+		t.Fatalf("expected unknown type error, got: %v", err)
+	}
+}
+
+func checkErr(t *testing.T, err error) {
+	if err != nil {
+		t.Helper()
+		t.Fatal(err)
+	}
+}
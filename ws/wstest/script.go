@@ -0,0 +1,352 @@
+package wstest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/client"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Script is a fake websocket server playing a conversation with the client under test,
+// step by step. Failures are reported once the test ends, with a diff of what the
+// client sent against what the script expected
+type Script struct {
+	steps   []step
+	timeout time.Duration
+
+	mu       sync.Mutex
+	failures []string
+	played   int
+}
+
+type step struct {
+	desc string
+	// checks a message the client sent, nil for steps the server plays
+	expect func(b []byte) error
+	play   func(conn *websocket.Conn) error
+}
+
+// creates an empty Script, expected messages must arrive within a second
+func NewScript() *Script {
+	return &Script{timeout: time.Second}
+}
+
+// how long each Expect waits for the client's message
+func (s *Script) Timeout(d time.Duration) *Script {
+	s.timeout = d
+	return s
+}
+
+// expects the client to send exactly msg
+func (s *Script) Expect(msg string) *Script {
+	s.steps = append(s.steps, step{
+		desc: "expect " + msg,
+		expect: func(b []byte) error {
+			if string(b) != msg {
+				return fmt.Errorf("unexpected message\n%s", diff(msg, string(b)))
+			}
+			return nil
+		},
+	})
+	return s
+}
+
+// expects the client to send json equivalent to v, whatever the key order or whitespace
+func (s *Script) ExpectJSON(v interface{}) *Script {
+	want, err := normalize(v)
+	if err != nil {
+		panic(fmt.Sprintf("wstest: invalid json expectation: %v", err))
+	}
+	s.steps = append(s.steps, step{
+		desc: "expect json " + compact(want),
+		expect: func(b []byte) error {
+			var got interface{}
+			if err := json.Unmarshal(b, &got); err != nil {
+				return fmt.Errorf("unexpected message, not json: %s", b)
+			}
+			var w interface{}
+			_ = json.Unmarshal(want, &w)
+			if !reflect.DeepEqual(got, w) {
+				g, _ := json.MarshalIndent(got, "", "  ")
+				return fmt.Errorf("unexpected message\n%s", diff(string(want), string(g)))
+			}
+			return nil
+		},
+	})
+	return s
+}
+
+// expects the client to send a message fn accepts, fn describes what's wrong otherwise
+func (s *Script) ExpectFunc(desc string, fn func(b []byte) error) *Script {
+	s.steps = append(s.steps, step{desc: "expect " + desc, expect: fn})
+	return s
+}
+
+// sends msg to the client
+func (s *Script) Send(msg string) *Script {
+	s.steps = append(s.steps, step{
+		desc: "send " + msg,
+		play: func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		},
+	})
+	return s
+}
+
+// sends v marshalled to json to the client
+func (s *Script) SendJSON(v interface{}) *Script {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("wstest: invalid json message: %v", err))
+	}
+	return s.Send(string(b))
+}
+
+// waits d before the next step, messages the client sends meanwhile are checked by the
+// next Expect
+func (s *Script) Wait(d time.Duration) *Script {
+	s.steps = append(s.steps, step{
+		desc: fmt.Sprintf("wait %v", d),
+		play: func(conn *websocket.Conn) error {
+			time.Sleep(d)
+			return nil
+		},
+	})
+	return s
+}
+
+// sends a close frame with code and reason and closes the connection
+func (s *Script) Close(code int, reason string) *Script {
+	s.steps = append(s.steps, step{
+		desc: fmt.Sprintf("close %d %s", code, reason),
+		play: func(conn *websocket.Conn) error {
+			msg := websocket.FormatCloseMessage(code, reason)
+			if err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(s.timeout)); err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	})
+	return s
+}
+
+// serves the script to the first client connecting to the returned host, on any path.
+// Once the test ends the script must have been played to the end without the client
+// sending anything unexpected
+func (s *Script) Start(t testing.TB) string {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	stop, done := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	up := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := false
+		once.Do(func() { first = true })
+		if !first {
+			http.Error(w, "script already playing", http.StatusConflict)
+			return
+		}
+		conn, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			s.fail("upgrade failed: %v", err)
+			conns <- nil
+			return
+		}
+		conns <- conn
+		go s.play(conn, stop, done)
+	}))
+
+	t.Cleanup(func() {
+		connected := true
+		once.Do(func() {
+			connected = false
+			s.mu.Lock()
+			s.failures = append(s.failures, "no client connected")
+			s.mu.Unlock()
+		})
+		if connected {
+			if conn := <-conns; conn != nil {
+				close(stop)
+				<-done
+				conn.Close()
+			}
+		}
+		srv.Close()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, f := range s.failures {
+			t.Errorf("%s", f)
+		}
+	})
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// starts the script and connects a client.Connection to it
+func (s *Script) Dial(t testing.TB) *client.Connection {
+	t.Helper()
+	host := s.Start(t)
+	conn, err := client.NewConnection(websocket.DefaultDialer, false, "script", host, "/", "", "")
+	if err != nil {
+		t.Fatalf("dialing script: %v", err)
+	}
+	return conn
+}
+
+// plays every step, then reports anything the client sends until the connection closes
+// or stop is closed
+func (s *Script) play(conn *websocket.Conn, stop, done chan struct{}) {
+	// read by a single goroutine, gorilla answers pings and closes concurrently with
+	// the script's writes
+	msgs := make(chan []byte, 64)
+	go func() {
+		defer close(msgs)
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			select {
+			case msgs <- b:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	defer close(done)
+	for i, st := range s.steps {
+		if st.play != nil {
+			if err := st.play(conn); err != nil {
+				s.fail("step %d, %s: %v", i+1, st.desc, err)
+				return
+			}
+			s.step()
+			continue
+		}
+
+		select {
+		case b, open := <-msgs:
+			if !open {
+				s.fail("step %d, %s: connection closed by the client", i+1, st.desc)
+				return
+			}
+			if err := st.expect(b); err != nil {
+				s.fail("step %d, %s: %v", i+1, st.desc, err)
+				return
+			}
+			s.step()
+		case <-time.After(s.timeout):
+			s.fail("step %d, %s: nothing received within %v", i+1, st.desc, s.timeout)
+			return
+		}
+	}
+
+	for {
+		select {
+		case b, open := <-msgs:
+			if !open {
+				return
+			}
+			s.fail("unexpected message after the script ended: %s", b)
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *Script) step() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.played++
+}
+
+func (s *Script) fail(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, fmt.Sprintf(format, args...)+s.remaining())
+}
+
+// the steps not played yet, guarded by mu
+func (s *Script) remaining() string {
+	if s.played+1 >= len(s.steps) {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\nsteps not played:")
+	for i, st := range s.steps[s.played+1:] {
+		fmt.Fprintf(&b, "\n  %d. %s", s.played+i+2, st.desc)
+	}
+	return b.String()
+}
+
+// indents v as json with sorted keys
+func normalize(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var i interface{}
+	if err := json.Unmarshal(b, &i); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(i, "", "  ")
+}
+
+func compact(b []byte) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, b) != nil {
+		return string(b)
+	}
+	return buf.String()
+}
+
+// line diff of want against got, lines only wanted are prefixed with - and lines only
+// got with +
+func diff(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+
+	// longest common subsequence of lines
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var out []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out = append(out, "  "+a[i])
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			out = append(out, "+ "+b[j])
+			j++
+		default:
+			out = append(out, "- "+a[i])
+			i++
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,144 @@
+package wstest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/mousybusiness/go-web/ws/envelope"
+	"github.com/mousybusiness/go-web/ws/wstest"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records test failures instead of failing
+type recordingT struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingT) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestScript(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	result, err := envelope.NewResult("1", chatMsg{Text: "hi"})
+	checkErr(t, err)
+	conn := wstest.NewScript().
+		ExpectJSON(map[string]interface{}{"type": "echo", "id": "1", "payload": chatMsg{Text: "hi"}}).
+		SendJSON(result).
+		Wait(time.Millisecond*20).
+		Send(`{"type":"chat.recv","payload":{"text":"yo"}}`).
+		Close(websocket.CloseGoingAway, "bye").
+		Dial(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgCh := make(chan []byte)
+	conn.Read(ctx, msgCh)
+
+	var res chatMsg
+	checkErr(t, conn.Call(ctx, "echo", chatMsg{Text: "hi"}, &res))
+	if res.Text != "hi" {
+		t.Fatalf("call result; want: %v, got: %v", "hi", res.Text)
+	}
+
+	if b := <-msgCh; string(b) != `{"type":"chat.recv","payload":{"text":"yo"}}` {
+		t.Fatalf("unexpected message %s", b)
+	}
+	if _, open := <-msgCh; open {
+		t.Fatal("expected the connection to be closed")
+	}
+
+	// the close code reaches the client
+	err = conn.Call(ctx, "echo", nil, nil)
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Text != "bye" {
+		t.Fatalf("expected going away close, got %v", err)
+	}
+}
+
+func TestScriptDiverges(t *testing.T) {
+	log.SetOutput(ioutil.Discard) // discard logs
+
+	tt := []struct {
+		name   string
+		script *wstest.Script
+		client func(conn *websocket.Conn)
+		want   []string
+	}{
+		{
+			"unexpected json",
+			wstest.NewScript().
+				ExpectJSON(map[string]interface{}{"type": "chat.send", "payload": chatMsg{Text: "hi"}}).
+				Send("never sent"),
+			func(conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"payload":{"text":"bye"},"type":"chat.send"}`))
+			},
+			[]string{"step 1", `-     "text": "hi"`, `+     "text": "bye"`, "2. send never sent"},
+		},
+		{
+			"unexpected text",
+			wstest.NewScript().Expect("ping"),
+			func(conn *websocket.Conn) {
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("pong"))
+			},
+			[]string{"step 1, expect ping", "- ping", "+ pong"},
+		},
+		{
+			"after the script",
+			wstest.NewScript().Send("hi"),
+			func(conn *websocket.Conn) {
+				_, _, _ = conn.ReadMessage()
+				_ = conn.WriteMessage(websocket.TextMessage, []byte("extra"))
+				time.Sleep(time.Millisecond * 20)
+			},
+			[]string{"unexpected message after the script ended: extra"},
+		},
+		{
+			"nothing received",
+			wstest.NewScript().Timeout(time.Millisecond * 20).Expect("ping"),
+			func(conn *websocket.Conn) {},
+			[]string{"nothing received within 20ms"},
+		},
+		{
+			"closed by the client",
+			wstest.NewScript().Expect("ping"),
+			func(conn *websocket.Conn) { conn.Close() },
+			[]string{"connection closed by the client"},
+		},
+		{
+			"no client",
+			wstest.NewScript().Expect("ping"),
+			nil,
+			[]string{"no client connected"},
+		},
+	}
+
+	for _, v := range tt {
+		rt := &recordingT{}
+		t.Run(v.name, func(t *testing.T) {
+			rt.TB = t
+			host := v.script.Start(rt)
+			if v.client == nil {
+				return
+			}
+			conn, _, err := websocket.DefaultDialer.Dial("ws://"+host+"/", nil)
+			checkErr(t, err)
+			v.client(conn)
+		})
+
+		// reported once the test ended
+		got := strings.Join(rt.errors, "\n")
+		for _, w := range v.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%s: expected failure to contain %q, got:\n%s", v.name, w, got)
+			}
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package wstest
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"github.com/gorilla/websocket"
 	"io"
 	"net/http"
+	"sync"
+	"testing"
+	"time"
 )
 
 type MockHappyConnection struct {
@@ -48,23 +52,131 @@ func (m MockDialer) Dial(urlStr string, requestHeader http.Header) (*websocket.C
 	return m.Conn, m.Resp, m.Err
 }
 
+// MockCleanConn is a server.CleanableConnection recording every uid cleaned up
 type MockCleanConn struct {
 	Conn       io.ReadWriteCloser
-	CleanedUp  bool
 	CleanupErr error
+
+	mu        sync.Mutex
+	cleanedUp []string
 }
 
-func (m MockCleanConn) GetConnection() io.ReadWriteCloser {
+func (m *MockCleanConn) GetConnection() io.ReadWriteCloser {
 	return m.Conn
 }
 
-func (m MockCleanConn) CleanUp(uid string) error {
-	m.CleanedUp = true
+func (m *MockCleanConn) CleanUp(uid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanedUp = append(m.cleanedUp, uid)
 	return m.CleanupErr
 }
 
-type MockRWCloser struct{}
+// uids cleaned up so far, in order
+func (m *MockCleanConn) CleanedUp() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.cleanedUp...)
+}
+
+// fails t unless uid is cleaned up within a second, cleanup usually happens on the
+// connection's read goroutine
+func (m *MockCleanConn) AssertCleanedUp(t testing.TB, uid string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		for _, v := range m.CleanedUp() {
+			if v == uid {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("expected %s to be cleaned up, got %v", uid, m.CleanedUp())
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// fails t if uid has been cleaned up
+func (m *MockCleanConn) AssertNotCleanedUp(t testing.TB, uid string) {
+	t.Helper()
+	for _, v := range m.CleanedUp() {
+		if v == uid {
+			t.Errorf("expected %s not to be cleaned up", uid)
+			return
+		}
+	}
+}
+
+// MockRWCloser is an in memory io.ReadWriteCloser, reads are served from what was fed
+// to it and end with io.EOF, everything written is recorded
+type MockRWCloser struct {
+	mu      sync.Mutex
+	unread  bytes.Buffer
+	read    int
+	written bytes.Buffer
+	closes  int
+}
+
+// creates a MockRWCloser serving b to reads
+func NewMockRWCloser(b []byte) *MockRWCloser {
+	m := &MockRWCloser{}
+	m.Feed(b)
+	return m
+}
+
+// queues b to be read
+func (rw *MockRWCloser) Feed(b []byte) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.unread.Write(b)
+}
+
+func (rw *MockRWCloser) Read(p []byte) (n int, err error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closes > 0 {
+		return 0, io.ErrClosedPipe
+	}
+	n, err = rw.unread.Read(p)
+	rw.read += n
+	return n, err
+}
+
+func (rw *MockRWCloser) Write(p []byte) (n int, err error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closes > 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return rw.written.Write(p)
+}
+
+func (rw *MockRWCloser) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.closes++
+	return nil
+}
+
+// bytes read so far
+func (rw *MockRWCloser) BytesRead() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.read
+}
+
+// everything written so far
+func (rw *MockRWCloser) Written() []byte {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return append([]byte(nil), rw.written.Bytes()...)
+}
 
-func (rw MockRWCloser) Read(p []byte) (n int, err error)  { return 0, nil }
-func (rw MockRWCloser) Write(p []byte) (n int, err error) { return 0, nil }
-func (rw MockRWCloser) Close() error                      { return nil }
+// number of times Close was called
+func (rw *MockRWCloser) Closes() int {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.closes
+}
@@ -0,0 +1,48 @@
+package wstest_test
+
+import (
+	"github.com/mousybusiness/go-web/ws/server"
+	"github.com/mousybusiness/go-web/ws/wstest"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestMockCleanConn(t *testing.T) {
+	var _ server.CleanableConnection = &wstest.MockCleanConn{}
+
+	m := &wstest.MockCleanConn{}
+	checkErr(t, m.CleanUp("a"))
+	checkErr(t, m.CleanUp("b"))
+	m.AssertCleanedUp(t, "a")
+	m.AssertNotCleanedUp(t, "c")
+
+	rt := &recordingT{TB: t}
+	m.AssertNotCleanedUp(rt, "b")
+	if len(rt.errors) != 1 {
+		t.Fatalf("expected the test to be failed, got %v", rt.errors)
+	}
+}
+
+func TestMockRWCloser(t *testing.T) {
+	rw := wstest.NewMockRWCloser([]byte("stub"))
+	b, err := ioutil.ReadAll(rw)
+	checkErr(t, err)
+	if string(b) != "stub" || rw.BytesRead() != 4 {
+		t.Fatalf("read; want: %v, got: %s %d", "stub", b, rw.BytesRead())
+	}
+
+	_, err = rw.Write([]byte("yo"))
+	checkErr(t, err)
+	if string(rw.Written()) != "yo" {
+		t.Fatalf("written; want: %v, got: %s", "yo", rw.Written())
+	}
+
+	checkErr(t, rw.Close())
+	if _, err := rw.Write([]byte("yo")); err != io.ErrClosedPipe {
+		t.Fatalf("expected writes to fail once closed, got %v", err)
+	}
+	if rw.Closes() != 1 {
+		t.Fatalf("want 1 close, got %d", rw.Closes())
+	}
+}